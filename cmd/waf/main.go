@@ -4,18 +4,25 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	_ "expvar"
+	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/yxorp/internal/cache"
 	"github.com/yxorp/internal/config"
 	"github.com/yxorp/internal/middleware"
 	"github.com/yxorp/internal/proxy"
+	"github.com/yxorp/internal/quota"
+	"github.com/yxorp/internal/route"
 	"github.com/yxorp/internal/rules"
 	"github.com/yxorp/internal/server"
 	"github.com/yxorp/internal/stats"
@@ -41,12 +48,17 @@ func main() {
 	// Initialize Config Manager
 	cfgManager := config.NewManager(cfg)
 
-	// 3. Initialize Load Balancer
-	rp, err := proxy.NewLoadBalancer(cfg.Proxy.Targets)
+	// 3. Initialize upstream pools and the routing table
+	rp, err := proxy.NewPools(cfg.Proxy)
 	if err != nil {
 		logger.Error("Failed to initialize load balancer", "error", err)
 		os.Exit(1)
 	}
+	routes, err := route.NewTable(cfg.Proxy.Routes)
+	if err != nil {
+		logger.Error("Failed to initialize routes", "error", err)
+		os.Exit(1)
+	}
 
 	// 4. Initialize Security Rules Engine
 	ruleEngine, err := rules.NewEngine(cfg.Security.Rules)
@@ -59,16 +71,209 @@ func main() {
 	var engineMu sync.RWMutex
 	currentEngine := ruleEngine
 
+	// 5. Initialize Rate Limiter
+	rateLimiter, err := middleware.NewRateLimiter(cfg.Security.RateLimit)
+	if err != nil {
+		logger.Error("Failed to initialize rate limiter", "error", err)
+		os.Exit(1)
+	}
+
+	// Proof-of-work challenge for suspected bots
+	challenge := middleware.NewChallenge(cfg.Security.Challenge)
+
+	// Proxies whose forwarding headers name the client
+	trustedProxies, err := middleware.NewTrustedProxies(cfg.Security.TrustedProxies)
+	if err != nil {
+		logger.Error("Failed to parse trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	middleware.SetTrustedProxies(trustedProxies)
+
+	// CIDR allow/deny lists
+	ipFilter, err := middleware.NewIPFilter(cfg.Security.IPFilter)
+	if err != nil {
+		logger.Error("Failed to initialize IP filter", "error", err)
+		os.Exit(1)
+	}
+
+	// GeoIP country/ASN lookups and policies
+	geoIP, err := middleware.NewGeoIP(cfg.Security.GeoIP)
+	if err != nil {
+		logger.Error("Failed to initialize GeoIP", "error", err)
+		os.Exit(1)
+	}
+
+	// IP reputation feeds
+	threatFeeds, err := middleware.NewThreatFeeds(cfg.Security.ThreatFeeds)
+	if err != nil {
+		logger.Error("Failed to initialize threat feeds", "error", err)
+		os.Exit(1)
+	}
+
+	// Reverse/forward DNS verification of search engine crawlers
+	goodBots, err := middleware.NewGoodBots(cfg.Security.GoodBots)
+	if err != nil {
+		logger.Error("Failed to initialize good bot verification", "error", err)
+		os.Exit(1)
+	}
+
+	// JA3/JA4 fingerprint block lists
+	tlsFingerprint := middleware.NewTLSFingerprint(cfg.Security.TLSFingerprint)
+
+	// Jail bans repeat offenders before the rest of the chain sees them
+	jail, err := middleware.NewJail(cfg.Security.Jail)
+	if err != nil {
+		logger.Error("Failed to initialize jail", "error", err)
+		os.Exit(1)
+	}
+
+	// Decoy paths and hidden form fields ban scanners on first touch
+	honeypot := middleware.NewHoneypot(cfg.Security.Honeypot, jail)
+
+	// Error-ratio and distinct-path tracking to classify scanners
+	scannerDetector, err := middleware.NewScannerDetector(cfg.Security.Scanner, jail)
+	if err != nil {
+		logger.Error("Failed to initialize scanner detection", "error", err)
+		os.Exit(1)
+	}
+
+	engineGetter := func() *rules.Engine {
+		engineMu.RLock()
+		defer engineMu.RUnlock()
+		return currentEngine
+	}
+
+	// WebSocket message limits and inspection
+	webSocket := middleware.NewWebSocket(cfg.Security.WebSocket, engineGetter)
+
+	// Shared response cache in front of the upstream pools
+	responseCache, err := cache.New(cfg.Proxy)
+	if err != nil {
+		logger.Error("Failed to initialize response cache", "error", err)
+		os.Exit(1)
+	}
+
+	// applyConfig pushes a new configuration into the running components and,
+	// when save is set, writes it to the config file first. Everything that
+	// can fail is done before anything is applied, so a bad config leaves the
+	// running one untouched.
+	var applyMu sync.Mutex
+	errSaveConfig := errors.New("failed to save config")
+	applyConfig := func(newCfg *config.Config, save bool) error {
+		applyMu.Lock()
+		defer applyMu.Unlock()
+
+		newEngine, err := rules.NewEngine(newCfg.Security.Rules)
+		if err != nil {
+			return err
+		}
+		newRoutes, err := route.NewTable(newCfg.Proxy.Routes)
+		if err != nil {
+			return err
+		}
+		newTrustedProxies, err := middleware.NewTrustedProxies(newCfg.Security.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		applyPools, err := rp.Prepare(newCfg.Proxy)
+		if err != nil {
+			return err
+		}
+		applyIPFilter, err := ipFilter.Prepare(newCfg.Security.IPFilter)
+		if err != nil {
+			return err
+		}
+		applyGeoIP, err := geoIP.Prepare(newCfg.Security.GeoIP)
+		if err != nil {
+			return err
+		}
+		applyThreatFeeds, err := threatFeeds.Prepare(newCfg.Security.ThreatFeeds)
+		if err != nil {
+			return err
+		}
+		applyGoodBots, err := goodBots.Prepare(newCfg.Security.GoodBots)
+		if err != nil {
+			return err
+		}
+		applyScanner, err := scannerDetector.Prepare(newCfg.Security.Scanner)
+		if err != nil {
+			return err
+		}
+		applyRateLimit, err := rateLimiter.Prepare(newCfg.Security.RateLimit)
+		if err != nil {
+			return err
+		}
+		applyJail, err := jail.Prepare(newCfg.Security.Jail)
+		if err != nil {
+			return err
+		}
+		// Last, as it may open a new disk store
+		applyCache, err := responseCache.Prepare(newCfg.Proxy)
+		if err != nil {
+			return err
+		}
+		if save {
+			if err := cfgManager.Update(configPath, newCfg); err != nil {
+				return fmt.Errorf("%w: %v", errSaveConfig, err)
+			}
+		} else {
+			cfgManager.Set(newCfg)
+		}
+
+		// Nothing below can fail
+		applyPools()
+		routes.Replace(newRoutes)
+		applyCache()
+		middleware.SetTrustedProxies(newTrustedProxies)
+		applyIPFilter()
+		applyGeoIP()
+		applyThreatFeeds()
+		applyGoodBots()
+		applyScanner()
+		applyRateLimit()
+		applyJail()
+
+		engineMu.Lock()
+		currentEngine = newEngine
+		engineMu.Unlock()
+
+		challenge.Update(newCfg.Security.Challenge)
+		tlsFingerprint.Update(newCfg.Security.TLSFingerprint)
+		honeypot.Update(newCfg.Security.Honeypot)
+		webSocket.Update(newCfg.Security.WebSocket)
+		return nil
+	}
+
+	// watchedModTime returns the latest modification time of the config file
+	// and the external files it references
+	watchedModTime := func() (time.Time, error) {
+		info, err := os.Stat(configPath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		latest := info.ModTime()
+		secCfg := cfgManager.Get().Security
+		paths := []string{secCfg.GeoIP.CountryDB, secCfg.GeoIP.ASNDB}
+		paths = append(paths, secCfg.IPFilter.AllowFiles...)
+		paths = append(paths, secCfg.IPFilter.DenyFiles...)
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+		return latest, nil
+	}
+
 	// Config Watcher
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
 		var lastMod time.Time
 		for range ticker.C {
-			info, err := os.Stat(configPath)
+			modTime, err := watchedModTime()
 			if err != nil {
 				continue
 			}
-			if !lastMod.IsZero() && info.ModTime().After(lastMod) {
+			if !lastMod.IsZero() && modTime.After(lastMod) {
 				logger.Info("Configuration change detected, reloading...")
 				newCfg, err := config.LoadConfig(configPath)
 				if err != nil {
@@ -76,59 +281,86 @@ func main() {
 					continue
 				}
 
-				newEngine, err := rules.NewEngine(newCfg.Security.Rules)
-				if err != nil {
-					logger.Error("Failed to reload rules", "error", err)
+				if err := applyConfig(newCfg, false); err != nil {
+					logger.Error("Failed to apply reloaded config", "error", err)
 					continue
 				}
 
-				cfgManager.Set(newCfg)
-
-				engineMu.Lock()
-				currentEngine = newEngine
-				engineMu.Unlock()
-
 				logger.Info("Configuration reloaded successfully")
 			}
-			lastMod = info.ModTime()
+			lastMod = modTime
 		}
 	}()
 
-	// 5. Initialize Rate Limiter
-	rateLimiter := middleware.NewRateLimiter(cfg.Security.RateLimit)
+	// 6. Initialize Concurrency Limiter (adaptive limit follows upstream latency)
+	concurrencyLimiter := middleware.NewConcurrencyLimiter(cfg.Security.Concurrency)
+	rp.AddObserver(concurrencyLimiter)
+
+	// Persistent per-API-key quotas
+	quotaManager, err := quota.NewManager(cfg.Security.Quota)
+	if err != nil {
+		logger.Error("Failed to initialize quotas", "error", err)
+		os.Exit(1)
+	}
 
 	// 7. Setup Middleware Chain
-	// Request Flow: Client -> [Rate Limiter] -> [Security Rules Engine] -> [Request Logger] -> [Circuit Breaker] -> [Reverse Proxy] -> Target Server
+	// Request Flow: Client -> [IP Filter] -> [Jail] -> [Honeypot] -> [GeoIP] -> [TLS Fingerprint] -> [Challenge] -> [Threat Feeds] -> [Rate Limiter] -> [Quotas] -> [Security Rules Engine] -> [WebSocket] -> [Request Logger] -> [Cache] -> [Concurrency Limiter] -> [Circuit Breaker] -> [Reverse Proxy] -> Target Server
 
 	// We build the chain from outer to inner.
 	// The handler passed to Chain is the final handler (Reverse Proxy).
 	// The middlewares are applied in order.
 
 	// Current available middlewares:
-	// - RecoveryMiddleware (Top level)
+	// - GRPCMiddleware (Top level, WAF errors as gRPC statuses for gRPC calls)
+	// - RecoveryMiddleware
+	// - Routes (Host/path routing to upstream pools + per-route security)
+	// - IPFilter (CIDR allow/deny lists)
+	// - Jail (Temporary bans for repeat offenders)
+	// - GoodBots (DNS-verified crawlers skip inspection, imposters blocked)
+	// - Honeypot (Decoy paths/fields + tarpit)
+	// - GeoIP (Country/ASN lookup + geo policies)
+	// - TLSFingerprint (JA3/JA4 block lists)
 	// - MetricsMiddleware
+	// - Challenge (Proof-of-work interstitial + "under attack" mode)
+	// - ScannerDetector (Error ratio + distinct paths per client)
+	// - ThreatFeeds (IP reputation lists)
 	// - RateLimiter
+	// - Quota (Daily/monthly usage per API key)
 	// - SecurityMiddleware (User-Agent blocking + Rules Engine)
+	// - WebSocket (Message limits + inspection on upgraded connections)
 	// - RequestLogger
+	// - Cache (RFC 9111 response cache, per-route keys)
+	// - ConcurrencyLimiter (In-flight caps + load shedding)
 	// - CircuitBreaker
 
 	finalHandler := middleware.Chain(
 		rp,
+		middleware.GRPCMiddleware,
 		middleware.RecoveryMiddleware,
+		routes.Middleware,
+		ipFilter.Middleware,
+		jail.Middleware,
+		goodBots.Middleware,
+		honeypot.Middleware,
+		geoIP.Middleware,
+		tlsFingerprint.Middleware,
 		middleware.RequestIDMiddleware(),
 		middleware.SecureHeadersMiddleware(),
 		middleware.GzipMiddleware(),
 		middleware.MetricsMiddleware,
+		challenge.Middleware,
+		scannerDetector.Middleware,
+		threatFeeds.Middleware,
 		rateLimiter.Middleware,
+		quotaManager.Middleware,
 		middleware.SecurityMiddleware(
 			func() config.SecurityConfig { return cfgManager.Get().Security },
-			func() *rules.Engine {
-				engineMu.RLock()
-				defer engineMu.RUnlock()
-				return currentEngine
-			},
+			engineGetter,
 		),
+		webSocket.Middleware,
 		middleware.RequestLogger,
+		responseCache.Middleware,
+		concurrencyLimiter.Middleware,
 	)
 
 	// 8. Start Server
@@ -164,6 +396,172 @@ func main() {
 			json.NewEncoder(w).Encode(cfgManager.Get().Security.Rules)
 		})
 
+		http.HandleFunc("/api/bans", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(jail.Bans())
+			case http.MethodDelete:
+				ip := r.URL.Query().Get("ip")
+				if ip == "" {
+					http.Error(w, "Missing ip parameter", http.StatusBadRequest)
+					return
+				}
+				if !jail.Unban(ip) {
+					http.Error(w, "No active ban for "+ip, http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Ban lifted for " + ip})
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+
+		http.HandleFunc("/api/honeypot", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(honeypot.Flagged())
+		})
+
+		// editTargets changes the targets of one pool, applies the result and
+		// saves it so the change survives reloads and restarts
+		editTargets := func(pool string, edit func([]config.Target) ([]config.Target, error)) error {
+			applyMu.Lock()
+			defer applyMu.Unlock()
+
+			newCfg := *cfgManager.Get()
+			proxyCfg, err := proxy.EditTargets(newCfg.Proxy, pool, edit)
+			if err != nil {
+				return err
+			}
+			newCfg.Proxy = proxyCfg
+			apply, err := rp.Prepare(newCfg.Proxy)
+			if err != nil {
+				return err
+			}
+			if err := cfgManager.Update(configPath, &newCfg); err != nil {
+				return fmt.Errorf("%w: %v", errSaveConfig, err)
+			}
+			apply()
+			return nil
+		}
+
+		http.HandleFunc("/api/upstreams", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				json.NewEncoder(w).Encode(rp.Status())
+				return
+			}
+
+			q := r.URL.Query()
+			pool, target := q.Get("pool"), q.Get("url")
+			if pool == "" {
+				pool = proxy.DefaultPool
+			}
+			if target == "" {
+				http.Error(w, "Missing url parameter", http.StatusBadRequest)
+				return
+			}
+			weight := 0
+			if v := q.Get("weight"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					http.Error(w, "Invalid weight parameter", http.StatusBadRequest)
+					return
+				}
+				weight = n
+			}
+
+			var err error
+			switch r.Method {
+			case http.MethodPost:
+				err = editTargets(pool, func(targets []config.Target) ([]config.Target, error) {
+					if proxy.TargetIndex(targets, target) >= 0 {
+						return nil, proxy.ErrTargetExists
+					}
+					return append(targets, config.Target{URL: target, Weight: weight}), nil
+				})
+			case http.MethodDelete:
+				err = editTargets(pool, func(targets []config.Target) ([]config.Target, error) {
+					i := proxy.TargetIndex(targets, target)
+					if i < 0 {
+						return nil, proxy.ErrUnknownTarget
+					}
+					return slices.Delete(targets, i, i+1), nil
+				})
+			case http.MethodPatch:
+				if weight > 0 {
+					err = editTargets(pool, func(targets []config.Target) ([]config.Target, error) {
+						i := proxy.TargetIndex(targets, target)
+						if i < 0 {
+							return nil, proxy.ErrUnknownTarget
+						}
+						targets[i].Weight = weight
+						return targets, nil
+					})
+				}
+				if v := q.Get("drain"); err == nil && v != "" {
+					drain, perr := strconv.ParseBool(v)
+					if perr != nil {
+						http.Error(w, "Invalid drain parameter", http.StatusBadRequest)
+						return
+					}
+					err = rp.SetDraining(pool, target, drain)
+				}
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			switch {
+			case errors.Is(err, proxy.ErrUnknownPool), errors.Is(err, proxy.ErrUnknownTarget):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, proxy.ErrTargetExists):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, errSaveConfig):
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			case err != nil:
+				http.Error(w, "Failed to update upstreams: "+err.Error(), http.StatusBadRequest)
+			default:
+				json.NewEncoder(w).Encode(rp.Status())
+			}
+		})
+
+		http.HandleFunc("/api/quotas", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			key := r.URL.Query().Get("key")
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(quotaManager.Usage(key))
+			case http.MethodDelete:
+				if key == "" {
+					http.Error(w, "Missing key parameter", http.StatusBadRequest)
+					return
+				}
+				n, err := quotaManager.Reset(key, r.URL.Query().Get("limit"))
+				if err != nil {
+					http.Error(w, "Failed to reset quota: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]any{"status": "ok", "reset": n})
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+
+		http.HandleFunc("/api/cache", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(responseCache.Stats())
+			case http.MethodDelete:
+				q := r.URL.Query()
+				n := responseCache.Purge(q.Get("host"), q.Get("prefix"))
+				json.NewEncoder(w).Encode(map[string]any{"status": "ok", "purged": n})
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+
 		http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			if r.Method == http.MethodGet {
@@ -177,29 +575,16 @@ func main() {
 					return
 				}
 
-				// Validate?
-				// For now, trust the user (admin).
-
-				if err := cfgManager.Update(configPath, &newCfg); err != nil {
-					http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+				if err := applyConfig(&newCfg, true); err != nil {
+					if errors.Is(err, errSaveConfig) {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					} else {
+						http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+					}
 					return
 				}
 
-				// Force reload of components?
-				// The main loop watches the file, so it should pick up changes automatically within 10s.
-				// But we can also manually trigger updates if we exposed them.
-				// Relying on file watcher is safer but slower.
-				// Let's explicitly update the in-memory rules engine right away if rules changed.
-
-				// Re-init rules engine for immediate effect
-				newEngine, err := rules.NewEngine(newCfg.Security.Rules)
-				if err == nil {
-					engineMu.Lock()
-					currentEngine = newEngine
-					engineMu.Unlock()
-				}
-
-				json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Configuration saved. Reloading..."})
+				json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Configuration saved and applied."})
 			} else {
 				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			}
@@ -232,5 +617,9 @@ func main() {
 		logger.Error("Server forced to shutdown", "error", err)
 	}
 
+	if err := quotaManager.Close(); err != nil {
+		logger.Error("Failed to persist quota state", "error", err)
+	}
+
 	logger.Info("Server exited properly")
 }
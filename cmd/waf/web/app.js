@@ -84,13 +84,14 @@ function startPolling() {
 
 async function fetchData() {
     try {
-        const [vars, stats, logs] = await Promise.all([
+        const [vars, stats, logs, flagged] = await Promise.all([
             fetch('/debug/vars').then(r => r.json()),
             fetch('/api/stats').then(r => r.json()),
-            fetch('/api/logs').then(r => r.json())
+            fetch('/api/logs').then(r => r.json()),
+            fetch('/api/honeypot').then(r => r.json())
         ]);
 
-        updateDashboard(vars, stats, logs);
+        updateDashboard(vars, stats, logs, flagged);
         document.getElementById('ctx-status').innerText = "CONNECTED";
         document.getElementById('ctx-status').style.color = "#10b981";
     } catch (e) {
@@ -100,7 +101,7 @@ async function fetchData() {
     }
 }
 
-function updateDashboard(vars, stats, logs) {
+function updateDashboard(vars, stats, logs, flagged) {
     const total = vars.requests_total || 0;
     const blocked = vars.requests_blocked || 0;
     const latencyTotal = vars.latency_total_ms || 0;
@@ -125,6 +126,36 @@ function updateDashboard(vars, stats, logs) {
     // Uptime
     document.getElementById('uptime').innerText = stats.uptime || "0s";
 
+    // Threat feed hits
+    const feedHits = Object.entries(vars.threat_feed_hits || {}).sort((a, b) => b[1] - a[1]);
+    const feedsBody = document.querySelector('#feeds-table tbody');
+    feedsBody.innerHTML = feedHits.length ? '' : '<tr><td class="text-muted">No hits</td></tr>';
+    feedHits.forEach(([feed, hits]) => {
+        const tr = document.createElement('tr');
+        const name = document.createElement('td');
+        name.className = 'font-mono';
+        name.textContent = feed;
+        const count = document.createElement('td');
+        count.className = 'text-danger font-bold';
+        count.textContent = hits;
+        tr.append(name, count);
+        feedsBody.appendChild(tr);
+    });
+
+    // Honeypot
+    const honeypotBody = document.querySelector('#honeypot-table tbody');
+    honeypotBody.innerHTML = flagged.length ? '' : '<tr><td class="text-muted" colspan="4">No scanners flagged</td></tr>';
+    flagged.forEach(ban => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td class="font-mono">${ban.ip}</td>
+            <td class="font-mono text-warning">${ban.reason.replace(/^honeypot /, '')}</td>
+            <td class="font-mono text-muted">${new Date(ban.banned_at).toLocaleTimeString()}</td>
+            <td class="font-mono text-muted">${new Date(ban.expires_at).toLocaleTimeString()}</td>
+        `;
+        honeypotBody.appendChild(tr);
+    });
+
     // Logs
     const tbody = document.querySelector('#logs-table tbody');
     tbody.innerHTML = '';
@@ -137,9 +168,9 @@ function updateDashboard(vars, stats, logs) {
         if (log.status_code >= 500) statusColor = "text-danger";
 
         // Action Style
-        let actionStyle = log.action === "BLOCKED" ?
-            '<span class="badge badge-danger">BLOCKED</span>' :
-            '<span class="badge badge-success">ALLOWED</span>';
+        let actionStyle = '<span class="badge badge-success">ALLOWED</span>';
+        if (log.action === "BLOCKED") actionStyle = '<span class="badge badge-danger">BLOCKED</span>';
+        if (log.action === "TRAPPED") actionStyle = '<span class="badge badge-warning">TRAPPED</span>';
 
         tr.innerHTML = `
             <td class="font-mono text-muted">${new Date(log.timestamp).toLocaleTimeString()}</td>
@@ -162,7 +193,7 @@ async function loadConfig() {
 
         // Populate inputs
         document.getElementById('cfg-port').value = cfg.server.port;
-        document.getElementById('cfg-targets').value = cfg.proxy.targets.join(', ');
+        document.getElementById('cfg-targets').value = cfg.proxy.targets.map(t => t.url).join(', ');
         document.getElementById('cfg-ratelimit').value = cfg.security.rate_limit.requests_per_minute;
         document.getElementById('cfg-maxbody').value = cfg.security.max_body_size || 0;
 
@@ -182,7 +213,10 @@ async function saveConfig(e) {
     newCfg.server.port = document.getElementById('cfg-port').value;
 
     const targetsStr = document.getElementById('cfg-targets').value;
-    newCfg.proxy.targets = targetsStr.split(',').map(s => s.trim().replace(/\/$/, '')).filter(s => s);
+    // Keep the weights of targets that are still listed
+    const weights = Object.fromEntries(currentConfig.proxy.targets.map(t => [t.url, t.weight]));
+    newCfg.proxy.targets = targetsStr.split(',').map(s => s.trim().replace(/\/$/, '')).filter(s => s)
+        .map(url => ({ url, weight: weights[url] || 1 }));
 
     newCfg.security.rate_limit.requests_per_minute = parseInt(document.getElementById('cfg-ratelimit').value);
     newCfg.security.max_body_size = parseInt(document.getElementById('cfg-maxbody').value);
@@ -0,0 +1,200 @@
+// Package botverify checks that clients claiming to be search engine crawlers
+// really are, using a reverse DNS lookup confirmed by a forward lookup.
+package botverify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/lru"
+)
+
+const (
+	defaultTTL        = 24 * time.Hour
+	defaultTimeout    = 2 * time.Second
+	defaultMaxEntries = 100000
+)
+
+// DefaultBots are the crawlers verified when none are configured, with the
+// domains their operators publish for reverse DNS verification.
+var DefaultBots = []config.GoodBot{
+	{Name: "googlebot", UserAgents: []string{"Googlebot", "AdsBot-Google", "Mediapartners-Google", "Google-InspectionTool"}, Domains: []string{"googlebot.com", "google.com", "googleusercontent.com"}},
+	{Name: "bingbot", UserAgents: []string{"bingbot", "BingPreview", "msnbot"}, Domains: []string{"search.msn.com"}},
+	{Name: "applebot", UserAgents: []string{"Applebot"}, Domains: []string{"applebot.apple.com"}},
+	{Name: "yandexbot", UserAgents: []string{"YandexBot", "YandexImages"}, Domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{Name: "baiduspider", UserAgents: []string{"Baiduspider"}, Domains: []string{"baidu.com", "baidu.jp"}},
+}
+
+// Match returns the bot whose User-Agent substring appears in userAgent.
+func Match(bots []config.GoodBot, userAgent string) (config.GoodBot, bool) {
+	ua := strings.ToLower(userAgent)
+	for _, bot := range bots {
+		for _, s := range bot.UserAgents {
+			if s != "" && strings.Contains(ua, strings.ToLower(s)) {
+				return bot, true
+			}
+		}
+	}
+	return config.GoodBot{}, false
+}
+
+// Resolver performs the DNS lookups. *net.Resolver implements it; tests can
+// plug in a stub.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// NewResolver returns a resolver that queries the DNS server at addr
+// (host:port), or the system resolver when addr is empty.
+func NewResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// verdict is a cached verification result. done is closed once the lookups
+// finished, so concurrent requests for the same client share them.
+type verdict struct {
+	done     chan struct{}
+	verified bool
+	err      error
+	expires  time.Time
+}
+
+func (v *verdict) settled() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Verifier checks client addresses against crawler domains and caches the
+// verdicts. Lookup errors are returned but not cached. At most
+// defaultMaxEntries verdicts are kept, dropping the least recently used.
+type Verifier struct {
+	resolver Resolver
+	ttl      time.Duration
+	timeout  time.Duration
+	cache    *lru.Cache[*verdict]
+}
+
+// New returns a Verifier. A zero ttl or timeout selects the default.
+func New(resolver Resolver, ttl, timeout time.Duration) *Verifier {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Verifier{resolver: resolver, ttl: ttl, timeout: timeout, cache: lru.New[*verdict](defaultMaxEntries, nil)}
+}
+
+// Verify reports whether ip reverse-resolves to a name within one of domains
+// that resolves back to ip.
+func (v *Verifier) Verify(ctx context.Context, ip string, domains []string) (bool, error) {
+	key := ip + "\x00" + strings.Join(domains, ",")
+
+	var e *verdict
+	cached := false
+	v.cache.Update(key, func(cur **verdict) {
+		if *cur != nil && !((*cur).settled() && time.Now().After((*cur).expires)) {
+			e, cached = *cur, true
+			return
+		}
+		e = &verdict{done: make(chan struct{})}
+		*cur = e
+	})
+	if cached {
+		select {
+		case <-e.done:
+			return e.verified, e.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	// The lookups are shared, so they must not be cut short when the
+	// request that started them goes away
+	lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), v.timeout)
+	defer cancel()
+	e.verified, e.err = v.lookup(lookupCtx, ip, domains)
+	e.expires = time.Now().Add(v.ttl)
+	close(e.done)
+
+	if e.err != nil {
+		v.cache.DeleteIf(key, func(cur **verdict) bool { return *cur == e })
+	}
+	return e.verified, e.err
+}
+
+// Len returns the number of cached verdicts.
+func (v *Verifier) Len() int {
+	return v.cache.Len()
+}
+
+func (v *Verifier) lookup(ctx context.Context, ip string, domains []string) (bool, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, nil
+	}
+
+	names, err := v.resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !inDomains(name, domains) {
+			continue
+		}
+		hosts, err := v.resolver.LookupHost(ctx, name)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		for _, h := range hosts {
+			if resolved, err := netip.ParseAddr(h); err == nil && resolved.Unmap() == addr.Unmap() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func inDomains(name string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err means the name has no records, which is a
+// verdict rather than a lookup failure.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,215 @@
+package botverify
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// dnsStub is a minimal UDP DNS server answering PTR and A queries from maps.
+type dnsStub struct {
+	conn    net.PacketConn
+	ptr     map[string]string // "1.66.249.66.in-addr.arpa." -> name
+	a       map[string]string // name -> IPv4
+	queries atomic.Int64
+}
+
+func startDNSStub(t *testing.T, ptr, a map[string]string) *dnsStub {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsStub{conn: conn, ptr: ptr, a: a}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.queries.Add(1)
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsStub) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	// Question name starts right after the header
+	var labels []string
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		l := int(q[i])
+		labels = append(labels, string(q[i+1:i+1+l]))
+		i += 1 + l
+	}
+	qend := i + 5
+	name := strings.ToLower(strings.Join(labels, ".") + ".")
+	qtype := binary.BigEndian.Uint16(q[i+1:])
+
+	var rdata [][]byte
+	found := false
+	switch qtype {
+	case 12: // PTR
+		if target, ok := s.ptr[name]; ok {
+			found = true
+			rdata = append(rdata, encodeName(target))
+		}
+	case 1: // A
+		if ip, ok := s.a[name]; ok {
+			found = true
+			rdata = append(rdata, netip.MustParseAddr(ip).AsSlice())
+		}
+	default: // AAAA and others: the name exists but has no such records
+		_, found = s.a[name]
+	}
+
+	resp := append([]byte{}, q[:2]...)
+	flags := uint16(0x8180)
+	if !found {
+		flags |= 3 // NXDOMAIN
+	}
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, q[12:qend]...)
+	for _, rd := range rdata {
+		resp = append(resp, 0xc0, 12) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rd)))
+		resp = append(resp, rd...)
+	}
+	return resp
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func TestVerifier(t *testing.T) {
+	stub := startDNSStub(t,
+		map[string]string{
+			"1.66.249.66.in-addr.arpa.": "crawl-66-249-66-1.googlebot.com.",
+			"2.0.0.10.in-addr.arpa.":    "crawl-fake.googlebot.com.evil.example.",
+			"3.0.0.10.in-addr.arpa.":    "crawl-10-0-0-3.googlebot.com.",
+		},
+		map[string]string{
+			"crawl-66-249-66-1.googlebot.com.":       "66.249.66.1",
+			"crawl-fake.googlebot.com.evil.example.": "10.0.0.2",
+			"crawl-10-0-0-3.googlebot.com.":          "66.249.66.99", // forward lookup disagrees
+		},
+	)
+	v := New(NewResolver(stub.conn.LocalAddr().String()), 0, 0)
+	domains := []string{"googlebot.com", "google.com"}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"66.249.66.1", true},
+		{"10.0.0.2", false}, // wrong domain
+		{"10.0.0.3", false}, // forward-confirm fails
+		{"10.0.0.4", false}, // no PTR record
+	}
+	for _, tt := range tests {
+		got, err := v.Verify(context.Background(), tt.ip, domains)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.ip, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	// Verdicts are cached
+	queries := stub.queries.Load()
+	if ok, _ := v.Verify(context.Background(), "66.249.66.1", domains); !ok {
+		t.Error("expected cached verdict")
+	}
+	if stub.queries.Load() != queries {
+		t.Error("expected no DNS queries for a cached verdict")
+	}
+	if v.Len() != len(tests) {
+		t.Errorf("expected %d cached verdicts, got %d", len(tests), v.Len())
+	}
+}
+
+type failingResolver struct{ calls int }
+
+func (r *failingResolver) LookupAddr(context.Context, string) ([]string, error) {
+	r.calls++
+	return nil, errors.New("timeout")
+}
+
+func (r *failingResolver) LookupHost(context.Context, string) ([]string, error) {
+	return nil, errors.New("timeout")
+}
+
+func TestVerifier_ErrorsNotCached(t *testing.T) {
+	r := &failingResolver{}
+	v := New(r, 0, 0)
+	for range 2 {
+		if _, err := v.Verify(context.Background(), "66.249.66.1", []string{"googlebot.com"}); err == nil {
+			t.Fatal("expected lookup error")
+		}
+	}
+	if r.calls != 2 || v.Len() != 0 {
+		t.Errorf("expected errors to be retried, got %d calls and %d cached", r.calls, v.Len())
+	}
+}
+
+// notFoundResolver answers every lookup with "no such host".
+type notFoundResolver struct{}
+
+func (notFoundResolver) LookupAddr(context.Context, string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+}
+
+func (notFoundResolver) LookupHost(context.Context, string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+}
+
+func TestVerifier_Bounded(t *testing.T) {
+	v := New(notFoundResolver{}, 0, 0)
+	for i := range defaultMaxEntries + 10000 {
+		ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+		if verified, err := v.Verify(context.Background(), ip, []string{"googlebot.com"}); verified || err != nil {
+			t.Fatalf("Verify(%s) = %v, %v", ip, verified, err)
+		}
+	}
+	if n := v.Len(); n > defaultMaxEntries {
+		t.Errorf("expected at most %d cached verdicts, got %d", defaultMaxEntries, n)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	ua := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	if bot, ok := Match(DefaultBots, ua); !ok || bot.Name != "googlebot" {
+		t.Errorf("expected googlebot, got %q", bot.Name)
+	}
+	if _, ok := Match(DefaultBots, "Mozilla/5.0 (X11; Linux x86_64) Firefox/130.0"); ok {
+		t.Error("expected no match for a browser")
+	}
+}
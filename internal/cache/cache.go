@@ -0,0 +1,704 @@
+// Package cache is a shared HTTP cache in front of the upstream pools. It
+// stores responses as RFC 9111 allows, revalidates them with conditional
+// requests, and serves stale responses while revalidating and when the
+// upstream fails, as the RFC 5861 directives or the configuration permit.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/middleware"
+	"github.com/yxorp/internal/route"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	defaultMemorySize = 64 << 20
+	defaultDiskSize   = 1 << 30
+	defaultEntrySize  = 1 << 20
+	defaultDir        = "data/cache"
+)
+
+// StatusHeader reports how the cache handled a request.
+const StatusHeader = "X-Cache-Status"
+
+// Values of StatusHeader
+const (
+	StatusHit         = "HIT"         // served fresh from the cache
+	StatusMiss        = "MISS"        // nothing stored, fetched upstream
+	StatusExpired     = "EXPIRED"     // stored response too old, fetched upstream
+	StatusStale       = "STALE"       // stale response served
+	StatusRevalidated = "REVALIDATED" // stored response confirmed by the upstream
+	StatusBypass      = "BYPASS"      // the request asked not to use the cache
+)
+
+var defaultKey = []string{"host", "path", "query"}
+
+// conditionalHeaders are the request preconditions a client may send.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+type state struct {
+	cfg   config.CacheConfig
+	store store    // nil while the cache is off
+	pools []string // pools the routes send requests to, keys are split by
+}
+
+// Cache answers requests from stored upstream responses.
+type Cache struct {
+	mu         sync.Mutex // serializes updates
+	state      atomic.Pointer[state]
+	refreshing sync.Map // keys being revalidated in the background
+	now        func() time.Time
+}
+
+// Stats describes the contents of the cache.
+type Stats struct {
+	Enabled bool   `json:"enabled"`
+	Store   string `json:"store,omitempty"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	MaxSize int64  `json:"max_size,omitempty"`
+}
+
+func New(cfg config.ProxyConfig) (*Cache, error) {
+	c := &Cache{now: time.Now}
+	c.state.Store(&state{})
+	if err := c.Update(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// settings returns the cache settings of cfg with defaults filled in, after
+// validating them and the routes' cache keys.
+func settings(cfg config.ProxyConfig) (config.CacheConfig, error) {
+	cc := cfg.Cache
+	if err := validateKey(cc.Key); err != nil {
+		return cc, fmt.Errorf("invalid cache key: %w", err)
+	}
+	for i, rc := range cfg.Routes {
+		if err := validateKey(rc.Cache.Key); err != nil {
+			return cc, fmt.Errorf("invalid cache key for route %d: %w", i+1, err)
+		}
+	}
+
+	switch cc.Store {
+	case "", "memory":
+		cc.Store = "memory"
+		if cc.MaxSize <= 0 {
+			cc.MaxSize = defaultMemorySize
+		}
+	case "disk":
+		if cc.MaxSize <= 0 {
+			cc.MaxSize = defaultDiskSize
+		}
+		if cc.Dir == "" {
+			cc.Dir = defaultDir
+		}
+	default:
+		return cc, fmt.Errorf("unknown cache store %q", cc.Store)
+	}
+	if cc.MaxEntrySize <= 0 {
+		cc.MaxEntrySize = defaultEntrySize
+	}
+	if len(cc.Key) == 0 {
+		cc.Key = defaultKey
+	}
+	return cc, nil
+}
+
+// Update applies the cache settings of cfg and validates its routes' cache
+// keys. The store is kept while its settings stay the same; a new memory
+// store starts out empty.
+func (c *Cache) Update(cfg config.ProxyConfig) error {
+	apply, err := c.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare does the work of Update that can fail, including opening a new
+// store, without changing the one in use. The returned function switches to
+// the result and cannot fail. The cache must not be updated in between.
+func (c *Cache) Prepare(cfg config.ProxyConfig) (apply func(), err error) {
+	cc, err := settings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.state.Load()
+	st := &state{cfg: cc, pools: []string{""}}
+	for _, rc := range cfg.Routes {
+		if !slices.Contains(st.pools, rc.Pool) {
+			st.pools = append(st.pools, rc.Pool)
+		}
+	}
+	if cc.Enabled {
+		if old.store != nil && old.cfg.Store == cc.Store && old.cfg.Dir == cc.Dir && old.cfg.MaxSize == cc.MaxSize {
+			st.store = old.store
+		} else if cc.Store == "disk" {
+			ds, err := openDiskStore(cc.Dir, cc.MaxSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open cache directory: %w", err)
+			}
+			st.store = ds
+		} else {
+			st.store = newMemoryStore(cc.MaxSize)
+		}
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		old := c.state.Load()
+		c.state.Store(st)
+		if old.store != nil && old.store != st.store {
+			old.store.close()
+		}
+	}, nil
+}
+
+// Stats reports the size of the cache.
+func (c *Cache) Stats() Stats {
+	st := c.state.Load()
+	if st.store == nil {
+		return Stats{}
+	}
+	entries, size := st.store.stats()
+	return Stats{Enabled: true, Store: st.cfg.Store, Entries: entries, Bytes: size, MaxSize: st.cfg.MaxSize}
+}
+
+// Purge removes the entries for host, or for every host when it is empty,
+// whose path starts with prefix, and returns how many it removed.
+func (c *Cache) Purge(host, prefix string) int {
+	st := c.state.Load()
+	if st.store == nil {
+		return 0
+	}
+	n := st.store.purge(func(h, p string) bool {
+		return (host == "" || strings.EqualFold(h, host)) && strings.HasPrefix(p, prefix)
+	})
+	logger.Info("Cache purged", "host", host, "prefix", prefix, "entries", n)
+	return n
+}
+
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := c.state.Load()
+		if st.store == nil || middleware.IsUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		spec, pool := st.cfg.Key, ""
+		if rt := route.FromContext(r.Context()); rt != nil {
+			if rt.Cache.Bypass {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(rt.Cache.Key) > 0 {
+				spec = rt.Cache.Key
+			}
+			pool = rt.Pool
+		}
+		key := requestKey(r, spec)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		default:
+			// A successful unsafe request invalidates what is stored for
+			// its URL, whichever pool the reads of it are routed to
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.code < http.StatusBadRequest {
+				for _, p := range st.pools {
+					st.store.remove(poolKey(p, key))
+				}
+			}
+			return
+		}
+		key = poolKey(pool, key)
+
+		req := parseRequest(r)
+		if req.noStore {
+			report(w, StatusBypass)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e, storedKey := lookup(st, key, r)
+		now := c.now()
+		if e != nil && !req.noCache {
+			age := e.age(now)
+			switch {
+			case age < e.TTL && (!req.hasMaxAge || age <= req.maxAge):
+				serve(w, r, e, now, StatusHit)
+				return
+			case !req.hasMaxAge && age < e.TTL+e.SWR:
+				serve(w, r, e, now, StatusStale)
+				c.refresh(st, next, r, key, e, storedKey)
+				return
+			}
+		}
+		if req.onlyIfCached {
+			report(w, StatusMiss)
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		c.fetch(st, next, w, r, key, e, storedKey)
+	})
+}
+
+// lookup returns the stored response for r and the key it is stored under,
+// which differs from key for responses that vary on request headers.
+func lookup(st *state, key string, r *http.Request) (*entry, string) {
+	e := st.store.get(key)
+	if e == nil || e.Variant == "" {
+		return e, key
+	}
+	key = variantKey(key, e, r)
+	return st.store.get(key), key
+}
+
+// variantKey is the key of the variant of a response matching r.
+func variantKey(key string, index *entry, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteString("variant=" + index.Variant + "\n")
+	for _, name := range index.Vary {
+		b.WriteString(name + "=" + strings.Join(r.Header.Values(name), ",") + "\n")
+	}
+	return b.String()
+}
+
+// fetch forwards r upstream, passes the response on to w and stores it if
+// it may. A stale entry is revalidated with a conditional request, and
+// stands in for an upstream error while its stale-if-error allowance
+// lasts. A circuit breaker that is open fails fast with such an error.
+// Without w, fetch only refreshes the cache.
+func (c *Cache) fetch(st *state, next http.Handler, w http.ResponseWriter, r *http.Request, key string, stale *entry, storedKey string) {
+	requested := c.now()
+	out, conditional := r, false
+	if stale != nil {
+		out, conditional = conditionalRequest(r, stale)
+	}
+	useStale := stale != nil && !stale.MustRevalidate && stale.age(requested) < stale.TTL+stale.SIE
+
+	status := StatusMiss
+	if stale != nil {
+		status = StatusExpired
+	}
+	rec := newRecorder(w, out, st.cfg.MaxEntrySize, status, func(code int) bool {
+		return conditional && code == http.StatusNotModified || useStale && serverError(code)
+	})
+	next.ServeHTTP(rec, out)
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	received := c.now()
+
+	switch {
+	case conditional && rec.code == http.StatusNotModified:
+		e := stale.revalidated(rec.upstreamHeader(), requested, received, st.cfg)
+		st.store.set(storedKey, e)
+		if w != nil {
+			serve(w, r, e, received, StatusRevalidated)
+		}
+	case rec.held:
+		logger.Warn("Serving stale response after upstream error", "path", r.URL.Path, "status", rec.code)
+		serve(w, r, stale, received, StatusStale)
+	default:
+		if w != nil {
+			cacheRequests.Add(strings.ToLower(status), 1)
+		}
+		c.put(st, key, r, rec, requested, received)
+	}
+}
+
+// refresh revalidates a stale entry in the background, one request per key
+// at a time.
+func (c *Cache) refresh(st *state, next http.Handler, r *http.Request, key string, stale *entry, storedKey string) {
+	if _, busy := c.refreshing.LoadOrStore(storedKey, struct{}{}); busy {
+		return
+	}
+	out := r.Clone(context.WithoutCancel(r.Context()))
+	out.Method = http.MethodGet
+	out.Body, out.ContentLength = http.NoBody, 0
+	for _, h := range conditionalHeaders {
+		out.Header.Del(h)
+	}
+	out.Header.Del("Range")
+	go func() {
+		defer c.refreshing.Delete(storedKey)
+		c.fetch(st, next, nil, out, key, stale, storedKey)
+	}()
+}
+
+// put stores the response rec recorded, if it may be stored.
+func (c *Cache) put(st *state, key string, r *http.Request, rec *recorder, requested, received time.Time) {
+	if !rec.complete() {
+		return
+	}
+	h := rec.upstreamHeader()
+	e := &entry{Host: requestHost(r), Path: r.URL.Path, Status: rec.code, Header: h, Body: rec.body.Bytes()}
+	e.freshness(requested, received, st.cfg.StaleWhileRevalidate, st.cfg.StaleIfError)
+	if e.TTL <= 0 {
+		return
+	}
+
+	if vary := varyNames(h); len(vary) > 0 {
+		e.Vary = vary
+		index := st.store.get(key)
+		if index == nil || index.Variant == "" || !slices.Equal(index.Vary, vary) {
+			// A new index orphans the variants of the previous one
+			index = &entry{Host: e.Host, Path: e.Path, Vary: vary, Variant: rand.Text()}
+			st.store.set(key, index)
+		}
+		key = variantKey(key, index, r)
+	}
+	st.store.set(key, e)
+}
+
+// revalidated returns a copy of e updated with the header of the 304
+// response that confirmed it.
+func (e *entry) revalidated(h http.Header, requested, received time.Time, cfg config.CacheConfig) *entry {
+	fresh := *e
+	fresh.Header = e.Header.Clone()
+	for k, vs := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		fresh.Header[k] = vs
+	}
+	fresh.freshness(requested, received, cfg.StaleWhileRevalidate, cfg.StaleIfError)
+	return &fresh
+}
+
+// conditionalRequest returns r with the validators of e, unless the client
+// sent preconditions of its own or e has none.
+func conditionalRequest(r *http.Request, e *entry) (*http.Request, bool) {
+	if r.Method != http.MethodGet {
+		return r, false
+	}
+	for _, h := range conditionalHeaders {
+		if r.Header.Get(h) != "" {
+			return r, false
+		}
+	}
+	etag, modified := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return r, false
+	}
+	out := r.Clone(r.Context())
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		out.Header.Set("If-Modified-Since", modified)
+	}
+	return out, true
+}
+
+// serve answers r from e.
+func serve(w http.ResponseWriter, r *http.Request, e *entry, now time.Time, status string) {
+	h := w.Header()
+	for k, vs := range e.Header {
+		h[k] = append(h[k], vs...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	report(w, status)
+
+	if notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// notModified reports whether the preconditions of r let it be answered
+// with 304 Not Modified.
+func notModified(r *http.Request, e *entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, e.Header.Get("ETag"))
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+func report(w http.ResponseWriter, status string) {
+	w.Header().Set(StatusHeader, status)
+	cacheRequests.Add(strings.ToLower(status), 1)
+}
+
+func serverError(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// varyNames returns the sorted, canonical header names h varies on.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// poolKey scopes key to the upstream pool a request is routed to, so routes
+// that split the same URL between pools, by header or method, do not share
+// entries.
+func poolKey(pool, key string) string {
+	return "pool=" + pool + "\n" + key
+}
+
+// requestKey builds the cache key of r from the parts spec names.
+func requestKey(r *http.Request, spec []string) string {
+	var b strings.Builder
+	for _, part := range spec {
+		kind, name, _ := strings.Cut(part, ":")
+		var v string
+		switch kind {
+		case "host":
+			v = requestHost(r)
+		case "path":
+			v = r.URL.EscapedPath()
+		case "query":
+			if name == "" {
+				v = r.URL.Query().Encode()
+			} else {
+				v = strings.Join(r.URL.Query()[name], ",")
+			}
+		case "header":
+			v = strings.Join(r.Header.Values(name), ",")
+		case "cookie":
+			if ck, err := r.Cookie(name); err == nil {
+				v = ck.Value
+			}
+		}
+		b.WriteString(part + "=" + v + "\n")
+	}
+	return b.String()
+}
+
+func validateKey(spec []string) error {
+	for _, part := range spec {
+		kind, name, named := strings.Cut(part, ":")
+		switch kind {
+		case "host", "path":
+			if !named {
+				continue
+			}
+		case "query":
+			if !named || name != "" {
+				continue
+			}
+		case "header", "cookie":
+			if name != "" {
+				continue
+			}
+		}
+		return fmt.Errorf("unknown key part %q", part)
+	}
+	return nil
+}
+
+// requestHost returns the lower-cased request host without port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// recorder passes an upstream response on to the client while keeping a
+// copy to store, if the response may be stored and fits. Responses hold
+// selects are kept from the client, for the cache to answer in their place.
+// Without a client writer it only records.
+type recorder struct {
+	w      http.ResponseWriter
+	r      *http.Request // sent upstream
+	pre    http.Header   // set before the upstream response arrived
+	header http.Header
+	status string
+	hold   func(code int) bool
+	max    int64
+
+	code        int
+	wroteHeader bool
+	held        bool
+	record      bool // the body is being copied
+	body        bytes.Buffer
+}
+
+func newRecorder(w http.ResponseWriter, r *http.Request, max int64, status string, hold func(int) bool) *recorder {
+	rec := &recorder{w: w, r: r, pre: http.Header{}, status: status, hold: hold, max: max}
+	if w != nil {
+		rec.pre = w.Header().Clone()
+	}
+	rec.header = rec.pre.Clone()
+	return rec
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	// Informational responses go straight through. The reverse proxy
+	// clears the header after them, so nothing set before counts.
+	if code >= 100 && code < 200 {
+		if rec.w != nil {
+			rec.copyHeader()
+			rec.w.WriteHeader(code)
+		}
+		rec.pre = http.Header{}
+		return
+	}
+
+	rec.wroteHeader = true
+	rec.code = code
+	rec.record = storable(rec.r, code, rec.upstreamHeader())
+	if n, err := strconv.ParseInt(rec.header.Get("Content-Length"), 10, 64); err == nil && n > rec.max {
+		rec.record = false
+	}
+	if rec.w == nil {
+		return
+	}
+	if rec.hold(code) {
+		rec.held = true
+		return
+	}
+	rec.copyHeader()
+	rec.w.Header().Set(StatusHeader, rec.status)
+	rec.w.WriteHeader(code)
+}
+
+func (rec *recorder) copyHeader() {
+	h := rec.w.Header()
+	clear(h)
+	maps.Copy(h, rec.header)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.held {
+		return len(b), nil
+	}
+	if rec.record {
+		if int64(rec.body.Len()+len(b)) > rec.max {
+			rec.record = false
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	if rec.w == nil {
+		return len(b), nil
+	}
+	return rec.w.Write(b)
+}
+
+func (rec *recorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.w != nil && !rec.held {
+		http.NewResponseController(rec.w).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
+
+// upstreamHeader returns the header fields the upstream added to the ones
+// set before.
+func (rec *recorder) upstreamHeader() http.Header {
+	h := make(http.Header)
+	for k, vs := range rec.header {
+		if n := len(rec.pre[k]); len(vs) > n {
+			h[k] = slices.Clone(vs[n:])
+		}
+	}
+	return h
+}
+
+// complete reports whether the response may be stored and its whole body
+// was recorded.
+func (rec *recorder) complete() bool {
+	if rec.held || !rec.record {
+		return false
+	}
+	cl := rec.header.Get("Content-Length")
+	return cl == "" || cl == strconv.Itoa(rec.body.Len())
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 && code >= 200 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
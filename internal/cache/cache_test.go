@@ -0,0 +1,507 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/proxy"
+	"github.com/yxorp/internal/route"
+	"github.com/yxorp/pkg/logger"
+)
+
+// testCache fronts handler with a reverse proxy and a cache whose clock
+// runs ahead of the real one by *skew.
+type testCache struct {
+	t        *testing.T
+	cache    *Cache
+	handler  http.Handler
+	skew     atomic.Int64
+	requests atomic.Int64 // requests seen by the upstream
+}
+
+func newTestCache(t *testing.T, cfg config.ProxyConfig, upstream http.HandlerFunc) *testCache {
+	t.Helper()
+	logger.Init()
+	tc := &testCache{t: t}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc.requests.Add(1)
+		w.Header().Set("Date", tc.cache.now().UTC().Format(http.TimeFormat))
+		upstream(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	tc.handler = httputil.NewSingleHostReverseProxy(target)
+
+	cfg.Cache.Enabled = true
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Now().Add(time.Duration(tc.skew.Load())) }
+	tc.cache = c
+
+	routes, err := route.NewTable(cfg.Routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := c.Middleware(tc.handler)
+	tc.handler = routes.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stands in for the middleware ahead of the cache
+		w.Header().Set("X-Request-ID", strconv.FormatInt(time.Now().UnixNano(), 10))
+		next.ServeHTTP(w, r)
+	}))
+	return tc
+}
+
+func (tc *testCache) advance(d time.Duration) {
+	tc.skew.Add(int64(d))
+}
+
+func (tc *testCache) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	tc.handler.ServeHTTP(w, r)
+	return w
+}
+
+func (tc *testCache) get(path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return tc.do(r)
+}
+
+// expect checks the cache status and body of a response.
+func (tc *testCache) expect(w *httptest.ResponseRecorder, status, body string) {
+	tc.t.Helper()
+	if got := w.Header().Get(StatusHeader); got != status {
+		tc.t.Errorf("%s = %q, want %q", StatusHeader, got, status)
+	}
+	if got := w.Body.String(); got != body {
+		tc.t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestCache_Hit(t *testing.T) {
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "hello")
+	})
+
+	tc.expect(tc.get("/page"), StatusMiss, "hello")
+	w := tc.get("/page")
+	tc.expect(w, StatusHit, "hello")
+	if ids := w.Header().Values("X-Request-ID"); len(ids) != 1 {
+		t.Errorf("X-Request-ID = %q, want only the current request's", ids)
+	}
+	if w.Header().Get("Age") == "" || w.Header().Get("ETag") != `"v1"` {
+		t.Errorf("stored header not served: %v", w.Header())
+	}
+	if n := tc.requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+
+	tc.expect(tc.do(httptest.NewRequest(http.MethodHead, "/page", nil)), StatusHit, "")
+	if w := tc.get("/page", "If-None-Match", `W/"v1"`); w.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match: got %d, want 304", w.Code)
+	}
+	tc.expect(tc.get("/page", "Cache-Control", "no-cache"), StatusRevalidated, "hello")
+	tc.expect(tc.get("/page", "Cache-Control", "no-store"), StatusBypass, "hello")
+	if n := tc.requests.Load(); n != 3 {
+		t.Errorf("upstream requests = %d, want 3", n)
+	}
+}
+
+func TestCache_NotStored(t *testing.T) {
+	tests := map[string]struct {
+		header  map[string]string
+		request map[string]string
+	}{
+		"no lifetime":   {header: map[string]string{}},
+		"no-store":      {header: map[string]string{"Cache-Control": "max-age=60, no-store"}},
+		"private":       {header: map[string]string{"Cache-Control": "private, max-age=60"}},
+		"no-cache":      {header: map[string]string{"Cache-Control": `no-cache="Set-Cookie, X-Foo", max-age=60`}},
+		"set-cookie":    {header: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"}},
+		"vary star":     {header: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}},
+		"expired":       {header: map[string]string{"Expires": "Thu, 01 Jan 1970 00:00:00 GMT"}},
+		"authorization": {header: map[string]string{"Cache-Control": "max-age=60"}, request: map[string]string{"Authorization": "Bearer x"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				io.WriteString(w, "x")
+			})
+			for range 2 {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				for k, v := range tt.request {
+					r.Header.Set(k, v)
+				}
+				tc.expect(tc.do(r), StatusMiss, "x")
+			}
+		})
+	}
+
+	t.Run("authorization public", func(t *testing.T) {
+		tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			io.WriteString(w, "x")
+		})
+		tc.get("/", "Authorization", "Bearer x")
+		tc.expect(tc.get("/", "Authorization", "Bearer x"), StatusHit, "x")
+	})
+
+	t.Run("too big", func(t *testing.T) {
+		tc := newTestCache(t, config.ProxyConfig{Cache: config.CacheConfig{MaxEntrySize: 4}}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "too big")
+		})
+		tc.get("/")
+		tc.expect(tc.get("/"), StatusMiss, "too big")
+	})
+}
+
+func TestRecorder_OnlyRecordsStorable(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for header, want := range map[string]int{"max-age=60": 1, "no-store": 0, "private, max-age=60": 0} {
+		w := httptest.NewRecorder()
+		rec := newRecorder(w, r, 1<<20, StatusMiss, func(int) bool { return false })
+		rec.Header().Set("Cache-Control", header)
+		io.WriteString(rec, "x")
+		if rec.body.Len() != want || w.Body.String() != "x" {
+			t.Errorf("%s: recorded %d bytes, want %d, and sent %q", header, rec.body.Len(), want, w.Body)
+		}
+	}
+
+	// A declared length over the limit is not recorded either
+	rec := newRecorder(nil, r, 4, StatusMiss, func(int) bool { return false })
+	rec.Header().Set("Cache-Control", "max-age=60")
+	rec.Header().Set("Content-Length", "7")
+	io.WriteString(rec, "too")
+	if rec.body.Len() != 0 || rec.complete() {
+		t.Errorf("recorded %d bytes of an oversized response", rec.body.Len())
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "accept-language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	})
+	tc.expect(tc.get("/", "Accept-Language", "en"), StatusMiss, "en")
+	tc.expect(tc.get("/", "Accept-Language", "fr"), StatusMiss, "fr")
+	tc.expect(tc.get("/", "Accept-Language", "en"), StatusHit, "en")
+	tc.expect(tc.get("/", "Accept-Language", "fr"), StatusHit, "fr")
+	tc.expect(tc.get("/"), StatusMiss, "")
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	var version atomic.Value
+	version.Store("v1")
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		v := version.Load().(string)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("ETag", `"`+v+`"`)
+		if r.Header.Get("If-None-Match") == `"`+v+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, v)
+	})
+
+	tc.get("/")
+	tc.advance(2 * time.Minute)
+	tc.expect(tc.get("/"), StatusRevalidated, "v1")
+	tc.expect(tc.get("/"), StatusHit, "v1")
+
+	version.Store("v2")
+	tc.advance(2 * time.Minute)
+	tc.expect(tc.get("/"), StatusExpired, "v2")
+	tc.expect(tc.get("/"), StatusHit, "v2")
+
+	// A client's own preconditions go upstream unchanged
+	tc.advance(2 * time.Minute)
+	if w := tc.get("/", "If-None-Match", `"v2"`); w.Code != http.StatusNotModified || w.Header().Get(StatusHeader) != StatusExpired {
+		t.Errorf("client revalidation: got %d %s", w.Code, w.Header().Get(StatusHeader))
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var version atomic.Value
+	version.Store("v1")
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=60")
+		io.WriteString(w, version.Load().(string))
+	})
+
+	tc.get("/")
+	version.Store("v2")
+	tc.advance(90 * time.Second)
+	tc.expect(tc.get("/"), StatusStale, "v1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tc.get("/").Body.String() != "v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("background revalidation did not store the new response")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tc.requests.Load(); n != 2 {
+		t.Errorf("upstream requests = %d, want 2", n)
+	}
+
+	// Past the allowance the request waits for the upstream
+	version.Store("v3")
+	tc.advance(3 * time.Minute)
+	tc.expect(tc.get("/"), StatusExpired, "v3")
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	var cacheControl atomic.Value
+	cacheControl.Store("max-age=60")
+	tc := newTestCache(t, config.ProxyConfig{Cache: config.CacheConfig{StaleIfError: 10 * time.Minute}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl.Load().(string))
+		w.WriteHeader(int(status.Load()))
+		io.WriteString(w, http.StatusText(int(status.Load())))
+	})
+
+	tc.get("/")
+	status.Store(http.StatusServiceUnavailable)
+	tc.advance(2 * time.Minute)
+	tc.expect(tc.get("/"), StatusStale, "OK")
+
+	tc.advance(10 * time.Minute)
+	w := tc.get("/")
+	tc.expect(w, StatusExpired, "Service Unavailable")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("past the allowance: got %d, want 503", w.Code)
+	}
+
+	status.Store(http.StatusOK)
+	cacheControl.Store("max-age=60, must-revalidate")
+	tc.get("/")
+	status.Store(http.StatusBadGateway)
+	tc.advance(2 * time.Minute)
+	if w := tc.get("/"); w.Code != http.StatusBadGateway {
+		t.Errorf("must-revalidate: got %d, want 502", w.Code)
+	}
+}
+
+func TestCache_CircuitOpen(t *testing.T) {
+	logger.Init()
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		io.WriteString(w, "cached")
+	}))
+	defer upstream.Close()
+
+	lb, err := proxy.NewLoadBalancer(config.PoolConfig{
+		Name:           "api",
+		Targets:        []config.Target{{URL: upstream.URL}},
+		HealthCheck:    config.HealthCheckConfig{Interval: time.Hour},
+		CircuitBreaker: config.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	c, err := New(config.ProxyConfig{Cache: config.CacheConfig{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := c.Middleware(lb)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	get("/page")
+	failing.Store(true)
+	// Open the circuit through an uncached path
+	if w := get("/other"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("failing upstream: got %d", w.Code)
+	}
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	w := get("/page")
+	if w.Code != http.StatusOK || w.Body.String() != "cached" || w.Header().Get(StatusHeader) != StatusStale {
+		t.Errorf("open circuit: got %d %q %s, want the stale response", w.Code, w.Body.String(), w.Header().Get(StatusHeader))
+	}
+	if w := get("/other"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("uncached path with open circuit: got %d, want 503", w.Code)
+	}
+}
+
+func TestCache_Invalidation(t *testing.T) {
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Method == http.MethodPost && r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, r.Method)
+	})
+	tc.get("/item")
+	tc.do(httptest.NewRequest(http.MethodPost, "/item?fail=1", nil))
+	tc.expect(tc.get("/item"), StatusHit, "GET")
+	tc.do(httptest.NewRequest(http.MethodPost, "/item", nil))
+	tc.expect(tc.get("/item"), StatusMiss, "GET")
+}
+
+func TestCache_OnlyIfCached(t *testing.T) {
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "x")
+	})
+	if w := tc.get("/", "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("miss: got %d, want 504", w.Code)
+	}
+	tc.get("/")
+	tc.expect(tc.get("/", "Cache-Control", "only-if-cached"), StatusHit, "x")
+	if n := tc.requests.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestCache_Routes(t *testing.T) {
+	cfg := config.ProxyConfig{Routes: []config.RouteConfig{
+		{Paths: []string{"/account"}, Cache: config.RouteCache{Key: []string{"path", "cookie:session"}}},
+		{Paths: []string{"/live"}, Cache: config.RouteCache{Bypass: true}},
+	}}
+	tc := newTestCache(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		ck, _ := r.Cookie("session")
+		if ck != nil {
+			io.WriteString(w, ck.Value)
+		}
+	})
+
+	tc.expect(tc.get("/account?x=1", "Cookie", "session=alice"), StatusMiss, "alice")
+	tc.expect(tc.get("/account?x=2", "Cookie", "session=bob"), StatusMiss, "bob")
+	tc.expect(tc.get("/account?x=3", "Cookie", "session=alice"), StatusHit, "alice")
+
+	tc.get("/live")
+	if w := tc.get("/live"); w.Header().Get(StatusHeader) != "" {
+		t.Errorf("bypassed route reported %q", w.Header().Get(StatusHeader))
+	}
+	if n := tc.requests.Load(); n != 4 {
+		t.Errorf("upstream requests = %d, want 4", n)
+	}
+}
+
+func TestCache_RoutePools(t *testing.T) {
+	cfg := config.ProxyConfig{Routes: []config.RouteConfig{
+		{Headers: map[string]string{"X-Beta": "^1$"}, Pool: "beta"},
+		{Methods: []string{http.MethodPost}, Pool: "writer"},
+		{Paths: []string{"/"}, Pool: "stable"},
+	}}
+	tc := newTestCache(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("X-Beta") == "1" {
+			io.WriteString(w, "beta")
+		} else {
+			io.WriteString(w, "stable")
+		}
+	})
+
+	// Routes splitting a URL by header keep separate entries
+	tc.expect(tc.get("/page"), StatusMiss, "stable")
+	tc.expect(tc.get("/page", "X-Beta", "1"), StatusMiss, "beta")
+	tc.expect(tc.get("/page"), StatusHit, "stable")
+	tc.expect(tc.get("/page", "X-Beta", "1"), StatusHit, "beta")
+
+	// A write routed to another pool still invalidates the reads
+	tc.do(httptest.NewRequest(http.MethodPost, "/page", nil))
+	tc.expect(tc.get("/page"), StatusMiss, "stable")
+	tc.expect(tc.get("/page", "X-Beta", "1"), StatusMiss, "beta")
+}
+
+func TestCache_Purge(t *testing.T) {
+	tc := newTestCache(t, config.ProxyConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		io.WriteString(w, r.Host+r.URL.Path)
+	})
+	for _, u := range []string{"http://a.test/img/1", "http://a.test/img/2", "http://a.test/doc", "http://b.test/img/1"} {
+		tc.do(httptest.NewRequest(http.MethodGet, u, nil))
+	}
+
+	// Each response takes an entry and so does its Vary index
+	if n := tc.cache.Purge("A.test", "/img/"); n != 4 {
+		t.Errorf("purged %d entries, want 4", n)
+	}
+	tc.expect(tc.do(httptest.NewRequest(http.MethodGet, "http://a.test/img/1", nil)), StatusMiss, "a.test/img/1")
+	tc.expect(tc.do(httptest.NewRequest(http.MethodGet, "http://b.test/img/1", nil)), StatusHit, "b.test/img/1")
+
+	tc.cache.Purge("", "")
+	if st := tc.cache.Stats(); st.Entries != 0 || st.Bytes != 0 {
+		t.Errorf("stats after purging everything: %+v", st)
+	}
+}
+
+func TestCache_Update(t *testing.T) {
+	invalid := []config.ProxyConfig{
+		{Cache: config.CacheConfig{Store: "redis"}},
+		{Cache: config.CacheConfig{Key: []string{"method"}}},
+		{Cache: config.CacheConfig{Key: []string{"header:"}}},
+		{Routes: []config.RouteConfig{{Cache: config.RouteCache{Key: []string{"path:x"}}}}},
+	}
+	for _, cfg := range invalid {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+
+	c, err := New(config.ProxyConfig{Cache: config.CacheConfig{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := c.state.Load().store
+	if err := c.Update(config.ProxyConfig{Cache: config.CacheConfig{Enabled: true, StaleIfError: time.Minute}}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state.Load().store != st {
+		t.Error("store replaced although its settings did not change")
+	}
+	apply, err := c.Prepare(config.ProxyConfig{Cache: config.CacheConfig{Enabled: true, Store: "disk", Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.state.Load().store != st {
+		t.Error("store replaced before the prepared update was applied")
+	}
+	apply()
+	if c.Stats().Store != "disk" {
+		t.Errorf("store = %q after applying, want disk", c.Stats().Store)
+	}
+	if err := c.Update(config.ProxyConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().Enabled {
+		t.Error("cache still enabled")
+	}
+}
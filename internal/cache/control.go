@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives holds the Cache-Control directives of a message by lower-cased
+// name. Directives without an argument map to "".
+type directives map[string]string
+
+func parseDirectives(h http.Header) directives {
+	d := make(directives)
+	for _, line := range h.Values("Cache-Control") {
+		for _, item := range splitList(line) {
+			name, value, _ := strings.Cut(item, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := d[name]; !ok {
+				d[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return d
+}
+
+// splitList splits a comma-separated header value, keeping commas inside
+// quoted strings such as no-cache="Set-Cookie, Set-Cookie2".
+func splitList(s string) []string {
+	var items []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, s[start:])
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of a directive. A malformed
+// argument counts as zero, which errs on the side of a stale response.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// requestDirectives is what a request asks of the cache.
+type requestDirectives struct {
+	noStore      bool
+	noCache      bool
+	onlyIfCached bool
+	maxAge       time.Duration
+	hasMaxAge    bool
+}
+
+func parseRequest(r *http.Request) requestDirectives {
+	d := parseDirectives(r.Header)
+	req := requestDirectives{
+		noStore:      d.has("no-store"),
+		noCache:      d.has("no-cache"),
+		onlyIfCached: d.has("only-if-cached"),
+	}
+	req.maxAge, req.hasMaxAge = d.seconds("max-age")
+	// Pragma: no-cache stands in for Cache-Control on HTTP/1.0 clients
+	if len(r.Header.Values("Cache-Control")) == 0 && headerHasToken(r.Header, "Pragma", "no-cache") {
+		req.noCache = true
+	}
+	return req
+}
+
+// cacheableStatus lists the status codes whose responses may be stored.
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusPermanentRedirect,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+}
+
+// storable reports whether a shared cache may store the response to r. Only
+// responses with an explicit lifetime are stored; there is no heuristic
+// freshness. Responses setting cookies are left alone, as are responses to
+// authorized requests unless they are marked for shared caching.
+func storable(r *http.Request, status int, h http.Header) bool {
+	if r.Method != http.MethodGet || !slices.Contains(cacheableStatus, status) {
+		return false
+	}
+	d := parseDirectives(h)
+	if d.has("no-store") || d.has("private") || d.has("no-cache") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !d.has("public") && !d.has("s-maxage") && !d.has("must-revalidate") {
+		return false
+	}
+	if h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" || headerHasToken(h, "Vary", "*") {
+		return false
+	}
+	return d.has("s-maxage") || d.has("max-age") || h.Get("Expires") != ""
+}
+
+// freshness sets the lifetime, initial age and stale allowances of e from
+// its header. requested and received bracket the upstream exchange.
+func (e *entry) freshness(requested, received time.Time, swr, sie time.Duration) {
+	d := parseDirectives(e.Header)
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = received
+	}
+
+	switch maxAge, ok := d.seconds("s-maxage"); {
+	case ok:
+		e.TTL = maxAge
+	default:
+		if maxAge, ok = d.seconds("max-age"); ok {
+			e.TTL = maxAge
+		} else if expires, err := http.ParseTime(e.Header.Get("Expires")); err == nil {
+			e.TTL = max(expires.Sub(date), 0)
+		} else {
+			e.TTL = 0
+		}
+	}
+
+	// The corrected initial age of RFC 9111, section 4.2.3
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	apparent := max(received.Sub(date), 0)
+	e.Age = max(apparent, ageValue+received.Sub(requested))
+	e.Stored = received
+
+	// s-maxage implies proxy-revalidate
+	e.MustRevalidate = d.has("must-revalidate") || d.has("proxy-revalidate") || d.has("s-maxage")
+	e.SWR, e.SIE = swr, sie
+	if v, ok := d.seconds("stale-while-revalidate"); ok {
+		e.SWR = v
+	}
+	if v, ok := d.seconds("stale-if-error"); ok {
+		e.SIE = v
+	}
+	if e.MustRevalidate {
+		e.SWR, e.SIE = 0, 0
+	}
+}
+
+// headerHasToken reports whether the comma-separated header name lists token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// etagMatch reports whether an If-None-Match list matches etag, using the
+// weak comparison RFC 9110 prescribes for it.
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"bufio"
+	"cmp"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/yxorp/pkg/logger"
+)
+
+const entrySuffix = ".entry"
+
+// diskItem is the index record of an entry file.
+type diskItem struct {
+	key  string
+	file string
+	size int64
+	host string
+	path string
+}
+
+// diskStore keeps one file per entry: a line of JSON metadata followed by
+// the body. The index and LRU order live in memory and are rebuilt from the
+// files on startup, ordered by modification time.
+type diskStore struct {
+	dir     string
+	maxSize int64
+
+	mu     sync.Mutex
+	size   int64
+	items  map[string]*list.Element
+	lru    *list.List // front is most recently used
+	closed bool
+}
+
+func openDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &diskStore{dir: dir, maxSize: maxSize, items: make(map[string]*list.Element), lru: list.New()}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type loaded struct {
+		item  *diskItem
+		mtime int64
+	}
+	var found []loaded
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		if strings.HasPrefix(f.Name(), "tmp-") {
+			os.Remove(name)
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), entrySuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		e, err := readEntry(name, false)
+		if err != nil {
+			logger.Warn("Removing unreadable cache entry", "file", name, "error", err)
+			os.Remove(name)
+			continue
+		}
+		found = append(found, loaded{&diskItem{key: e.Key, file: name, size: info.Size(), host: e.Host, path: e.Path}, info.ModTime().UnixNano()})
+	}
+	slices.SortFunc(found, func(a, b loaded) int { return cmp.Compare(b.mtime, a.mtime) })
+	for _, l := range found {
+		s.items[l.item.key] = s.lru.PushBack(l.item)
+		s.size += l.item.size
+		cacheEntries.Add(1)
+		cacheBytes.Add(l.item.size)
+	}
+	s.mu.Lock()
+	s.evictLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// readEntry reads an entry file, with the body when withBody is set.
+func readEntry(name string, withBody bool) (*entry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	meta, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	if err := json.Unmarshal(meta, e); err != nil {
+		return nil, err
+	}
+	if withBody {
+		if e.Body, err = io.ReadAll(br); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (s *diskStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+entrySuffix)
+}
+
+func (s *diskStore) get(key string) *entry {
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	e, err := readEntry(el.Value.(*diskItem).file, true)
+	if err != nil || e.Key != key {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// The entry may have been replaced or removed while it was read
+		if s.items[key] == el {
+			logger.Warn("Dropping unreadable cache entry", "key", key, "error", err)
+			s.removeLocked(key)
+		}
+		return nil
+	}
+	return e
+}
+
+func (s *diskStore) set(key string, e *entry) {
+	e.Key = key
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	size := int64(len(meta) + 1 + len(e.Body))
+	if size > s.maxSize {
+		return
+	}
+
+	// Write a temporary file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		logger.Error("Failed to write cache entry", "error", err)
+		return
+	}
+	_, err = tmp.Write(slices.Concat(meta, []byte{'\n'}, e.Body))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Error("Failed to write cache entry", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		os.Remove(tmp.Name())
+		return
+	}
+	item := &diskItem{key: key, file: s.fileName(key), size: size, host: e.Host, path: e.Path}
+	if err := os.Rename(tmp.Name(), item.file); err != nil {
+		os.Remove(tmp.Name())
+		logger.Error("Failed to write cache entry", "error", err)
+		return
+	}
+	// The rename replaced any previous file for the key
+	s.forgetLocked(key)
+	s.items[key] = s.lru.PushFront(item)
+	s.size += size
+	cacheEntries.Add(1)
+	cacheBytes.Add(size)
+	s.evictLocked()
+}
+
+func (s *diskStore) evictLocked() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back().Value.(*diskItem).key)
+		cacheEvictions.Add(1)
+	}
+}
+
+func (s *diskStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *diskStore) removeLocked(key string) bool {
+	item := s.forgetLocked(key)
+	if item == nil {
+		return false
+	}
+	if err := os.Remove(item.file); err != nil && !os.IsNotExist(err) {
+		logger.Error("Failed to remove cache entry", "file", item.file, "error", err)
+	}
+	return true
+}
+
+// forgetLocked drops key from the index, leaving its file alone.
+func (s *diskStore) forgetLocked(key string) *diskItem {
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	item := el.Value.(*diskItem)
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= item.size
+	cacheEntries.Add(-1)
+	cacheBytes.Add(-item.size)
+	return item
+}
+
+func (s *diskStore) purge(match func(host, path string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, el := range s.items {
+		if item := el.Value.(*diskItem); match(item.host, item.path) && s.removeLocked(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *diskStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items), s.size
+}
+
+// close detaches a store that has been replaced. The files stay for the
+// store that takes over the directory.
+func (s *diskStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.items {
+		s.forgetLocked(key)
+	}
+	s.closed = true
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"container/list"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	cacheRequests  = expvar.NewMap("cache_requests")
+	cacheEvictions = expvar.NewInt("cache_evictions")
+	cacheEntries   = expvar.NewInt("cache_entries")
+	cacheBytes     = expvar.NewInt("cache_bytes")
+)
+
+// entry is a stored response. An entry with a Variant ID stands for a
+// response that varies on request headers: it holds no response itself but
+// the Vary header names, and the variants are stored under keys derived
+// from its ID and the request's values for those headers.
+type entry struct {
+	Key     string      `json:"key"`
+	Host    string      `json:"host"`
+	Path    string      `json:"path"`
+	Vary    []string    `json:"vary,omitempty"`
+	Variant string      `json:"variant,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"-"`
+
+	Stored         time.Time     `json:"stored"`
+	Age            time.Duration `json:"age"` // corrected initial age
+	TTL            time.Duration `json:"ttl"` // freshness lifetime
+	SWR            time.Duration `json:"swr,omitempty"`
+	SIE            time.Duration `json:"sie,omitempty"`
+	MustRevalidate bool          `json:"must_revalidate,omitempty"`
+}
+
+// age returns the current age of the stored response.
+func (e *entry) age(now time.Time) time.Duration {
+	return e.Age + max(now.Sub(e.Stored), 0)
+}
+
+// size estimates the memory the entry takes up.
+func (e *entry) size() int64 {
+	n := len(e.Key) + len(e.Host) + len(e.Path) + len(e.Body) + 128
+	for k, vs := range e.Header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+// store holds cache entries, evicting the least recently used ones to stay
+// within its size.
+type store interface {
+	get(key string) *entry
+	set(key string, e *entry)
+	remove(key string)
+	// purge removes the entries match selects by host and path.
+	purge(match func(host, path string) bool) int
+	stats() (entries int, bytes int64)
+	close()
+}
+
+type memoryItem struct {
+	key  string
+	e    *entry
+	size int64
+}
+
+// memoryStore is an in-memory LRU store.
+type memoryStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List // front is most recently used
+	closed  bool
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{maxSize: maxSize, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *memoryStore) get(key string) *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).e
+}
+
+func (s *memoryStore) set(key string, e *entry) {
+	e.Key = key
+	item := &memoryItem{key: key, e: e, size: e.size()}
+	if item.size > s.maxSize {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.removeLocked(key)
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	cacheEntries.Add(1)
+	cacheBytes.Add(item.size)
+	for s.size > s.maxSize {
+		s.removeLocked(s.lru.Back().Value.(*memoryItem).key)
+		cacheEvictions.Add(1)
+	}
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *memoryStore) removeLocked(key string) bool {
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	item := el.Value.(*memoryItem)
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= item.size
+	cacheEntries.Add(-1)
+	cacheBytes.Add(-item.size)
+	return true
+}
+
+func (s *memoryStore) purge(match func(host, path string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, el := range s.items {
+		if e := el.Value.(*memoryItem).e; match(e.Host, e.Path) && s.removeLocked(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items), s.size
+}
+
+// close drops the entries of a store that has been replaced.
+func (s *memoryStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.items {
+		s.removeLocked(key)
+	}
+	s.closed = true
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yxorp/pkg/logger"
+)
+
+func testEntry(host, path string, size int) *entry {
+	return &entry{
+		Host:   host,
+		Path:   path,
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   []byte(strings.Repeat("x", size)),
+		Stored: time.Now(),
+		TTL:    time.Minute,
+	}
+}
+
+func TestMemoryStore_Evicts(t *testing.T) {
+	e := testEntry("a.test", "/", 100)
+	e.Key = "a"
+	s := newMemoryStore(3 * e.size())
+	for _, key := range []string{"a", "b", "c"} {
+		s.set(key, testEntry("a.test", "/", 100))
+	}
+	s.get("a") // a is now used more recently than b
+	s.set("d", testEntry("a.test", "/", 100))
+
+	if s.get("b") != nil {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if s.get(key) == nil {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	s.set("big", testEntry("a.test", "/", 1000))
+	if n, _ := s.stats(); n != 3 || s.get("big") != nil {
+		t.Errorf("oversized entry stored: %d entries", n)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	logger.Init()
+	dir := t.TempDir()
+	s, err := openDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.set("a", testEntry("a.test", "/img/1", 100))
+	s.set("b", testEntry("a.test", "/doc", 100))
+	s.set("c", testEntry("b.test", "/img/1", 100))
+
+	e := s.get("a")
+	if e == nil || len(e.Body) != 100 || e.Header.Get("Content-Type") != "text/plain" || e.TTL != time.Minute {
+		t.Fatalf("entry not read back: %+v", e)
+	}
+
+	// A new store over the same directory picks the entries up
+	s.close()
+	os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken"+entrySuffix), []byte("{"), 0o644)
+	s, err = openDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.stats(); n != 3 {
+		t.Errorf("reopened store has %d entries, want 3", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp-123")); !os.IsNotExist(err) {
+		t.Error("leftover temporary file not removed")
+	}
+
+	if n := s.purge(func(host, path string) bool { return strings.HasPrefix(path, "/img/") }); n != 2 {
+		t.Errorf("purged %d entries, want 2", n)
+	}
+	if s.get("a") != nil || s.get("b") == nil {
+		t.Error("purge removed the wrong entries")
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files left, want 1", len(files))
+	}
+
+	// An entry whose file went missing is dropped
+	os.Remove(s.fileName("b"))
+	if s.get("b") != nil {
+		t.Error("missing entry read back")
+	}
+	if n, _ := s.stats(); n != 0 {
+		t.Errorf("%d entries left after dropping an unreadable one, want 0", n)
+	}
+
+	// Shrinking the store evicts on open
+	s.close()
+	s, err = openDiskStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.stats(); n != 0 {
+		t.Errorf("%d entries left in a store too small for any", n)
+	}
+}
@@ -7,40 +7,561 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Config is the whole configuration. The admin API serves and accepts it as
+// JSON, with the same field names as the YAML file.
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Proxy    ProxyConfig    `yaml:"proxy"`
-	Security SecurityConfig `yaml:"security"`
+	Server   ServerConfig   `yaml:"server" json:"server"`
+	Proxy    ProxyConfig    `yaml:"proxy" json:"proxy"`
+	Security SecurityConfig `yaml:"security" json:"security"`
 }
 
+// ServerConfig sets up the listener. With a certificate it serves HTTP/2 as
+// well as HTTP/1.1; H2C also accepts HTTP/2 without TLS (prior knowledge),
+// for gRPC clients behind a load balancer that terminates TLS.
 type ServerConfig struct {
-	Port         string        `yaml:"port"`
-	ReadTimeout  time.Duration `yaml:"read_timeout"`
-	WriteTimeout time.Duration `yaml:"write_timeout"`
-	CertFile     string        `yaml:"cert_file"`
-	KeyFile      string        `yaml:"key_file"`
+	Port         string        `yaml:"port" json:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout" json:"write_timeout"`
+	CertFile     string        `yaml:"cert_file" json:"cert_file"`
+	KeyFile      string        `yaml:"key_file" json:"key_file"`
+	H2C          bool          `yaml:"h2c" json:"h2c"`
 }
 
+// ProxyConfig lists the upstream pools and the routes leading to them. The
+// pool named "default" serves requests that match no route and routes that
+// name no pool. Targets and Balancer are a shorthand for declaring it.
 type ProxyConfig struct {
-	Targets []string `yaml:"targets"`
+	Targets  []Target       `yaml:"targets" json:"targets"`
+	Balancer BalancerConfig `yaml:"balancer" json:"balancer"`
+	Pools    []PoolConfig   `yaml:"pools" json:"pools"`
+	Routes   []RouteConfig  `yaml:"routes" json:"routes"`
+	Cache    CacheConfig    `yaml:"cache" json:"cache"`
+}
+
+// CacheConfig enables a shared HTTP cache in front of the upstream pools.
+// Store is "memory" (default) or "disk", which keeps entries in Dir.
+// MaxSize bounds the store in bytes (64MB in memory, 1GB on disk) and
+// MaxEntrySize a single response (1MB). StaleWhileRevalidate and
+// StaleIfError apply to responses that set no such directive themselves.
+// Key lists the request parts responses are cached by: "host", "path",
+// "query", "query:<name>", "header:<name>" and "cookie:<name>". It
+// defaults to host, path and query.
+type CacheConfig struct {
+	Enabled              bool          `yaml:"enabled" json:"enabled"`
+	Store                string        `yaml:"store" json:"store"`
+	Dir                  string        `yaml:"dir" json:"dir"`
+	MaxSize              int64         `yaml:"max_size" json:"max_size"`
+	MaxEntrySize         int64         `yaml:"max_entry_size" json:"max_entry_size"`
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate" json:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error" json:"stale_if_error"`
+	Key                  []string      `yaml:"key" json:"key"`
+}
+
+// PoolConfig is a named group of upstream targets. Timeout bounds each
+// proxied request, including the response body; zero means no limit.
+type PoolConfig struct {
+	Name           string               `yaml:"name" json:"name"`
+	Targets        []Target             `yaml:"targets" json:"targets"`
+	Balancer       BalancerConfig       `yaml:"balancer" json:"balancer"`
+	Timeout        time.Duration        `yaml:"timeout" json:"timeout"`
+	HealthCheck    HealthCheckConfig    `yaml:"health_check" json:"health_check"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" json:"circuit_breaker"`
+	Retry          RetryConfig          `yaml:"retry" json:"retry"`
+	Sticky         StickyConfig         `yaml:"sticky" json:"sticky"`
+	Transport      TransportConfig      `yaml:"transport" json:"transport"`
+}
+
+// HealthCheckConfig probes every target of a pool each Interval. Without a
+// Path the probe only opens a TCP connection. With a Path it sends an HTTP
+// request (Method, default GET, with an optional Host header) over Scheme,
+// default the target's, and expects a status in ExpectedStatus, e.g. "200",
+// "200-299" or "200,204" (default "200-399"), and a body containing Body and
+// matching BodyRegex when set. A target turns unhealthy after
+// UnhealthyThreshold failed probes in a row (default 3) and healthy again
+// after HealthyThreshold successful ones (default 2).
+type HealthCheckConfig struct {
+	Path               string        `yaml:"path" json:"path"`
+	Scheme             string        `yaml:"scheme" json:"scheme"`
+	Method             string        `yaml:"method" json:"method"`
+	Host               string        `yaml:"host" json:"host"`
+	ExpectedStatus     string        `yaml:"expected_status" json:"expected_status"`
+	Body               string        `yaml:"body" json:"body"`
+	BodyRegex          string        `yaml:"body_regex" json:"body_regex"`
+	Interval           time.Duration `yaml:"interval" json:"interval"`
+	Timeout            time.Duration `yaml:"timeout" json:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold" json:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold" json:"unhealthy_threshold"`
+}
+
+// CircuitBreakerConfig stops sending requests to a target that keeps
+// failing. Each target's circuit opens after ConsecutiveFailures failures in
+// a row (default 5, negative turns it off), or once ErrorPercent of the
+// requests in the rolling Window (default 10s) failed, counting only when
+// there were at least MinRequests of them (default 20). ErrorPercent zero
+// turns the error rate off. After OpenTimeout (default 30s) the circuit lets
+// at most HalfOpenRequests probes through at a time (default 1); it closes
+// once that many succeed and opens again on the first failure.
+//
+// A response is a failure when its status is in FailureStatuses (default
+// every 5xx), or for gRPC calls when its grpc-status is in GRPCFailureCodes
+// (default UNKNOWN, DEADLINE_EXCEEDED, INTERNAL, UNAVAILABLE and DATA_LOSS).
+// Connection errors always count; timeouts, DEADLINE_EXCEEDED included,
+// count unless IgnoreTimeouts is set.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures" json:"consecutive_failures"`
+	ErrorPercent        float64       `yaml:"error_percent" json:"error_percent"`
+	Window              time.Duration `yaml:"window" json:"window"`
+	MinRequests         int           `yaml:"min_requests" json:"min_requests"`
+	OpenTimeout         time.Duration `yaml:"open_timeout" json:"open_timeout"`
+	HalfOpenRequests    int           `yaml:"half_open_requests" json:"half_open_requests"`
+	FailureStatuses     []int         `yaml:"failure_statuses" json:"failure_statuses"`
+	GRPCFailureCodes    []int         `yaml:"grpc_failure_codes" json:"grpc_failure_codes"`
+	IgnoreTimeouts      bool          `yaml:"ignore_timeouts" json:"ignore_timeouts"`
+}
+
+// RetryConfig sends a failed request again to another target of the pool.
+// Requests with an idempotent method or an Idempotency-Key header are
+// retried on a status in Statuses (default 502 and 503) or a transport error
+// other than a timeout; any request is retried when no connection to the
+// target could be made. A request is retried at most MaxRetries times
+// (default 2, negative turns retries off), after a random wait of up to
+// BackoffBase (default 25ms) doubled per retry and capped at BackoffMax
+// (default 250ms).
+//
+// Retries within the last 10 seconds may not exceed BudgetPercent of the
+// requests (default 20), though MinRetries of them (default 10) are always
+// allowed. Request bodies up to MaxBodySize bytes (default 64KB) are buffered
+// so they can be sent again; requests with larger bodies are not retried.
+type RetryConfig struct {
+	MaxRetries    int           `yaml:"max_retries" json:"max_retries"`
+	Statuses      []int         `yaml:"statuses" json:"statuses"`
+	BudgetPercent float64       `yaml:"budget_percent" json:"budget_percent"`
+	MinRetries    int           `yaml:"min_retries" json:"min_retries"`
+	BackoffBase   time.Duration `yaml:"backoff_base" json:"backoff_base"`
+	BackoffMax    time.Duration `yaml:"backoff_max" json:"backoff_max"`
+	MaxBodySize   int64         `yaml:"max_body_size" json:"max_body_size"`
+}
+
+// StickyConfig pins each client to one target of the pool. Mode "cookie"
+// hands out a cookie, Name (default "waf_affinity"), naming the target and
+// signed with Secret (random per process when empty); it lasts TTL, or the
+// browser session when zero. Modes "app_cookie" and "header" hash the value
+// of the application's own cookie or header Name onto a target. When the
+// pinned target is down or its circuit is open, the request goes to another
+// target, and in cookie mode the cookie moves along with it.
+type StickyConfig struct {
+	Mode   string        `yaml:"mode" json:"mode"`
+	Name   string        `yaml:"name" json:"name"`
+	Secret string        `yaml:"secret" json:"secret"`
+	TTL    time.Duration `yaml:"ttl" json:"ttl"`
+}
+
+// TransportConfig tunes the connections to a pool's targets. Zero values
+// keep Go's defaults: DialTimeout 30s, KeepAlive 30s (negative turns TCP
+// keep-alive probes off), TLSHandshakeTimeout 10s, no ResponseHeaderTimeout,
+// IdleConnTimeout 90s, MaxIdleConnsPerHost 2 and no MaxConnsPerHost.
+// DisableKeepAlives opens a new connection for every request. Protocol is
+// "http1" for HTTP/1.1 only, "http2" for HTTP/2 only, "h2c" for HTTP/2 that
+// goes without TLS to http:// targets (as gRPC services expect), or empty to
+// use HTTP/2 when the target offers it over TLS.
+type TransportConfig struct {
+	DialTimeout           time.Duration     `yaml:"dial_timeout" json:"dial_timeout"`
+	KeepAlive             time.Duration     `yaml:"keep_alive" json:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration     `yaml:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration     `yaml:"response_header_timeout" json:"response_header_timeout"`
+	IdleConnTimeout       time.Duration     `yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   int               `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int               `yaml:"max_conns_per_host" json:"max_conns_per_host"`
+	DisableKeepAlives     bool              `yaml:"disable_keep_alives" json:"disable_keep_alives"`
+	Protocol              string            `yaml:"protocol" json:"protocol"`
+	TLS                   UpstreamTLSConfig `yaml:"tls" json:"tls"`
+}
+
+// UpstreamTLSConfig secures the connections to HTTPS targets. CAFile is a
+// PEM bundle trusted instead of the system roots. ServerName overrides the
+// SNI name and the name the certificate is checked against.
+// InsecureSkipVerify turns certificate verification off, for lab setups.
+// PinnedSHA256 lists base64 SHA-256 hashes of public keys (SubjectPublicKeyInfo,
+// optionally prefixed "sha256/"); the target's chain must contain one of
+// them, even with InsecureSkipVerify. CertFile and KeyFile are the client
+// certificate for mutual TLS.
+type UpstreamTLSConfig struct {
+	CAFile             string   `yaml:"ca_file" json:"ca_file"`
+	ServerName         string   `yaml:"server_name" json:"server_name"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	PinnedSHA256       []string `yaml:"pinned_sha256" json:"pinned_sha256"`
+	CertFile           string   `yaml:"cert_file" json:"cert_file"`
+	KeyFile            string   `yaml:"key_file" json:"key_file"`
+}
+
+// RouteConfig sends matching requests to Pool. Routes are tried in order and
+// every configured matcher must match:
+//   - Hosts: exact host names, or "*.example.com" for any subdomain
+//   - Paths: path prefixes ending on a segment boundary; PathRegex: a regular
+//     expression on the path. Both see the path with dot segments resolved
+//   - Methods: HTTP methods
+//   - Headers: header name to a regular expression its value must match
+type RouteConfig struct {
+	Name      string            `yaml:"name" json:"name"`
+	Hosts     []string          `yaml:"hosts" json:"hosts"`
+	Paths     []string          `yaml:"paths" json:"paths"`
+	PathRegex string            `yaml:"path_regex" json:"path_regex"`
+	Methods   []string          `yaml:"methods" json:"methods"`
+	Headers   map[string]string `yaml:"headers" json:"headers"`
+	Pool      string            `yaml:"pool" json:"pool"`
+	Security  RouteSecurity     `yaml:"security" json:"security"`
+	Cache     RouteCache        `yaml:"cache" json:"cache"`
+}
+
+// RouteCache adjusts caching for the requests of a route. Bypass sends
+// them straight to the upstream and Key replaces the global cache key.
+type RouteCache struct {
+	Bypass bool     `yaml:"bypass" json:"bypass"`
+	Key    []string `yaml:"key" json:"key"`
+}
+
+// RouteSecurity adjusts inspection for the requests of a route.
+// SkipInspection turns off User-Agent blocking and the rules, SkipRules
+// turns off the named rules, and MaxBodySize overrides the global limit.
+type RouteSecurity struct {
+	SkipInspection bool     `yaml:"skip_inspection" json:"skip_inspection"`
+	SkipRules      []string `yaml:"skip_rules" json:"skip_rules"`
+	MaxBodySize    int64    `yaml:"max_body_size" json:"max_body_size"`
+}
+
+// Target is an upstream server. In YAML it is either a plain URL or a mapping
+// with url and weight. Weight defaults to 1.
+type Target struct {
+	URL    string `yaml:"url" json:"url"`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+func (t *Target) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = Target{URL: node.Value}
+		return nil
+	}
+	type plain Target
+	return node.Decode((*plain)(t))
+}
+
+func (t Target) MarshalYAML() (any, error) {
+	if t.Weight <= 1 {
+		return t.URL, nil
+	}
+	type plain Target
+	return plain(t), nil
+}
+
+// BalancerConfig selects how requests are spread over the targets:
+//   - round_robin (default): smooth weighted round robin
+//   - least_requests: fewest outstanding requests relative to weight
+//   - p2c_ewma: the cheaper of two random targets, by latency EWMA and load
+//   - random: weighted random
+//   - ring_hash, maglev: consistent hashing on HashKey, which is "ip"
+//     (default), "header:<Name>" or "cookie:<Name>"; requests without the
+//     header or cookie are hashed by client IP
+type BalancerConfig struct {
+	Strategy string `yaml:"strategy" json:"strategy"`
+	HashKey  string `yaml:"hash_key" json:"hash_key"`
 }
 
 type SecurityConfig struct {
-	BlockUserAgents []string        `yaml:"block_user_agents"`
-	RateLimit       RateLimitConfig `yaml:"rate_limit"`
-	Rules           []SecurityRule  `yaml:"rules"`
-	MaxBodySize     int64           `yaml:"max_body_size"`
+	// TrustedProxies lists the addresses and CIDR ranges of proxies in
+	// front of the WAF whose X-Forwarded-For and X-Real-IP headers are
+	// believed. Requests from anywhere else are attributed to the peer.
+	TrustedProxies  []string             `yaml:"trusted_proxies" json:"trusted_proxies"`
+	BlockUserAgents []string             `yaml:"block_user_agents" json:"block_user_agents"`
+	RateLimit       RateLimitConfig      `yaml:"rate_limit" json:"rate_limit"`
+	Rules           []SecurityRule       `yaml:"rules" json:"rules"`
+	MaxBodySize     int64                `yaml:"max_body_size" json:"max_body_size"`
+	Concurrency     ConcurrencyConfig    `yaml:"concurrency" json:"concurrency"`
+	Jail            JailConfig           `yaml:"jail" json:"jail"`
+	Quota           QuotaConfig          `yaml:"quota" json:"quota"`
+	IPFilter        IPFilterConfig       `yaml:"ip_filter" json:"ip_filter"`
+	GeoIP           GeoIPConfig          `yaml:"geoip" json:"geoip"`
+	Challenge       ChallengeConfig      `yaml:"challenge" json:"challenge"`
+	TLSFingerprint  TLSFingerprintConfig `yaml:"tls_fingerprint" json:"tls_fingerprint"`
+	ThreatFeeds     ThreatFeedConfig     `yaml:"threat_feeds" json:"threat_feeds"`
+	Honeypot        HoneypotConfig       `yaml:"honeypot" json:"honeypot"`
+	GoodBots        GoodBotConfig        `yaml:"good_bots" json:"good_bots"`
+	Scanner         ScannerConfig        `yaml:"scanner_detection" json:"scanner_detection"`
+	WebSocket       WebSocketConfig      `yaml:"websocket" json:"websocket"`
 }
 
 type RateLimitConfig struct {
-	Enabled           bool `yaml:"enabled"`
-	RequestsPerMinute int  `yaml:"requests_per_minute"`
+	Enabled           bool              `yaml:"enabled" json:"enabled"`
+	RequestsPerMinute int               `yaml:"requests_per_minute" json:"requests_per_minute"`
+	Burst             int               `yaml:"burst" json:"burst"`
+	MaxClients        int               `yaml:"max_clients" json:"max_clients"`
+	Action            string            `yaml:"action" json:"action"`
+	Policies          []RateLimitPolicy `yaml:"policies" json:"policies"`
+	Login             LoginConfig       `yaml:"login" json:"login"`
+}
+
+// LoginConfig protects login endpoints against credential stuffing and
+// account takeover. POSTs to Paths are attributed to the UsernameField of the
+// form or JSON body, and upstream responses with one of FailureStatuses count
+// as failed logins. Within Window, a username with MaxUserFailures failures,
+// a client IP with MaxIPFailures failures or a client IP trying
+// MaxUsernamesPerIP different usernames is blocked (Action "block", default)
+// or challenged (Action "challenge"). Counters decay continuously, so a
+// blocked key recovers gradually over the window.
+type LoginConfig struct {
+	Enabled           bool          `yaml:"enabled" json:"enabled"`
+	Paths             []string      `yaml:"paths" json:"paths"`
+	UsernameField     string        `yaml:"username_field" json:"username_field"`
+	FailureStatuses   []int         `yaml:"failure_statuses" json:"failure_statuses"`
+	Window            time.Duration `yaml:"window" json:"window"`
+	MaxUserFailures   int           `yaml:"max_user_failures" json:"max_user_failures"`
+	MaxIPFailures     int           `yaml:"max_ip_failures" json:"max_ip_failures"`
+	MaxUsernamesPerIP int           `yaml:"max_usernames_per_ip" json:"max_usernames_per_ip"`
+	Action            string        `yaml:"action" json:"action"`
+}
+
+// RateLimitPolicy gives requests matching Paths, Methods, Countries and ASNs
+// their own token bucket. Name is required, unique and not "default". Key
+// selects what the bucket is tracked by: "ip" (default), "country", "asn",
+// "ja3", "ja4" or "header:<Name>", falling back to the client IP when the
+// value is unknown. A header key is only safe for a header set by a trusted
+// upstream, such as an authenticating gateway: a client that sets the header
+// itself gets a fresh bucket for every value it sends. Action is "block"
+// (default) or "challenge" to let clients past the limit once they solve a
+// proof-of-work challenge, up to four times the limit.
+type RateLimitPolicy struct {
+	Name              string   `yaml:"name" json:"name"`
+	Paths             []string `yaml:"paths" json:"paths"`
+	Methods           []string `yaml:"methods" json:"methods"`
+	Countries         []string `yaml:"countries" json:"countries"`
+	ASNs              []uint   `yaml:"asns" json:"asns"`
+	Key               string   `yaml:"key" json:"key"`
+	RequestsPerMinute int      `yaml:"requests_per_minute" json:"requests_per_minute"`
+	Burst             int      `yaml:"burst" json:"burst"`
+	Action            string   `yaml:"action" json:"action"`
+}
+
+type ConcurrencyConfig struct {
+	Enabled      bool            `yaml:"enabled" json:"enabled"`
+	MaxInFlight  int             `yaml:"max_in_flight" json:"max_in_flight"`
+	MaxPerClient int             `yaml:"max_per_client" json:"max_per_client"`
+	Adaptive     AdaptiveConfig  `yaml:"adaptive" json:"adaptive"`
+	Priorities   []PriorityClass `yaml:"priorities" json:"priorities"`
+}
+
+// AdaptiveConfig tunes the AIMD limiter that follows upstream latency.
+type AdaptiveConfig struct {
+	Enabled          bool          `yaml:"enabled" json:"enabled"`
+	InitialLimit     int           `yaml:"initial_limit" json:"initial_limit"`
+	MinLimit         int           `yaml:"min_limit" json:"min_limit"`
+	MaxLimit         int           `yaml:"max_limit" json:"max_limit"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold" json:"latency_threshold"`
+	BackoffRatio     float64       `yaml:"backoff_ratio" json:"backoff_ratio"`
+}
+
+// PriorityClass groups traffic for load shedding. MaxShare is the fraction
+// of the current concurrency limit the class may occupy, so classes with a
+// smaller share are shed first when the limit shrinks.
+type PriorityClass struct {
+	Name     string            `yaml:"name" json:"name"`
+	Paths    []string          `yaml:"paths" json:"paths"`
+	Methods  []string          `yaml:"methods" json:"methods"`
+	Headers  map[string]string `yaml:"headers" json:"headers"`
+	MaxShare float64           `yaml:"max_share" json:"max_share"`
+}
+
+// JailConfig controls automatic temporary bans. A client that exceeds any of
+// the Max* counters within Window is banned for BanTime, and each repeat ban
+// is BanMultiplier times longer, up to MaxBanTime. Bans placed by other
+// components, such as the honeypot, apply even when Enabled is false. At most
+// MaxClients offenders are tracked.
+type JailConfig struct {
+	Enabled          bool          `yaml:"enabled" json:"enabled"`
+	Window           time.Duration `yaml:"window" json:"window"`
+	MaxRuleHits      int           `yaml:"max_rule_hits" json:"max_rule_hits"`
+	MaxRateLimitHits int           `yaml:"max_rate_limit_hits" json:"max_rate_limit_hits"`
+	MaxNotFound      int           `yaml:"max_not_found" json:"max_not_found"`
+	BanTime          time.Duration `yaml:"ban_time" json:"ban_time"`
+	MaxBanTime       time.Duration `yaml:"max_ban_time" json:"max_ban_time"`
+	BanMultiplier    float64       `yaml:"ban_multiplier" json:"ban_multiplier"`
+	MaxClients       int           `yaml:"max_clients" json:"max_clients"`
+}
+
+// QuotaConfig defines usage quotas per API key. Counters are persisted in
+// DataDir and reset on calendar boundaries in the configured Timezone.
+type QuotaConfig struct {
+	Enabled          bool          `yaml:"enabled" json:"enabled"`
+	Header           string        `yaml:"header" json:"header"`
+	DataDir          string        `yaml:"data_dir" json:"data_dir"`
+	Timezone         string        `yaml:"timezone" json:"timezone"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" json:"snapshot_interval"`
+	Limits           []QuotaLimit  `yaml:"limits" json:"limits"`
+}
+
+// QuotaLimit allows Limit requests per Period ("daily" or "monthly") for
+// each of Keys, or for every API key when Keys is empty.
+type QuotaLimit struct {
+	Name   string   `yaml:"name" json:"name"`
+	Keys   []string `yaml:"keys" json:"keys"`
+	Period string   `yaml:"period" json:"period"`
+	Limit  int64    `yaml:"limit" json:"limit"`
+}
+
+// IPFilterConfig lists IPv4/IPv6 addresses and CIDR ranges to allow or deny,
+// inline or in files with one entry per line. Allowed ranges take precedence
+// over denied ones and skip the rules engine.
+type IPFilterConfig struct {
+	Allow      []string `yaml:"allow" json:"allow"`
+	Deny       []string `yaml:"deny" json:"deny"`
+	AllowFiles []string `yaml:"allow_files" json:"allow_files"`
+	DenyFiles  []string `yaml:"deny_files" json:"deny_files"`
+}
+
+// GeoIPConfig points at local MaxMind databases. Either file can be replaced
+// on disk and is picked up by the config watcher.
+type GeoIPConfig struct {
+	CountryDB string      `yaml:"country_db" json:"country_db"`
+	ASNDB     string      `yaml:"asn_db" json:"asn_db"`
+	Policies  []GeoPolicy `yaml:"policies" json:"policies"`
+}
+
+// GeoPolicy matches requests from the listed countries (ISO codes) or ASNs,
+// optionally limited to Paths and Methods. Action is "block" (default) or
+// "log" to only record matches.
+type GeoPolicy struct {
+	Name      string   `yaml:"name" json:"name"`
+	Countries []string `yaml:"countries" json:"countries"`
+	ASNs      []uint   `yaml:"asns" json:"asns"`
+	Paths     []string `yaml:"paths" json:"paths"`
+	Methods   []string `yaml:"methods" json:"methods"`
+	Action    string   `yaml:"action" json:"action"`
+}
+
+// ChallengeConfig controls the proof-of-work interstitial used by the
+// "challenge" action of rules and rate limit policies. UnderAttack challenges
+// every request. Clearance cookies are signed with Secret (a random key per
+// process when empty) and stay valid for TTL.
+type ChallengeConfig struct {
+	UnderAttack bool          `yaml:"under_attack" json:"under_attack"`
+	Secret      string        `yaml:"secret" json:"secret"`
+	Difficulty  int           `yaml:"difficulty" json:"difficulty"`
+	TTL         time.Duration `yaml:"ttl" json:"ttl"`
+}
+
+// TLSFingerprintConfig blocks TLS clients by fingerprint. BlockJA3 takes JA3
+// MD5 hashes or full JA3 strings, BlockJA4 takes JA4 fingerprints.
+type TLSFingerprintConfig struct {
+	BlockJA3 []string `yaml:"block_ja3" json:"block_ja3"`
+	BlockJA4 []string `yaml:"block_ja4" json:"block_ja4"`
+}
+
+// HoneypotConfig sets up decoy paths and hidden form fields. A client that
+// requests a decoy path (or anything below it), or fills in one of the hidden
+// fields, is banned for BanTime. With Tarpit the decoy response trickles out
+// one byte per TarpitInterval for up to TarpitDuration, for at most
+// MaxTarpits clients at a time.
+type HoneypotConfig struct {
+	Enabled        bool          `yaml:"enabled" json:"enabled"`
+	Paths          []string      `yaml:"paths" json:"paths"`
+	FormFields     []string      `yaml:"form_fields" json:"form_fields"`
+	BanTime        time.Duration `yaml:"ban_time" json:"ban_time"`
+	Tarpit         bool          `yaml:"tarpit" json:"tarpit"`
+	TarpitInterval time.Duration `yaml:"tarpit_interval" json:"tarpit_interval"`
+	TarpitDuration time.Duration `yaml:"tarpit_duration" json:"tarpit_duration"`
+	MaxTarpits     int           `yaml:"max_tarpits" json:"max_tarpits"`
+}
+
+// WebSocketConfig applies to connections upgraded to WebSocket. With
+// Inspect, every text message from the client is matched against the
+// security rules with location "body" or "websocket" before it is passed on,
+// and a match closes the connection. Messages over MaxMessageSize (default
+// 1MB) close the connection, as does sending more than MessagesPerSecond
+// messages (0 = unlimited) with bursts of up to Burst (default one second's
+// worth). IdleTimeout (default 5m, negative turns it off) closes connections
+// without traffic in either direction.
+type WebSocketConfig struct {
+	Inspect           bool          `yaml:"inspect" json:"inspect"`
+	MaxMessageSize    int64         `yaml:"max_message_size" json:"max_message_size"`
+	MessagesPerSecond float64       `yaml:"messages_per_second" json:"messages_per_second"`
+	Burst             int           `yaml:"burst" json:"burst"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+// ScannerConfig classifies clients as vulnerability scanners from the status
+// codes they get back. Within a sliding Window, a client that sent at least
+// MinRequests requests, at least ErrorRatio of them answered with one of
+// ErrorStatuses, on at least DistinctPaths different paths, is a scanner.
+// Action is "ban" (default; jailed for BanTime, or the jail's escalating ban
+// time when zero), "challenge" (proof-of-work for the rest of the window) or
+// "log". At most MaxClients clients are tracked.
+type ScannerConfig struct {
+	Enabled       bool          `yaml:"enabled" json:"enabled"`
+	Window        time.Duration `yaml:"window" json:"window"`
+	ErrorStatuses []int         `yaml:"error_statuses" json:"error_statuses"`
+	MinRequests   int           `yaml:"min_requests" json:"min_requests"`
+	ErrorRatio    float64       `yaml:"error_ratio" json:"error_ratio"`
+	DistinctPaths int           `yaml:"distinct_paths" json:"distinct_paths"`
+	Action        string        `yaml:"action" json:"action"`
+	BanTime       time.Duration `yaml:"ban_time" json:"ban_time"`
+	MaxClients    int           `yaml:"max_clients" json:"max_clients"`
+}
+
+// GoodBotConfig verifies clients whose User-Agent claims to be a known
+// crawler with a reverse DNS lookup and a forward-confirming lookup. Verified
+// crawlers skip User-Agent blocking but are otherwise inspected; imposters are
+// blocked (Action "block", default) or only logged (Action "log"). Resolver is
+// the host:port of the DNS server to query, the system resolver when empty.
+// Verdicts are cached for CacheTTL. Bots defaults to the major search engines.
+type GoodBotConfig struct {
+	Enabled  bool          `yaml:"enabled" json:"enabled"`
+	Resolver string        `yaml:"resolver" json:"resolver"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl" json:"cache_ttl"`
+	Action   string        `yaml:"action" json:"action"`
+	Bots     []GoodBot     `yaml:"bots" json:"bots"`
+}
+
+// GoodBot is a crawler recognized by a substring of its User-Agent. Its
+// addresses must reverse-resolve to one of Domains or a subdomain of them.
+type GoodBot struct {
+	Name       string   `yaml:"name" json:"name"`
+	UserAgents []string `yaml:"user_agents" json:"user_agents"`
+	Domains    []string `yaml:"domains" json:"domains"`
+}
+
+// ThreatFeedConfig loads IP reputation lists. Scores of the "score" feeds
+// listing a client add up, and the request is blocked once the total reaches
+// BlockScore (never when 0).
+type ThreatFeedConfig struct {
+	BlockScore int          `yaml:"block_score" json:"block_score"`
+	Feeds      []ThreatFeed `yaml:"feeds" json:"feeds"`
+}
+
+// ThreatFeed is read from Path (a file, or every file in a directory) or a
+// local URL, and re-read every Refresh (default 1h). Format is "plain" (also
+// FireHOL netsets), "spamhaus" (DROP lists) or "csv" with 1-based IPColumn
+// and ScoreColumn. Action is "block" (default), "challenge" or "score", which
+// adds Score, or the CSV score when Score is 0.
+type ThreatFeed struct {
+	Name        string        `yaml:"name" json:"name"`
+	Path        string        `yaml:"path" json:"path"`
+	URL         string        `yaml:"url" json:"url"`
+	Format      string        `yaml:"format" json:"format"`
+	Refresh     time.Duration `yaml:"refresh" json:"refresh"`
+	Action      string        `yaml:"action" json:"action"`
+	Score       int           `yaml:"score" json:"score"`
+	IPColumn    int           `yaml:"ip_column" json:"ip_column"`
+	ScoreColumn int           `yaml:"score_column" json:"score_column"`
+	MinScore    int           `yaml:"min_score" json:"min_score"`
 }
 
+// SecurityRule matches Pattern against Location. Action is "block" (default)
+// or "challenge". Challenge rules no longer apply to a client once it holds a
+// clearance cookie, so they suit bot screening rather than attack payloads.
 type SecurityRule struct {
-	Name     string `yaml:"name"`
-	Pattern  string `yaml:"pattern"`
-	Location string `yaml:"location"`
+	Name     string `yaml:"name" json:"name"`
+	Pattern  string `yaml:"pattern" json:"pattern"`
+	Location string `yaml:"location" json:"location"`
+	Action   string `yaml:"action" json:"action"`
 }
 
 func LoadConfig(path string) (*Config, error) {
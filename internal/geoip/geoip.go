@@ -0,0 +1,73 @@
+package geoip
+
+import "net/netip"
+
+// Info is what the configured databases know about an address.
+type Info struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// DB combines an optional country (or city) database with an optional ASN
+// database.
+type DB struct {
+	readers []*Reader
+}
+
+// OpenDB opens the databases at the given paths. Empty paths are skipped.
+func OpenDB(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		r, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Empty reports whether no database is loaded.
+func (db *DB) Empty() bool {
+	return db == nil || len(db.readers) == 0
+}
+
+// Lookup collects country and ASN data for addr from every database. Lookup
+// errors are treated as unknown data.
+func (db *DB) Lookup(addr netip.Addr) Info {
+	var info Info
+	if db == nil {
+		return info
+	}
+
+	for _, r := range db.readers {
+		record, err := r.Lookup(addr)
+		if err != nil || record == nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = isoCode(record, "country")
+			if info.Country == "" {
+				info.Country = isoCode(record, "registered_country")
+			}
+		}
+		if info.ASN == 0 {
+			info.ASN = toUint(record["autonomous_system_number"])
+			info.ASOrg, _ = record["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+func isoCode(record map[string]any, field string) string {
+	country, ok := record[field].(map[string]any)
+	if !ok {
+		return ""
+	}
+	code, _ := country["iso_code"].(string)
+	return code
+}
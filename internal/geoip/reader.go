@@ -0,0 +1,361 @@
+// Package geoip reads MaxMind DB (.mmdb) files such as GeoLite2-Country and
+// GeoLite2-ASN without any external dependencies.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the run of zero bytes between the search tree and
+// the data section.
+const dataSectionSeparator = 16
+
+// Metadata describes the layout of a database.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint
+	NodeCount    uint
+	RecordSize   uint
+	BuildEpoch   uint
+}
+
+// Reader looks up records in an in-memory copy of a MaxMind DB file.
+type Reader struct {
+	Metadata  Metadata
+	buf       []byte
+	data      []byte // data section
+	ipv4Start uint
+}
+
+// Open reads the whole database at path into memory, so the file can be
+// replaced on disk while the Reader is in use.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses a database held in buf.
+func FromBytes(buf []byte) (*Reader, error) {
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, errors.New("geoip: metadata section not found")
+	}
+
+	meta, _, err := decoder{buf: buf[idx+len(metadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: invalid metadata: %w", err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("geoip: metadata is not a map")
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	r.Metadata.IPVersion = toUint(m["ip_version"])
+	r.Metadata.NodeCount = toUint(m["node_count"])
+	r.Metadata.RecordSize = toUint(m["record_size"])
+	r.Metadata.BuildEpoch = toUint(m["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("geoip: unsupported record size %d", r.Metadata.RecordSize)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize * 2 / 8
+	if treeSize+dataSectionSeparator > uint(idx) {
+		return nil, errors.New("geoip: search tree exceeds file size")
+	}
+	r.data = buf[treeSize+dataSectionSeparator : idx]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+func (r *Reader) readNode(node uint, bit uint) uint {
+	size := r.Metadata.RecordSize
+	off := node * size * 2 / 8
+	b := r.buf[off:]
+
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return (uint(b[3])&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return (uint(b[3])&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the decoded record for addr, or nil if the database has no
+// entry for it.
+func (r *Reader) Lookup(addr netip.Addr) (map[string]any, error) {
+	if !addr.IsValid() {
+		return nil, errors.New("geoip: invalid address")
+	}
+	addr = addr.Unmap()
+
+	var ip []byte
+	node := uint(0)
+	if addr.Is4() {
+		a := addr.As4()
+		ip = a[:]
+		node = r.ipv4Start
+	} else {
+		if r.Metadata.IPVersion == 4 {
+			return nil, nil
+		}
+		a := addr.As16()
+		ip = a[:]
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = r.readNode(node, bit)
+	}
+
+	if node == nodeCount {
+		return nil, nil // empty record
+	}
+	if node < nodeCount {
+		return nil, errors.New("geoip: invalid search tree")
+	}
+
+	off := node - nodeCount - dataSectionSeparator
+	if off >= uint(len(r.data)) {
+		return nil, errors.New("geoip: record pointer out of range")
+	}
+	v, _, err := decoder{buf: r.data}.decode(off)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	return m, nil
+}
+
+// decoder reads values from the MaxMind DB data format.
+type decoder struct {
+	buf []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("geoip: truncated data")
+
+func (d decoder) bytesAt(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.buf)) || off+n < off {
+		return nil, errTruncated
+	}
+	return d.buf[off : off+n], nil
+}
+
+// maxDepth bounds nesting so a malformed file cannot recurse forever.
+const maxDepth = 32
+
+// decode returns the value at off and the offset just past it.
+func (d decoder) decode(off uint) (any, uint, error) {
+	return d.decodeAt(off, 0)
+}
+
+func (d decoder) decodeAt(off uint, depth int) (any, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("geoip: data nested too deeply")
+	}
+	if off >= uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := d.buf[off]
+	off++
+
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeAt(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return nil, 0, errTruncated
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytesAt(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 3:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeAt(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("geoip: map key is not a string")
+			}
+			v, next, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeAt(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	case typeContainer, typeEndMarker:
+		return nil, off, nil
+	}
+
+	b, err := d.bytesAt(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("geoip: invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("geoip: invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case typeInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		// Values shorter than four bytes are positive
+		if size < 4 {
+			return int64(v), off, nil
+		}
+		return int64(int32(v)), off, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), off, nil
+	}
+	return nil, 0, fmt.Errorf("geoip: unknown data type %d", typ)
+}
+
+func (d decoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	b, err := d.bytesAt(off, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	off += ss + 1
+
+	var ptr uint
+	switch ss {
+	case 0:
+		ptr = vvv<<8 | uint(b[0])
+	case 1:
+		ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	case 3:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, off, nil
+}
+
+func toUint(v any) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	case int64:
+		if n > 0 {
+			return uint(n)
+		}
+	}
+	return 0
+}
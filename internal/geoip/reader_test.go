@@ -0,0 +1,235 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// The helpers below write just enough of the MaxMind DB format to build
+// small test databases.
+
+func encodeCtrl(typ byte, size int) []byte {
+	var out []byte
+	var sizeBits byte
+	var ext []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, ext = 29, []byte{byte(size - 29)}
+	default:
+		sizeBits, ext = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+	}
+	if typ <= 7 {
+		out = append(out, typ<<5|sizeBits)
+	} else {
+		out = append(out, sizeBits, typ-7)
+	}
+	return append(out, ext...)
+}
+
+func encodeValue(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(encodeCtrl(typeString, len(v)), v...)
+	case uint16:
+		b := []byte{byte(v >> 8), byte(v)}
+		return append(encodeCtrl(typeUint16, 2), b...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(encodeCtrl(typeUint32, 4), b...)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := encodeCtrl(typeMap, len(v))
+		for _, k := range keys {
+			out = append(out, encodeValue(k)...)
+			out = append(out, encodeValue(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported test value")
+}
+
+type testRecord struct {
+	prefix string
+	data   map[string]any
+}
+
+func buildDB(t *testing.T, ipVersion uint16, recordSize int, records []testRecord) []byte {
+	t.Helper()
+
+	const empty = -1
+	// Record values: >= 0 is a node index, empty, or -(2+i) for data item i
+	nodes := [][2]int{{empty, empty}}
+	var data [][]byte
+
+	for _, rec := range records {
+		p := netip.MustParsePrefix(rec.prefix)
+		var bits []byte
+		bitLen := p.Bits()
+		if p.Addr().Is4() && ipVersion == 6 {
+			a := p.Addr().As4()
+			var b16 [16]byte
+			copy(b16[12:], a[:])
+			bits = b16[:]
+			bitLen += 96
+		} else {
+			bits = p.Addr().AsSlice()
+		}
+
+		node := 0
+		for i := 0; i < bitLen; i++ {
+			bit := bits[i/8] >> (7 - i%8) & 1
+			if i == bitLen-1 {
+				nodes[node][bit] = -(2 + len(data))
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, encodeValue(rec.data))
+	}
+
+	nodeCount := len(nodes)
+	offsets := make([]int, len(data))
+	var section []byte
+	for i, d := range data {
+		offsets[i] = len(section)
+		section = append(section, d...)
+	}
+
+	resolve := func(v int) uint32 {
+		switch {
+		case v >= 0:
+			return uint32(v)
+		case v == empty:
+			return uint32(nodeCount)
+		}
+		return uint32(nodeCount + dataSectionSeparator + offsets[-(v+2)])
+	}
+
+	var tree []byte
+	for _, n := range nodes {
+		left, right := resolve(n[0]), resolve(n[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0x0f)<<4|byte(right>>24&0x0f),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(tree, left)
+			tree = binary.BigEndian.AppendUint32(tree, right)
+		}
+	}
+
+	var buf []byte
+	buf = append(buf, tree...)
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, section...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encodeValue(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"database_type":               "Test-DB",
+		"ip_version":                  ipVersion,
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})...)
+	return buf
+}
+
+var testRecords = []testRecord{
+	{"81.2.69.0/24", map[string]any{"country": map[string]any{"iso_code": "GB"}}},
+	{"2001:db8::/32", map[string]any{"country": map[string]any{"iso_code": "DE"}}},
+}
+
+func TestReader_Lookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := FromBytes(buildDB(t, 6, recordSize, testRecords))
+		if err != nil {
+			t.Fatalf("record size %d: FromBytes: %v", recordSize, err)
+		}
+
+		tests := []struct {
+			addr    string
+			country string
+		}{
+			{"81.2.69.160", "GB"},
+			{"::ffff:81.2.69.1", "GB"},
+			{"81.2.70.1", ""},
+			{"2001:db8::1", "DE"},
+			{"2001:db9::1", ""},
+		}
+		for _, tt := range tests {
+			record, err := r.Lookup(netip.MustParseAddr(tt.addr))
+			if err != nil {
+				t.Fatalf("record size %d: Lookup(%s): %v", recordSize, tt.addr, err)
+			}
+			if got := isoCode(record, "country"); got != tt.country {
+				t.Errorf("record size %d: Lookup(%s) country = %q, want %q", recordSize, tt.addr, got, tt.country)
+			}
+		}
+	}
+}
+
+func TestReader_IPv4Database(t *testing.T) {
+	r, err := FromBytes(buildDB(t, 4, 24, testRecords[:1]))
+	if err != nil {
+		t.Fatalf("FromBytes: %v", err)
+	}
+	record, err := r.Lookup(netip.MustParseAddr("81.2.69.1"))
+	if err != nil || isoCode(record, "country") != "GB" {
+		t.Errorf("expected GB, got %v (%v)", record, err)
+	}
+	if record, _ := r.Lookup(netip.MustParseAddr("2001:db8::1")); record != nil {
+		t.Errorf("expected no IPv6 data in an IPv4 database, got %v", record)
+	}
+}
+
+func TestDecoder_Pointer(t *testing.T) {
+	// "US" at offset 0 followed by a pointer back to it
+	buf := append(encodeValue("US"), typePointer<<5, 0)
+	v, next, err := decoder{buf: buf}.decode(3)
+	if err != nil || v != "US" || next != 5 {
+		t.Errorf("decode(pointer) = %v, %d, %v; want US, 5, nil", v, next, err)
+	}
+}
+
+func TestDB_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	countryPath := filepath.Join(dir, "country.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	if err := os.WriteFile(countryPath, buildDB(t, 6, 24, testRecords), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asnRecords := []testRecord{
+		{"81.2.69.0/24", map[string]any{
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		}},
+	}
+	if err := os.WriteFile(asnPath, buildDB(t, 6, 24, asnRecords), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDB(countryPath, asnPath)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	info := db.Lookup(netip.MustParseAddr("81.2.69.160"))
+	if info.Country != "GB" || info.ASN != 20712 || info.ASOrg != "Andrews & Arnold Ltd" {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
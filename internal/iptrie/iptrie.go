@@ -0,0 +1,160 @@
+// Package iptrie stores IPv4 and IPv6 prefixes in binary prefix trees for
+// longest-prefix lookups of client addresses.
+package iptrie
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+type node[V any] struct {
+	children [2]*node[V]
+	value    V
+	set      bool
+}
+
+// Trie maps IP prefixes to values. Lookups return the value of the longest
+// prefix containing the address. A Trie is not safe for concurrent writes;
+// build it fully, then share it read-only.
+type Trie[V any] struct {
+	v4   *node[V]
+	v6   *node[V]
+	size int
+}
+
+func New[V any]() *Trie[V] {
+	return &Trie[V]{v4: &node[V]{}, v6: &node[V]{}}
+}
+
+func (t *Trie[V]) root(addr netip.Addr) *node[V] {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// Insert stores value for prefix, replacing any previous value.
+func (t *Trie[V]) Insert(prefix netip.Prefix, value V) {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	bytes := addr.AsSlice()
+
+	n := t.root(addr)
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bytes[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &node[V]{}
+		}
+		n = n.children[bit]
+	}
+	if !n.set {
+		t.size++
+	}
+	n.value = value
+	n.set = true
+}
+
+// Lookup returns the value of the most specific prefix containing addr.
+func (t *Trie[V]) Lookup(addr netip.Addr) (V, bool) {
+	var (
+		value V
+		found bool
+	)
+	if !addr.IsValid() {
+		return value, false
+	}
+	addr = addr.Unmap()
+
+	n := t.root(addr)
+	var buf [16]byte
+	bytes := buf[:addr.BitLen()/8]
+	if addr.Is4() {
+		a := addr.As4()
+		copy(bytes, a[:])
+	} else {
+		a := addr.As16()
+		copy(bytes, a[:])
+	}
+
+	for i := 0; n != nil; i++ {
+		if n.set {
+			value, found = n.value, true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		n = n.children[bytes[i/8]>>(7-i%8)&1]
+	}
+	return value, found
+}
+
+// Contains reports whether any prefix in the trie contains addr.
+func (t *Trie[V]) Contains(addr netip.Addr) bool {
+	_, ok := t.Lookup(addr)
+	return ok
+}
+
+// Len returns the number of prefixes stored.
+func (t *Trie[V]) Len() int {
+	return t.size
+}
+
+// ParsePrefix accepts a CIDR prefix or a single address, which is treated as
+// a full-length prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ReadList parses one address or prefix per line. Blank lines and anything
+// after '#' or ';' are ignored.
+func ReadList(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		p, err := ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, scanner.Err()
+}
+
+// ReadListFile reads a list in the ReadList format from path.
+func ReadListFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefixes, err := ReadList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return prefixes, nil
+}
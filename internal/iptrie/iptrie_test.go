@@ -0,0 +1,71 @@
+package iptrie
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestTrie_LongestPrefix(t *testing.T) {
+	trie := New[string]()
+	for prefix, value := range map[string]string{
+		"10.0.0.0/8":    "private",
+		"10.1.0.0/16":   "office",
+		"192.0.2.7":     "host",
+		"2001:db8::/32": "doc",
+	} {
+		p, err := ParsePrefix(prefix)
+		if err != nil {
+			t.Fatalf("ParsePrefix(%q): %v", prefix, err)
+		}
+		trie.Insert(p, value)
+	}
+
+	tests := []struct {
+		addr  string
+		value string
+		found bool
+	}{
+		{"10.2.3.4", "private", true},
+		{"10.1.3.4", "office", true},
+		{"192.0.2.7", "host", true},
+		{"192.0.2.8", "", false},
+		{"::ffff:10.1.0.1", "office", true},
+		{"2001:db8:1::1", "doc", true},
+		{"2001:db9::1", "", false},
+	}
+
+	for _, tt := range tests {
+		value, found := trie.Lookup(netip.MustParseAddr(tt.addr))
+		if found != tt.found || value != tt.value {
+			t.Errorf("Lookup(%s) = %q, %v; want %q, %v", tt.addr, value, found, tt.value, tt.found)
+		}
+	}
+
+	if trie.Len() != 4 {
+		t.Errorf("expected 4 prefixes, got %d", trie.Len())
+	}
+}
+
+func TestReadList(t *testing.T) {
+	input := `# blocklist
+203.0.113.0/24 ; SBL123
+198.51.100.1
+
+2001:db8::/48   # documentation
+`
+	prefixes, err := ReadList(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ReadList: %v", err)
+	}
+	if len(prefixes) != 3 {
+		t.Fatalf("expected 3 prefixes, got %d", len(prefixes))
+	}
+	if prefixes[1].Bits() != 32 {
+		t.Errorf("expected single address to become a /32, got /%d", prefixes[1].Bits())
+	}
+
+	if _, err := ReadList(strings.NewReader("not-an-ip\n")); err == nil {
+		t.Error("expected an error for an invalid entry")
+	}
+}
@@ -0,0 +1,227 @@
+// Package lru provides a bounded map spread over independently locked
+// shards, which evicts its least recently used entries when full.
+package lru
+
+import "sync"
+
+const numShards = 64 // must be a power of two
+
+// evictScan is how many protected entries eviction passes over before it
+// evicts one regardless, which keeps the memory bound hard.
+const evictScan = 8
+
+type entry[V any] struct {
+	key        string
+	value      V
+	prev, next *entry[V]
+}
+
+// shard is one lock domain of a Cache. Entries are kept in LRU order (head
+// is the most recently used) so eviction never scans the whole map.
+type shard[V any] struct {
+	mu       sync.Mutex
+	entries  map[string]*entry[V]
+	head     *entry[V]
+	tail     *entry[V]
+	capacity int
+}
+
+// Cache maps string keys to values of type V. Values live inside the cache
+// and are only accessed through callbacks that run under their shard's lock,
+// so they may be modified in place. The callbacks must not call back into
+// the cache.
+type Cache[V any] struct {
+	shards [numShards]shard[V]
+	keep   func(v *V) bool
+}
+
+// New returns a Cache holding up to about maxEntries entries. When a shard is
+// full its least recently used entry is evicted, preferring entries keep
+// does not protect. keep may be nil.
+func New[V any](maxEntries int, keep func(v *V) bool) *Cache[V] {
+	c := &Cache[V]{keep: keep}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*entry[V])
+	}
+	c.SetCapacity(maxEntries)
+	return c
+}
+
+// SetCapacity changes the number of entries the cache holds, evicting the
+// least recently used ones if it shrinks.
+func (c *Cache[V]) SetCapacity(maxEntries int) {
+	perShard := max(maxEntries/numShards, 1)
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.capacity = perShard
+		for len(sh.entries) > sh.capacity {
+			sh.remove(sh.victim(c.keep))
+		}
+		sh.mu.Unlock()
+	}
+}
+
+func (c *Cache[V]) shard(key string) *shard[V] {
+	return &c.shards[fnv1a(key)&(numShards-1)]
+}
+
+// fnv1a hashes s with 32-bit FNV-1a. Unlike hash/fnv it does not allocate.
+func fnv1a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// Update calls fn with the value for key, adding a zero value first if there
+// is none, and marks it as the most recently used. It reports whether
+// another entry was evicted to make room.
+func (c *Cache[V]) Update(key string, fn func(v *V)) (evicted bool) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.entries[key]
+	if !ok {
+		if len(sh.entries) >= sh.capacity {
+			sh.remove(sh.victim(c.keep))
+			evicted = true
+		}
+		e = &entry[V]{key: key}
+		sh.entries[key] = e
+		sh.pushFront(e)
+	} else {
+		sh.moveToFront(e)
+	}
+	fn(&e.value)
+	return evicted
+}
+
+// View calls fn with the value for key, if there is one, without changing
+// its position. It reports whether key was found.
+func (c *Cache[V]) View(key string, fn func(v *V)) bool {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.entries[key]
+	if ok {
+		fn(&e.value)
+	}
+	return ok
+}
+
+// DeleteIf removes key if fn reports true for its value, and reports whether
+// it did.
+func (c *Cache[V]) DeleteIf(key string, fn func(v *V) bool) bool {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.entries[key]
+	if !ok || !fn(&e.value) {
+		return false
+	}
+	sh.remove(e)
+	return true
+}
+
+// Range calls fn for every entry, one shard at a time.
+func (c *Cache[V]) Range(fn func(key string, v *V)) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for e := sh.head; e != nil; e = e.next {
+			fn(e.key, &e.value)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// DeleteFunc calls fn for every entry, one shard at a time, and removes those
+// it reports true for. It returns how many it removed.
+func (c *Cache[V]) DeleteFunc(fn func(key string, v *V) bool) int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for e := sh.head; e != nil; {
+			next := e.next
+			if fn(e.key, &e.value) {
+				sh.remove(e)
+				n++
+			}
+			e = next
+		}
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Len returns the number of entries.
+func (c *Cache[V]) Len() int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		n += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// victim picks the entry to evict: the least recently used one that keep
+// does not protect. Protected entries passed over are moved to the front, so
+// later evictions do not check them again; if only protected entries are
+// found within evictScan, the least recently used one is evicted anyway.
+func (sh *shard[V]) victim(keep func(v *V) bool) *entry[V] {
+	for i := 0; keep != nil && i < evictScan && sh.tail != nil && keep(&sh.tail.value); i++ {
+		sh.moveToFront(sh.tail)
+	}
+	return sh.tail
+}
+
+func (sh *shard[V]) remove(e *entry[V]) {
+	if e == nil {
+		return
+	}
+	sh.unlink(e)
+	delete(sh.entries, e.key)
+}
+
+func (sh *shard[V]) pushFront(e *entry[V]) {
+	e.prev = nil
+	e.next = sh.head
+	if sh.head != nil {
+		sh.head.prev = e
+	}
+	sh.head = e
+	if sh.tail == nil {
+		sh.tail = e
+	}
+}
+
+func (sh *shard[V]) unlink(e *entry[V]) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		sh.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		sh.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+func (sh *shard[V]) moveToFront(e *entry[V]) {
+	if sh.head == e {
+		return
+	}
+	sh.unlink(e)
+	sh.pushFront(e)
+}
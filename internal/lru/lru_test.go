@@ -0,0 +1,63 @@
+package lru
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[int](numShards, nil) // one entry per shard
+	c.Update("a", func(v *int) { *v = 1 })
+	sh := c.shard("a")
+
+	// Find another key in the same shard
+	other := ""
+	for i := 0; other == ""; i++ {
+		if k := strconv.Itoa(i); c.shard(k) == sh {
+			other = k
+		}
+	}
+	if !c.Update(other, func(v *int) {}) {
+		t.Error("expected an eviction from a full shard")
+	}
+	if c.View("a", func(v *int) {}) {
+		t.Error("expected a to be evicted")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len = %d, want 1", c.Len())
+	}
+}
+
+func TestCache_KeepsProtectedEntries(t *testing.T) {
+	c := New[bool](numShards*4, func(kept *bool) bool { return *kept })
+	c.Update("kept", func(v *bool) { *v = true })
+
+	// Flood the cache; the protected entry is never the only candidate
+	for i := range numShards * 100 {
+		c.Update(strconv.Itoa(i), func(v *bool) {})
+	}
+	if !c.View("kept", func(v *bool) {}) {
+		t.Error("protected entry was evicted")
+	}
+	if n := c.Len(); n > numShards*4 {
+		t.Errorf("Len = %d, exceeds capacity %d", n, numShards*4)
+	}
+}
+
+func TestCache_DeleteFunc(t *testing.T) {
+	c := New[int](1000, nil)
+	for i := range 10 {
+		c.Update(strconv.Itoa(i), func(v *int) { *v = i })
+	}
+	if n := c.DeleteFunc(func(_ string, v *int) bool { return *v%2 == 0 }); n != 5 {
+		t.Errorf("DeleteFunc removed %d, want 5", n)
+	}
+	if !c.DeleteIf("1", func(v *int) bool { return *v == 1 }) || c.DeleteIf("3", func(v *int) bool { return false }) {
+		t.Error("DeleteIf did not follow its condition")
+	}
+	sum := 0
+	c.Range(func(_ string, v *int) { sum += *v })
+	if sum != 3+5+7+9 {
+		t.Errorf("sum of remaining values = %d, want %d", sum, 3+5+7+9)
+	}
+}
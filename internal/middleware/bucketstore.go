@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"expvar"
+	"sync"
+)
+
+const bucketShards = 64 // must be a power of two
+
+var rateLimitEvictions = expvar.NewInt("ratelimit_evictions")
+
+// bucket is a token bucket linked into its shard's LRU list.
+type bucket struct {
+	key        string
+	tokens     float64
+	lastUpdate int64 // unix nanoseconds
+	prev, next *bucket
+}
+
+// bucketShard is one lock domain of a bucketStore. Buckets are kept in LRU
+// order (head is the most recently used) so the oldest entries can be
+// expired or evicted from the tail without scanning the whole map.
+type bucketShard struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	head     *bucket
+	tail     *bucket
+	free     *bucket // recycled buckets, linked through next
+	capacity int
+}
+
+// bucketStore holds token buckets spread over independently locked shards.
+// Memory is bounded: when a shard is full its least recently used bucket is
+// evicted, which keeps IP-spray attacks from growing the map without limit.
+type bucketStore struct {
+	shards [bucketShards]bucketShard
+}
+
+func newBucketStore(maxBuckets int) *bucketStore {
+	s := &bucketStore{}
+	for i := range s.shards {
+		s.shards[i].buckets = make(map[string]*bucket)
+	}
+	s.setCapacity(maxBuckets)
+	return s
+}
+
+func (s *bucketStore) setCapacity(maxBuckets int) {
+	perShard := maxBuckets / bucketShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.capacity = perShard
+		for len(sh.buckets) > sh.capacity {
+			sh.evict(sh.tail)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+func (s *bucketStore) shard(key string) *bucketShard {
+	return &s.shards[fnv1a(key)&(bucketShards-1)]
+}
+
+// fnv1a hashes s with 32-bit FNV-1a. Unlike hash/fnv it does not allocate.
+func fnv1a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// take refills the bucket for key and consumes one token from it. It reports
+// whether a token was available.
+func (s *bucketStore) take(key string, now int64, rate, burst float64) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// A bucket that has been idle long enough to refill completely is the
+	// same as a new one, so it can be dropped. Check a couple of the oldest
+	// entries on every call to expire idle clients incrementally.
+	idle := int64(burst / rate * 1e9)
+	for i := 0; i < 2 && sh.tail != nil && now-sh.tail.lastUpdate > idle; i++ {
+		sh.evict(sh.tail)
+	}
+
+	b, ok := sh.buckets[key]
+	if !ok {
+		if len(sh.buckets) >= sh.capacity {
+			sh.evict(sh.tail)
+			rateLimitEvictions.Add(1)
+		}
+		b = sh.alloc()
+		b.key = key
+		b.tokens = burst
+		b.lastUpdate = now
+		sh.buckets[key] = b
+		sh.pushFront(b)
+	} else {
+		sh.moveToFront(b)
+	}
+
+	// Refill tokens
+	if elapsed := now - b.lastUpdate; elapsed > 0 {
+		b.tokens += float64(elapsed) / 1e9 * rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.lastUpdate = now
+
+	if b.tokens >= 1.0 {
+		b.tokens -= 1.0
+		return true
+	}
+	return false
+}
+
+// tokens returns the tokens the bucket for key would hold at now, without
+// consuming any. Unknown keys hold a full burst.
+func (s *bucketStore) tokens(key string, now int64, rate, burst float64) float64 {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	b, ok := sh.buckets[key]
+	if !ok {
+		return burst
+	}
+	tokens := b.tokens
+	if elapsed := now - b.lastUpdate; elapsed > 0 {
+		tokens += float64(elapsed) / 1e9 * rate
+	}
+	return min(tokens, burst)
+}
+
+// Len returns the number of tracked buckets.
+func (s *bucketStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.buckets)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+func (sh *bucketShard) alloc() *bucket {
+	if b := sh.free; b != nil {
+		sh.free = b.next
+		b.next = nil
+		return b
+	}
+	return &bucket{}
+}
+
+func (sh *bucketShard) evict(b *bucket) {
+	if b == nil {
+		return
+	}
+	sh.unlink(b)
+	delete(sh.buckets, b.key)
+	*b = bucket{next: sh.free}
+	sh.free = b
+}
+
+func (sh *bucketShard) pushFront(b *bucket) {
+	b.prev = nil
+	b.next = sh.head
+	if sh.head != nil {
+		sh.head.prev = b
+	}
+	sh.head = b
+	if sh.tail == nil {
+		sh.tail = b
+	}
+}
+
+func (sh *bucketShard) unlink(b *bucket) {
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else {
+		sh.head = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	} else {
+		sh.tail = b.prev
+	}
+	b.prev, b.next = nil, nil
+}
+
+func (sh *bucketShard) moveToFront(b *bucket) {
+	if sh.head == b {
+		return
+	}
+	sh.unlink(b)
+	sh.pushFront(b)
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBucketStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	// One bucket per shard
+	s := newBucketStore(bucketShards)
+	now := time.Now().UnixNano()
+
+	// Find two keys that land in the same shard
+	first := "192.0.2.1"
+	var second string
+	for i := 2; ; i++ {
+		k := "192.0.2." + strconv.Itoa(i)
+		if s.shard(k) == s.shard(first) {
+			second = k
+			break
+		}
+	}
+
+	s.take(first, now, 1, 1)
+	if s.take(first, now, 1, 1) {
+		t.Fatal("expected drained bucket to reject")
+	}
+
+	// The new key pushes the drained bucket out...
+	s.take(second, now, 1, 1)
+	if n := len(s.shard(first).buckets); n != 1 {
+		t.Fatalf("expected shard to stay at capacity 1, got %d", n)
+	}
+	// ...so the first client starts over with a full bucket
+	if !s.take(first, now, 1, 1) {
+		t.Error("expected evicted client to get a fresh bucket")
+	}
+}
+
+func TestBucketStore_ExpiresIdleBuckets(t *testing.T) {
+	s := newBucketStore(1000)
+	now := time.Now().UnixNano()
+
+	for i := 0; i < 100; i++ {
+		s.take("198.51.100."+strconv.Itoa(i), now, 10, 10)
+	}
+	if n := s.Len(); n != 100 {
+		t.Fatalf("expected 100 buckets, got %d", n)
+	}
+
+	// A burst of 10 at 10 tokens/s refills in one second; after that the
+	// buckets are idle and get dropped as the shards are touched again.
+	later := now + int64(2*time.Second)
+	for i := 0; i < 5000; i++ {
+		s.take("client-"+strconv.Itoa(i), later, 10, 10)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := s.shard("198.51.100." + strconv.Itoa(i)).buckets["198.51.100."+strconv.Itoa(i)]; ok {
+			t.Fatalf("expected idle bucket %d to be expired", i)
+		}
+	}
+}
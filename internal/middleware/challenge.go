@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	// challengePath receives solved challenges. It is handled by the WAF and
+	// never reaches the upstream.
+	challengePath   = "/.waf/challenge"
+	clearanceCookie = "waf_clearance"
+
+	// challengeTimeout is how long a client has to solve a challenge.
+	challengeTimeout  = 5 * time.Minute
+	defaultDifficulty = 16
+	maxDifficulty     = 32
+	defaultClearance  = time.Hour
+)
+
+var (
+	challengesIssued = expvar.NewInt("challenges_issued")
+	challengesPassed = expvar.NewInt("challenges_passed")
+	challengesFailed = expvar.NewInt("challenges_failed")
+)
+
+type challengeKey struct{}
+
+// challengePassed reports whether the client holds a valid clearance cookie.
+// It is false when the Challenge middleware is not in the chain.
+func challengePassed(r *http.Request) bool {
+	state, ok := r.Context().Value(challengeKey{}).(*challengeState)
+	return ok && state.passed(r)
+}
+
+// serveChallenge answers the request with the proof-of-work interstitial. It
+// returns false when the Challenge middleware is not in the chain, in which
+// case the caller should block the request instead.
+func serveChallenge(w http.ResponseWriter, r *http.Request) bool {
+	state, ok := r.Context().Value(challengeKey{}).(*challengeState)
+	if !ok {
+		return false
+	}
+	state.serve(w, r)
+	return true
+}
+
+type challengeState struct {
+	underAttack bool
+	secret      []byte
+	difficulty  int
+	ttl         time.Duration
+}
+
+// Challenge serves a proof-of-work page to suspected bots and hands out a
+// signed clearance cookie, bound to the client IP and User-Agent, once the
+// puzzle is solved.
+type Challenge struct {
+	mu           sync.Mutex // serializes Update
+	randomSecret []byte
+	state        atomic.Pointer[challengeState]
+}
+
+func NewChallenge(cfg config.ChallengeConfig) *Challenge {
+	c := &Challenge{}
+	c.Update(cfg)
+	return c
+}
+
+// Update applies a new configuration. Changing the secret invalidates every
+// clearance handed out so far.
+func (c *Challenge) Update(cfg config.ChallengeConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := &challengeState{
+		underAttack: cfg.UnderAttack,
+		secret:      []byte(cfg.Secret),
+		difficulty:  cfg.Difficulty,
+		ttl:         cfg.TTL,
+	}
+	if next.difficulty <= 0 {
+		next.difficulty = defaultDifficulty
+	}
+	if next.difficulty > maxDifficulty {
+		next.difficulty = maxDifficulty
+	}
+	if next.ttl <= 0 {
+		next.ttl = defaultClearance
+	}
+	if len(next.secret) == 0 {
+		if c.randomSecret == nil {
+			c.randomSecret = make([]byte, 32)
+			rand.Read(c.randomSecret)
+			logger.Info("No challenge secret configured, clearances will not survive a restart")
+		}
+		next.secret = c.randomSecret
+	}
+
+	c.state.Store(next)
+}
+
+func (c *Challenge) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := c.state.Load()
+		if r.URL.Path == challengePath {
+			state.verify(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), challengeKey{}, state))
+		if state.underAttack && !isAllowlisted(r) && !state.passed(r) {
+			state.serve(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sign returns the HMAC of the NUL-separated parts.
+func (s *challengeState) sign(parts ...string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	for _, p := range parts {
+		mac.Write([]byte(p))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+// checkSigned verifies a value of the form "<fields>.<hex mac>" whose first
+// field is a unix expiry time, and returns the fields.
+func (s *challengeState) checkSigned(value, kind string, r *http.Request) ([]string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return nil, false
+	}
+	mac, err := hex.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	fields := strings.Split(value[:i], ".")
+	exp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, false
+	}
+	parts := append([]string{kind, ClientIP(r), r.UserAgent()}, fields...)
+	return fields, hmac.Equal(mac, s.sign(parts...))
+}
+
+func (s *challengeState) newSigned(kind string, r *http.Request, fields ...string) string {
+	parts := append([]string{kind, ClientIP(r), r.UserAgent()}, fields...)
+	return strings.Join(fields, ".") + "." + hex.EncodeToString(s.sign(parts...))
+}
+
+func (s *challengeState) passed(r *http.Request) bool {
+	cookie, err := r.Cookie(clearanceCookie)
+	if err != nil {
+		return false
+	}
+	_, ok := s.checkSigned(cookie.Value, "clearance", r)
+	return ok
+}
+
+// serve writes the challenge page. The token carries the expiry, a random
+// salt and the difficulty, signed together with the client IP and UA.
+func (s *challengeState) serve(w http.ResponseWriter, r *http.Request) {
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	exp := strconv.FormatInt(time.Now().Add(challengeTimeout).Unix(), 10)
+	token := s.newSigned("challenge", r, exp, hex.EncodeToString(salt), strconv.Itoa(s.difficulty))
+
+	returnTo := "/"
+	if r.Method == http.MethodGet {
+		returnTo = r.URL.RequestURI()
+	}
+
+	challengesIssued.Add(1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	challengePage.Execute(w, map[string]any{
+		"Action":     challengePath,
+		"Token":      token,
+		"Difficulty": s.difficulty,
+		"Return":     returnTo,
+	})
+}
+
+// verify checks a solved challenge and sets the clearance cookie.
+func (s *challengeState) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	token, nonce := r.PostFormValue("token"), r.PostFormValue("nonce")
+
+	fields, ok := s.checkSigned(token, "challenge", r)
+	if ok && len(fields) == 3 && len(nonce) <= 20 {
+		difficulty, _ := strconv.Atoi(fields[2])
+		ok = difficulty > 0 && leadingZeroBits(sha256.Sum256([]byte(token+":"+nonce))) >= difficulty
+	} else {
+		ok = false
+	}
+	if !ok {
+		challengesFailed.Add(1)
+		logger.Warn("Challenge failed", "client_ip", ClientIP(r))
+		s.serve(w, r)
+		return
+	}
+
+	challengesPassed.Add(1)
+	exp := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     clearanceCookie,
+		Value:    s.newSigned("clearance", r, exp),
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Only redirect to local paths
+	returnTo := r.PostFormValue("return")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// challengePage finds a nonce such that SHA-256(token ":" nonce) starts with
+// the required number of zero bits. SHA-256 is implemented inline because
+// crypto.subtle is unavailable over plain HTTP.
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Checking your browser</title>
+<style>
+body { background: #000; color: #ddd; font-family: sans-serif; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+main { text-align: center; }
+</style>
+</head>
+<body>
+<main>
+<h1>Checking your browser</h1>
+<p id="status">This takes a few seconds.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<form id="challenge" method="POST" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="nonce" value="">
+<input type="hidden" name="return" value="{{.Return}}">
+</form>
+</main>
+<script>
+(function () {
+  var token = {{.Token}}, difficulty = {{.Difficulty}};
+  var K = [], H = [];
+  for (var p = 2, n = 0; n < 64; p++) {
+    var prime = true;
+    for (var d = 2; d * d <= p; d++) {
+      if (p % d === 0) { prime = false; break; }
+    }
+    if (prime) {
+      if (n < 8) H[n] = Math.pow(p, 1 / 2) * 4294967296 | 0;
+      K[n++] = Math.pow(p, 1 / 3) * 4294967296 | 0;
+    }
+  }
+  function ror(x, n) { return (x >>> n) | (x << (32 - n)); }
+  function sha256(s) {
+    var words = [], bitLen = s.length * 8, i, j;
+    s += '\x80';
+    while (s.length % 64 !== 56) s += '\x00';
+    for (i = 0; i < s.length; i++) words[i >> 2] |= s.charCodeAt(i) << (3 - (i & 3)) * 8;
+    words.push(bitLen / 4294967296 | 0, bitLen | 0);
+    var h = H.slice();
+    for (j = 0; j < words.length; j += 16) {
+      var w = words.slice(j, j + 16), a = h.slice();
+      for (i = 0; i < 64; i++) {
+        if (i >= 16) {
+          var w15 = w[i - 15], w2 = w[i - 2];
+          w[i] = (w[i - 16] + (ror(w15, 7) ^ ror(w15, 18) ^ (w15 >>> 3)) + w[i - 7] + (ror(w2, 17) ^ ror(w2, 19) ^ (w2 >>> 10))) | 0;
+        }
+        var e = a[4], x = a[0];
+        var t1 = a[7] + (ror(e, 6) ^ ror(e, 11) ^ ror(e, 25)) + ((e & a[5]) ^ (~e & a[6])) + K[i] + w[i];
+        var t2 = (ror(x, 2) ^ ror(x, 13) ^ ror(x, 22)) + ((x & a[1]) ^ (x & a[2]) ^ (a[1] & a[2]));
+        a.unshift((t1 + t2) | 0);
+        a[4] = (a[4] + t1) | 0;
+        a.length = 8;
+      }
+      for (i = 0; i < 8; i++) h[i] = (h[i] + a[i]) | 0;
+    }
+    return h;
+  }
+  function leadingZeros(h) {
+    for (var i = 0, n = 0; i < 8; i++, n += 32) {
+      if (h[i] !== 0) return n + Math.clz32(h[i]);
+    }
+    return n;
+  }
+  var form = document.getElementById('challenge'), nonce = 0;
+  function work() {
+    for (var end = nonce + 5000; nonce < end; nonce++) {
+      if (leadingZeros(sha256(token + ':' + nonce)) >= difficulty) {
+        form.nonce.value = nonce;
+        form.submit();
+        return;
+      }
+    }
+    setTimeout(work, 0);
+  }
+  work();
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+var tokenPattern = regexp.MustCompile(`name="token" value="([^"]+)"`)
+
+// solveChallenge extracts the token from a challenge page and posts a valid
+// answer, returning the verification response.
+func solveChallenge(t *testing.T, handler http.Handler, page, userAgent string) *httptest.ResponseRecorder {
+	t.Helper()
+	m := tokenPattern.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatal("challenge page has no token")
+	}
+	token := m[1]
+	difficulty, _ := strconv.Atoi(strings.Split(token, ".")[2])
+
+	nonce := 0
+	for leadingZeroBits(sha256.Sum256([]byte(token+":"+strconv.Itoa(nonce)))) < difficulty {
+		nonce++
+	}
+
+	form := url.Values{"token": {token}, "nonce": {strconv.Itoa(nonce)}, "return": {"/protected?x=1"}}
+	req := httptest.NewRequest("POST", challengePath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestChallenge_UnderAttack(t *testing.T) {
+	logger.Init()
+	c := NewChallenge(config.ChallengeConfig{UnderAttack: true, Secret: "test", Difficulty: 8})
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	makeRequest := func(userAgent string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/protected", nil)
+		req.Header.Set("User-Agent", userAgent)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := makeRequest("browser")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Checking your browser") {
+		t.Fatalf("Expected challenge page, got %d", rec.Code)
+	}
+
+	verified := solveChallenge(t, handler, rec.Body.String(), "browser")
+	if verified.Code != http.StatusSeeOther || verified.Header().Get("Location") != "/protected?x=1" {
+		t.Fatalf("Expected redirect after solving, got %d %q", verified.Code, verified.Header().Get("Location"))
+	}
+	cookies := verified.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != clearanceCookie {
+		t.Fatalf("Expected clearance cookie, got %v", cookies)
+	}
+
+	if rec := makeRequest("browser", cookies[0]); rec.Code != http.StatusOK {
+		t.Errorf("Expected OK with clearance, got %d", rec.Code)
+	}
+	// Clearance is bound to the User-Agent
+	if rec := makeRequest("other", cookies[0]); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected challenge for a different User-Agent, got %d", rec.Code)
+	}
+
+	forged := *cookies[0]
+	forged.Value = strings.Replace(forged.Value, forged.Value[:1], "9", 1)
+	if rec := makeRequest("browser", &forged); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected challenge for a tampered cookie, got %d", rec.Code)
+	}
+}
+
+func TestChallenge_WrongAnswer(t *testing.T) {
+	logger.Init()
+	c := NewChallenge(config.ChallengeConfig{UnderAttack: true, Difficulty: 20})
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	token := tokenPattern.FindStringSubmatch(rec.Body.String())[1]
+
+	form := url.Values{"token": {token}, "nonce": {"0"}}
+	req := httptest.NewRequest("POST", challengePath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected a new challenge without clearance, got %d", rec.Code)
+	}
+}
+
+func TestChallenge_RuleAction(t *testing.T) {
+	logger.Init()
+	engine, err := rules.NewEngine([]config.SecurityRule{
+		{Name: "Scripted client", Pattern: "python-requests", Location: "headers", Action: "challenge"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChallenge(config.ChallengeConfig{Difficulty: 8})
+	security := SecurityMiddleware(func() config.SecurityConfig { return config.SecurityConfig{} }, func() *rules.Engine { return engine })
+	handler := c.Middleware(security(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "python-requests/2.31")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Checking your browser") {
+		t.Fatalf("Expected challenge page, got %d", rec.Code)
+	}
+
+	cookies := solveChallenge(t, handler, rec.Body.String(), "python-requests/2.31").Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("Expected clearance cookie")
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "python-requests/2.31")
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected OK after passing the challenge, got %d", rec.Code)
+	}
+}
+
+func TestChallenge_RateLimitAction(t *testing.T) {
+	logger.Init()
+	rl, _ := NewRateLimiter(config.RateLimitConfig{Enabled: true, RequestsPerMinute: 1, Action: "challenge"})
+	c := NewChallenge(config.ChallengeConfig{Difficulty: 8})
+	handler := c.Middleware(rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	makeRequest := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := makeRequest(); rec.Code != http.StatusOK {
+		t.Fatalf("Expected OK, got %d", rec.Code)
+	}
+	rec := makeRequest()
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Checking your browser") {
+		t.Fatalf("Expected challenge over the limit, got %d", rec.Code)
+	}
+
+	cookies := solveChallenge(t, handler, rec.Body.String(), "").Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("Expected clearance cookie")
+	}
+	for i := range clearedRateFactor - 1 {
+		if rec := makeRequest(cookies[0]); rec.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected OK with clearance, got %d", i, rec.Code)
+		}
+	}
+	if rec := makeRequest(cookies[0]); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected cleared client to be limited at the ceiling, got %d", rec.Code)
+	}
+}
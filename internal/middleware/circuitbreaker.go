@@ -1,11 +1,23 @@
 package middleware
 
 import (
+	"expvar"
+	"fmt"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/yxorp/pkg/logger"
+	"github.com/yxorp/internal/config"
+)
+
+// circuitSlots is the resolution of the error rate window: counts age out
+// one slot (Window / circuitSlots) at a time.
+const circuitSlots = 10
+
+var (
+	circuitTransitions = expvar.NewMap("circuit_breaker_transitions")
+	circuitsOpen       = expvar.NewInt("circuit_breakers_open")
 )
 
 type State int
@@ -16,67 +28,275 @@ const (
 	StateHalfOpen              // Testing recovery
 )
 
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+type circuitSlot struct {
+	epoch    int64 // now / slot length
+	requests int
+	failures int
+}
+
+// CircuitBreaker tracks the failures of one upstream and rejects requests
+// to it while its circuit is open. See config.CircuitBreakerConfig.
 type CircuitBreaker struct {
-	mu           sync.Mutex
-	state        State
-	failures     int
-	threshold    int
-	resetTimeout time.Duration
-	lastFailure  time.Time
+	onChange func(from, to State)
+
+	mu          sync.Mutex
+	cfg         config.CircuitBreakerConfig
+	state       State
+	changedAt   time.Time
+	consecutive int
+	slots       [circuitSlots]circuitSlot
+	probes      int // half-open requests in flight
+	successes   int // successful half-open requests
 }
 
-func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
+// NewCircuitBreaker returns a closed circuit breaker. onChange, when not
+// nil, is called after every state change, outside the breaker's lock.
+func NewCircuitBreaker(cfg config.CircuitBreakerConfig, onChange func(from, to State)) (*CircuitBreaker, error) {
+	cfg, err := circuitDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &CircuitBreaker{
-		threshold:    threshold,
-		resetTimeout: timeout,
-		state:        StateClosed,
+		cfg:       cfg,
+		onChange:  onChange,
+		state:     StateClosed,
+		changedAt: time.Now(),
+	}, nil
+}
+
+// Update applies a new configuration and keeps the current state.
+func (cb *CircuitBreaker) Update(cfg config.CircuitBreakerConfig) error {
+	cfg, err := circuitDefaults(cfg)
+	if err != nil {
+		return err
 	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.cfg = cfg
+	return nil
 }
 
-func (cb *CircuitBreaker) AllowRequest() bool {
+// ValidateCircuitBreaker checks cfg without building a breaker.
+func ValidateCircuitBreaker(cfg config.CircuitBreakerConfig) error {
+	_, err := circuitDefaults(cfg)
+	return err
+}
+
+func circuitDefaults(cfg config.CircuitBreakerConfig) (config.CircuitBreakerConfig, error) {
+	if cfg.ErrorPercent < 0 || cfg.ErrorPercent > 100 {
+		return cfg, fmt.Errorf("circuit breaker error_percent %v is not between 0 and 100", cfg.ErrorPercent)
+	}
+	if cfg.ConsecutiveFailures == 0 {
+		cfg.ConsecutiveFailures = 5
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if len(cfg.GRPCFailureCodes) == 0 {
+		cfg.GRPCFailureCodes = []int{grpcUnknown, grpcDeadlineExceeded, grpcInternal, grpcUnavailable, grpcDataLoss}
+	}
+	return cfg, nil
+}
+
+// State returns the current state and when the breaker entered it.
+func (cb *CircuitBreaker) State() (State, time.Time) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	return cb.state, cb.changedAt
+}
 
-	if cb.state == StateOpen {
-		if time.Since(cb.lastFailure) > cb.resetTimeout {
-			cb.state = StateHalfOpen
-			logger.Info("Circuit Breaker entering Half-Open state")
-			return true
-		}
+// IsFailure reports whether a response with the given status counts as a
+// failure.
+func (cb *CircuitBreaker) IsFailure(status int) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if len(cb.cfg.FailureStatuses) > 0 {
+		return slices.Contains(cb.cfg.FailureStatuses, status)
+	}
+	return status >= 500
+}
+
+// IsGRPCFailure reports whether a gRPC call that ended with the given
+// grpc-status counts as a failure.
+func (cb *CircuitBreaker) IsGRPCFailure(code int) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if code == grpcDeadlineExceeded && cb.cfg.IgnoreTimeouts {
 		return false
 	}
-	// Closed or HalfOpen (allow probe)
-	return true
+	return slices.Contains(cb.cfg.GRPCFailureCodes, code)
 }
 
-func (cb *CircuitBreaker) RecordSuccess() {
+// CountsTimeouts reports whether upstream timeouts count as failures.
+func (cb *CircuitBreaker) CountsTimeouts() bool {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	return !cb.cfg.IgnoreTimeouts
+}
+
+// AllowRequest reports whether a request may go to the upstream. Every
+// allowed request must be followed by RecordSuccess, RecordFailure or
+// RecordCanceled so half-open probe slots are given back.
+func (cb *CircuitBreaker) AllowRequest() bool {
+	cb.mu.Lock()
+	from := cb.state
+	now := time.Now()
+	if cb.state == StateOpen && now.Sub(cb.changedAt) >= cb.cfg.OpenTimeout {
+		cb.setState(StateHalfOpen, now)
+	}
+	allowed := true
+	switch cb.state {
+	case StateOpen:
+		allowed = false
+	case StateHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			allowed = false
+		} else {
+			cb.probes++
+		}
+	}
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+	return allowed
+}
 
-	if cb.state == StateHalfOpen {
-		cb.state = StateClosed
-		cb.failures = 0
-		logger.Info("Circuit Breaker recovered. Closed.")
-	} else if cb.state == StateClosed {
-		cb.failures = 0
+// Ready reports whether AllowRequest would let a request through now,
+// without taking a half-open probe slot.
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case StateOpen:
+		return time.Since(cb.changedAt) >= cb.cfg.OpenTimeout
+	case StateHalfOpen:
+		return cb.probes < cb.cfg.HalfOpenRequests
 	}
+	return true
+}
+
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.record(false)
 }
 
 func (cb *CircuitBreaker) RecordFailure() {
+	cb.record(true)
+}
+
+// RecordCanceled ends a request that neither succeeded nor failed, such as
+// one the client gave up on.
+func (cb *CircuitBreaker) RecordCanceled() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	if cb.state == StateHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *CircuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	from := cb.state
+	now := time.Now()
 
-	if cb.state == StateHalfOpen {
-		cb.state = StateOpen
-		cb.lastFailure = time.Now()
-		logger.Warn("Circuit Breaker Half-Open check failed. Re-opening.")
-	} else {
-		cb.failures++
-		if cb.failures >= cb.threshold {
-			cb.state = StateOpen
-			cb.lastFailure = time.Now()
-			logger.Warn("Circuit Breaker tripped to Open state", "failures", cb.failures)
+	switch cb.state {
+	case StateHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
 		}
+		if failed {
+			cb.setState(StateOpen, now)
+		} else if cb.successes++; cb.successes >= cb.cfg.HalfOpenRequests {
+			cb.setState(StateClosed, now)
+		}
+	case StateClosed:
+		epoch := now.UnixNano() / max(int64(cb.cfg.Window)/circuitSlots, 1)
+		slot := &cb.slots[epoch%circuitSlots]
+		if slot.epoch != epoch {
+			*slot = circuitSlot{epoch: epoch}
+		}
+		slot.requests++
+		if !failed {
+			cb.consecutive = 0
+			break
+		}
+		slot.failures++
+		cb.consecutive++
+		if cb.shouldTrip(epoch) {
+			cb.setState(StateOpen, now)
+		}
+	}
+	// Results arriving while open belong to requests sent before it opened
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+}
+
+// shouldTrip reports whether the failures seen so far open the circuit.
+// Callers must hold cb.mu.
+func (cb *CircuitBreaker) shouldTrip(epoch int64) bool {
+	if cb.cfg.ConsecutiveFailures > 0 && cb.consecutive >= cb.cfg.ConsecutiveFailures {
+		return true
+	}
+	if cb.cfg.ErrorPercent == 0 {
+		return false
+	}
+	requests, failures := 0, 0
+	for _, s := range cb.slots {
+		if epoch-s.epoch < circuitSlots {
+			requests += s.requests
+			failures += s.failures
+		}
+	}
+	return requests >= cb.cfg.MinRequests && float64(failures)*100 >= cb.cfg.ErrorPercent*float64(requests)
+}
+
+// setState moves the breaker to state and resets the counters of the state
+// it leaves. Callers must hold cb.mu.
+func (cb *CircuitBreaker) setState(state State, now time.Time) {
+	cb.state = state
+	cb.changedAt = now
+	cb.consecutive = 0
+	cb.slots = [circuitSlots]circuitSlot{}
+	cb.probes = 0
+	cb.successes = 0
+}
+
+func (cb *CircuitBreaker) notify(from, to State) {
+	if from == to {
+		return
+	}
+	circuitTransitions.Add(to.String(), 1)
+	switch {
+	case to == StateOpen:
+		circuitsOpen.Add(1)
+	case from == StateOpen:
+		circuitsOpen.Add(-1)
+	}
+	if cb.onChange != nil {
+		cb.onChange(from, to)
 	}
 }
 
@@ -91,7 +311,7 @@ func (cb *CircuitBreaker) Middleware(next http.Handler) http.Handler {
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(rw, r)
 
-		if rw.statusCode >= 500 {
+		if cb.IsFailure(rw.statusCode) {
 			cb.RecordFailure()
 		} else {
 			cb.RecordSuccess()
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+)
+
+func newTestBreaker(t *testing.T, cfg config.CircuitBreakerConfig) (*CircuitBreaker, *[]State) {
+	t.Helper()
+	var changes []State
+	cb, err := NewCircuitBreaker(cfg, func(from, to State) { changes = append(changes, to) })
+	if err != nil {
+		t.Fatalf("NewCircuitBreaker: %v", err)
+	}
+	return cb, &changes
+}
+
+func TestCircuitBreaker_ConsecutiveFailures(t *testing.T) {
+	cb, changes := newTestBreaker(t, config.CircuitBreakerConfig{ConsecutiveFailures: 3, OpenTimeout: 20 * time.Millisecond})
+
+	cb.RecordFailure()
+	cb.RecordFailure()
+	cb.RecordSuccess() // resets the run
+	cb.RecordFailure()
+	cb.RecordFailure()
+	if !cb.AllowRequest() {
+		t.Fatal("expected circuit to stay closed after a broken run of failures")
+	}
+	cb.RecordFailure()
+	if cb.AllowRequest() {
+		t.Fatal("expected circuit to open after 3 failures in a row")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !cb.AllowRequest() {
+		t.Fatal("expected a probe after the open timeout")
+	}
+	cb.RecordFailure()
+	if state, _ := cb.State(); state != StateOpen {
+		t.Fatalf("expected a failed probe to reopen the circuit, got %v", state)
+	}
+
+	want := []State{StateOpen, StateHalfOpen, StateOpen}
+	if len(*changes) != len(want) {
+		t.Fatalf("got state changes %v, want %v", *changes, want)
+	}
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Fatalf("got state changes %v, want %v", *changes, want)
+		}
+	}
+}
+
+func TestCircuitBreaker_ErrorPercent(t *testing.T) {
+	cb, _ := newTestBreaker(t, config.CircuitBreakerConfig{
+		ConsecutiveFailures: -1,
+		ErrorPercent:        50,
+		MinRequests:         10,
+		Window:              time.Minute,
+	})
+
+	// 5 of 8 failed, but below the minimum volume
+	for i := range 8 {
+		if i%3 == 0 {
+			cb.RecordSuccess()
+		} else {
+			cb.RecordFailure()
+		}
+	}
+	if state, _ := cb.State(); state != StateClosed {
+		t.Fatalf("expected closed below min_requests, got %v", state)
+	}
+	cb.RecordSuccess() // 5 of 9
+	cb.RecordFailure() // 6 of 10
+	if state, _ := cb.State(); state != StateOpen {
+		t.Fatalf("expected open at 60%% errors, got %v", state)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	cb, _ := newTestBreaker(t, config.CircuitBreakerConfig{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         10 * time.Millisecond,
+		HalfOpenRequests:    2,
+	})
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+
+	if !cb.AllowRequest() || !cb.AllowRequest() {
+		t.Fatal("expected two probes in half-open state")
+	}
+	if cb.AllowRequest() {
+		t.Fatal("expected the third concurrent probe to be rejected")
+	}
+	cb.RecordCanceled()
+	if !cb.AllowRequest() {
+		t.Fatal("expected a canceled probe to free its slot")
+	}
+
+	cb.RecordSuccess()
+	if state, _ := cb.State(); state != StateHalfOpen {
+		t.Fatalf("expected half-open after one of two successes, got %v", state)
+	}
+	cb.RecordSuccess()
+	if state, _ := cb.State(); state != StateClosed {
+		t.Fatalf("expected closed after two successes, got %v", state)
+	}
+}
+
+func TestCircuitBreaker_FailureStatuses(t *testing.T) {
+	cb, _ := newTestBreaker(t, config.CircuitBreakerConfig{})
+	if !cb.IsFailure(http.StatusInternalServerError) || cb.IsFailure(http.StatusNotFound) {
+		t.Error("expected every 5xx and nothing else to fail by default")
+	}
+
+	cb, _ = newTestBreaker(t, config.CircuitBreakerConfig{FailureStatuses: []int{502, 503, 429}})
+	if cb.IsFailure(http.StatusInternalServerError) || !cb.IsFailure(http.StatusTooManyRequests) {
+		t.Error("expected only the configured statuses to fail")
+	}
+
+	if _, err := NewCircuitBreaker(config.CircuitBreakerConfig{ErrorPercent: 150}, nil); err == nil {
+		t.Error("expected error for error_percent above 100")
+	}
+}
+
+func TestCircuitBreaker_GRPCFailure(t *testing.T) {
+	cb, _ := newTestBreaker(t, config.CircuitBreakerConfig{})
+	for code, want := range map[int]bool{0: false, 5: false, grpcDeadlineExceeded: true, grpcUnavailable: true, -1: false} {
+		if got := cb.IsGRPCFailure(code); got != want {
+			t.Errorf("IsGRPCFailure(%d) = %v, want %v", code, got, want)
+		}
+	}
+
+	cb, _ = newTestBreaker(t, config.CircuitBreakerConfig{GRPCFailureCodes: []int{grpcResourceExhausted, grpcDeadlineExceeded}, IgnoreTimeouts: true})
+	if !cb.IsGRPCFailure(grpcResourceExhausted) || cb.IsGRPCFailure(grpcUnavailable) || cb.IsGRPCFailure(grpcDeadlineExceeded) {
+		t.Error("configured gRPC failure codes or ignore_timeouts not applied")
+	}
+}
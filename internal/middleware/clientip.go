@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/iptrie"
+)
+
+// TrustedProxies are the networks of the load balancers and proxies in
+// front of the WAF. Only requests they relay have their X-Forwarded-For and
+// X-Real-IP headers believed.
+type TrustedProxies struct {
+	nets *iptrie.Trie[struct{}]
+}
+
+// trustedProxies is consulted by ClientIP; nil trusts no one.
+var trustedProxies atomic.Pointer[TrustedProxies]
+
+// NewTrustedProxies parses a list of addresses and CIDR ranges.
+func NewTrustedProxies(entries []string) (*TrustedProxies, error) {
+	nets := iptrie.New[struct{}]()
+	for _, entry := range entries {
+		p, err := iptrie.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets.Insert(p, struct{}{})
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// SetTrustedProxies switches the proxies ClientIP trusts.
+func SetTrustedProxies(tp *TrustedProxies) {
+	trustedProxies.Store(tp)
+}
+
+func (tp *TrustedProxies) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && tp.nets.Contains(addr.Unmap())
+}
+
+// ClientIP returns the originating client address. That is the connection's
+// remote address unless it belongs to a trusted proxy, in which case
+// X-Forwarded-For is walked back from the nearest hop to the first address
+// no trusted proxy added. X-Real-IP is used when there is no
+// X-Forwarded-For.
+func ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	tp := trustedProxies.Load()
+	if tp == nil || tp.nets.Len() == 0 || !tp.contains(remote) {
+		return remote
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Garbage can only come from the client; the hop after it is
+			// the furthest one vouched for
+			return client
+		}
+		client = addr.Unmap().String()
+		if !tp.nets.Contains(addr.Unmap()) {
+			return client
+		}
+	}
+	if len(hops) > 0 {
+		return client
+	}
+
+	// Spelled in canonical form so Header.Get does not allocate
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return remote
+}
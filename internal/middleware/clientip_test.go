@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tp, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("expected an invalid trusted proxy to be rejected")
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		xff     []string
+		realIP  string
+		trusted *TrustedProxies
+		want    string
+	}{
+		{"no trusted proxies", "203.0.113.5:1234", []string{"198.51.100.1"}, "", nil, "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5:1234", []string{"198.51.100.1"}, "198.51.100.2", tp, "203.0.113.5"},
+		{"trusted peer", "10.1.2.3:1234", []string{"198.51.100.1"}, "", tp, "198.51.100.1"},
+		{"spoofed first hop", "10.1.2.3:1234", []string{"198.51.100.9, 203.0.113.7"}, "", tp, "203.0.113.7"},
+		{"proxy chain", "10.1.2.3:1234", []string{"203.0.113.7, 192.0.2.1", "10.9.9.9"}, "", tp, "203.0.113.7"},
+		{"all trusted", "10.1.2.3:1234", []string{"10.0.0.1, 192.0.2.1"}, "", tp, "10.0.0.1"},
+		{"garbage hop", "10.1.2.3:1234", []string{"evil, 192.0.2.1"}, "", tp, "192.0.2.1"},
+		{"real ip", "[::ffff:10.1.2.3]:1234", nil, "198.51.100.1", tp, "198.51.100.1"},
+		{"invalid real ip", "10.1.2.3:1234", nil, "nope", tp, "10.1.2.3"},
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	for _, tt := range tests {
+		SetTrustedProxies(tt.trusted)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := ClientIP(r); got != tt.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bufio"
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+var (
+	shedRequests     = expvar.NewInt("requests_shed")
+	inFlightRequests = expvar.NewInt("requests_in_flight")
+	concurrencyLimit = expvar.NewFloat("concurrency_limit")
+)
+
+type priorityClass struct {
+	requestMatcher
+	name     string
+	maxShare float64
+}
+
+var defaultClass = &priorityClass{name: "default", maxShare: 1}
+
+// ConcurrencyLimiter caps the number of in-flight requests, globally and per
+// client. With adaptive limiting enabled the global cap follows upstream
+// latency (AIMD): it grows by one while backends keep up and is cut by the
+// backoff ratio whenever a response is slow or fails.
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	enabled      bool
+	inFlight     int
+	perClient    map[string]int
+	limit        float64
+	maxInFlight  int
+	maxPerClient int
+	adaptive     config.AdaptiveConfig
+	classes      []*priorityClass
+}
+
+func NewConcurrencyLimiter(cfg config.ConcurrencyConfig) *ConcurrencyLimiter {
+	adaptive := cfg.Adaptive
+	if adaptive.MinLimit <= 0 {
+		adaptive.MinLimit = 1
+	}
+	if adaptive.MaxLimit <= 0 {
+		adaptive.MaxLimit = 1000
+	}
+	if adaptive.InitialLimit <= 0 {
+		adaptive.InitialLimit = 100
+	}
+	if adaptive.LatencyThreshold <= 0 {
+		adaptive.LatencyThreshold = time.Second
+	}
+	if adaptive.BackoffRatio <= 0 || adaptive.BackoffRatio >= 1 {
+		adaptive.BackoffRatio = 0.9
+	}
+
+	cl := &ConcurrencyLimiter{
+		enabled:      cfg.Enabled,
+		perClient:    make(map[string]int),
+		limit:        float64(adaptive.InitialLimit),
+		maxInFlight:  cfg.MaxInFlight,
+		maxPerClient: cfg.MaxPerClient,
+		adaptive:     adaptive,
+	}
+
+	for _, p := range cfg.Priorities {
+		share := p.MaxShare
+		if share <= 0 || share > 1 {
+			share = 1
+		}
+		cl.classes = append(cl.classes, &priorityClass{
+			requestMatcher: requestMatcher{paths: p.Paths, methods: p.Methods, headers: p.Headers},
+			name:           p.Name,
+			maxShare:       share,
+		})
+	}
+
+	concurrencyLimit.Set(cl.effectiveLimit())
+	return cl
+}
+
+// effectiveLimit returns the current global cap, or 0 when unlimited.
+// Callers must hold cl.mu (or be the constructor).
+func (cl *ConcurrencyLimiter) effectiveLimit() float64 {
+	if !cl.adaptive.Enabled {
+		return float64(cl.maxInFlight)
+	}
+	if cl.maxInFlight > 0 && cl.limit > float64(cl.maxInFlight) {
+		return float64(cl.maxInFlight)
+	}
+	return cl.limit
+}
+
+func (cl *ConcurrencyLimiter) classify(r *http.Request) *priorityClass {
+	for _, c := range cl.classes {
+		if c.matches(r) {
+			return c
+		}
+	}
+	return defaultClass
+}
+
+// acquire reserves a slot for the client and returns 0 on success, or the
+// status code to reject the request with.
+func (cl *ConcurrencyLimiter) acquire(ip string, class *priorityClass) int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.maxPerClient > 0 && cl.perClient[ip] >= cl.maxPerClient {
+		return http.StatusTooManyRequests
+	}
+
+	if limit := cl.effectiveLimit(); limit > 0 {
+		allowed := math.Max(1, math.Floor(limit*class.maxShare))
+		if float64(cl.inFlight) >= allowed {
+			return http.StatusServiceUnavailable
+		}
+	}
+
+	cl.inFlight++
+	cl.perClient[ip]++
+	inFlightRequests.Add(1)
+	return 0
+}
+
+func (cl *ConcurrencyLimiter) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.inFlight--
+	if cl.perClient[ip] <= 1 {
+		delete(cl.perClient, ip)
+	} else {
+		cl.perClient[ip]--
+	}
+	inFlightRequests.Add(-1)
+}
+
+// ObserveLatency feeds an upstream response into the adaptive limit.
+func (cl *ConcurrencyLimiter) ObserveLatency(latency time.Duration, statusCode int) {
+	if !cl.adaptive.Enabled {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if latency > cl.adaptive.LatencyThreshold || statusCode >= 500 {
+		cl.limit = math.Max(float64(cl.adaptive.MinLimit), cl.limit*cl.adaptive.BackoffRatio)
+	} else if float64(cl.inFlight)*2 >= cl.limit {
+		// Only grow while the limit is actually being used
+		cl.limit = math.Min(float64(cl.adaptive.MaxLimit), cl.limit+1)
+	}
+	concurrencyLimit.Set(cl.effectiveLimit())
+}
+
+// Limit returns the current global concurrency limit (0 means unlimited).
+func (cl *ConcurrencyLimiter) Limit() float64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.effectiveLimit()
+}
+
+func (cl *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cl.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r)
+		class := cl.classify(r)
+
+		switch cl.acquire(ip, class) {
+		case http.StatusTooManyRequests:
+			logger.Warn("Client concurrency limit exceeded", "client_ip", ip)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		case http.StatusServiceUnavailable:
+			shedRequests.Add(1)
+			logger.Warn("Request shed", "client_ip", ip, "class", class.name, "limit", cl.Limit())
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !IsUpgrade(r) {
+			defer cl.release(ip)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// An upgraded connection can stay open for hours; it stops counting
+		// as in flight once the upgrade is done
+		var once sync.Once
+		release := func() { once.Do(func() { cl.release(ip) }) }
+		defer release()
+		next.ServeHTTP(&hijackWriter{ResponseWriter: w, onHijack: func(conn net.Conn, brw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+			release()
+			return conn, brw
+		}}, r)
+	})
+}
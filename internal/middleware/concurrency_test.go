@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestConcurrencyLimiter_PerClient(t *testing.T) {
+	logger.Init()
+
+	cl := NewConcurrencyLimiter(config.ConcurrencyConfig{
+		Enabled:      true,
+		MaxPerClient: 1,
+	})
+
+	// Hold one request from the client in flight
+	if code := cl.acquire("192.0.2.1", defaultClass); code != 0 {
+		t.Fatalf("expected first request to be admitted, got %d", code)
+	}
+
+	handler := cl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	makeRequest := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := makeRequest("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected %d for busy client, got %d", http.StatusTooManyRequests, code)
+	}
+	if code := makeRequest("192.0.2.2"); code != http.StatusOK {
+		t.Errorf("expected OK for other client, got %d", code)
+	}
+
+	cl.release("192.0.2.1")
+	if code := makeRequest("192.0.2.1"); code != http.StatusOK {
+		t.Errorf("expected OK after release, got %d", code)
+	}
+}
+
+func TestConcurrencyLimiter_ShedsLowPriorityFirst(t *testing.T) {
+	logger.Init()
+
+	cl := NewConcurrencyLimiter(config.ConcurrencyConfig{
+		Enabled:     true,
+		MaxInFlight: 4,
+		Priorities: []config.PriorityClass{
+			{Name: "bulk", Paths: []string{"/export"}, MaxShare: 0.5},
+		},
+	})
+
+	bulk := cl.classify(httptest.NewRequest("GET", "/export/all", nil))
+	if bulk.name != "bulk" {
+		t.Fatalf("expected bulk class, got %s", bulk.name)
+	}
+	critical := cl.classify(httptest.NewRequest("GET", "/login", nil))
+
+	for i := 0; i < 2; i++ {
+		if code := cl.acquire("192.0.2.1", critical); code != 0 {
+			t.Fatalf("expected admission, got %d", code)
+		}
+	}
+
+	// Half of the limit is in use, so bulk traffic is shed...
+	if code := cl.acquire("192.0.2.2", bulk); code != http.StatusServiceUnavailable {
+		t.Errorf("expected bulk request to be shed, got %d", code)
+	}
+	// ...while the default class may still use the rest
+	if code := cl.acquire("192.0.2.2", critical); code != 0 {
+		t.Errorf("expected critical request to be admitted, got %d", code)
+	}
+}
+
+func TestConcurrencyLimiter_AdaptiveLimit(t *testing.T) {
+	cl := NewConcurrencyLimiter(config.ConcurrencyConfig{
+		Enabled: true,
+		Adaptive: config.AdaptiveConfig{
+			Enabled:          true,
+			InitialLimit:     10,
+			MinLimit:         2,
+			LatencyThreshold: 100 * time.Millisecond,
+			BackoffRatio:     0.5,
+		},
+	})
+
+	cl.ObserveLatency(time.Second, http.StatusOK)
+	if got := cl.Limit(); got != 5 {
+		t.Errorf("expected limit to back off to 5, got %v", got)
+	}
+
+	cl.ObserveLatency(10*time.Millisecond, http.StatusServiceUnavailable)
+	cl.ObserveLatency(10*time.Millisecond, http.StatusServiceUnavailable)
+	if got := cl.Limit(); got != 2 {
+		t.Errorf("expected limit to stop at minimum 2, got %v", got)
+	}
+
+	// Fast responses grow the limit only while it is being used
+	cl.ObserveLatency(10*time.Millisecond, http.StatusOK)
+	if got := cl.Limit(); got != 2 {
+		t.Errorf("expected idle limit to stay at 2, got %v", got)
+	}
+	cl.acquire("192.0.2.1", defaultClass)
+	cl.ObserveLatency(10*time.Millisecond, http.StatusOK)
+	if got := cl.Limit(); got != 3 {
+		t.Errorf("expected limit to grow to 3, got %v", got)
+	}
+}
@@ -47,11 +47,17 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // GzipMiddleware compresses responses
 func GzipMiddleware() Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			// Upgraded connections are not HTTP responses to compress
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || IsUpgrade(r) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/geoip"
+	"github.com/yxorp/pkg/logger"
+)
+
+var geoBlockedRequests = expvar.NewInt("requests_geo_blocked")
+
+type geoKey struct{}
+
+// geoInfo returns the GeoIP data the GeoIP middleware attached to r.
+func geoInfo(r *http.Request) geoip.Info {
+	info, _ := r.Context().Value(geoKey{}).(geoip.Info)
+	return info
+}
+
+type geoPolicy struct {
+	requestMatcher
+	name  string
+	block bool
+}
+
+type geoFile struct {
+	path    string
+	modTime time.Time
+}
+
+type geoState struct {
+	db       *geoip.DB
+	files    [2]geoFile // country, asn
+	policies []*geoPolicy
+}
+
+// GeoIP looks up the client's country and ASN in local MaxMind databases,
+// attaches them to the request for logging and policy matching, and enforces
+// geo policies.
+type GeoIP struct {
+	mu    sync.Mutex // serializes Update
+	state atomic.Pointer[geoState]
+}
+
+func NewGeoIP(cfg config.GeoIPConfig) (*GeoIP, error) {
+	g := &GeoIP{}
+	if err := g.Update(cfg); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Update applies a new configuration. Databases are only re-read when their
+// path or modification time changed, so an updated file can be dropped in
+// place without a restart.
+func (g *GeoIP) Update(cfg config.GeoIPConfig) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next, err := g.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	g.install(cfg, next)
+	return nil
+}
+
+// Prepare does the work of Update that can fail, including opening changed
+// databases, without changing the state in use. The returned function
+// installs the result and cannot fail. Nothing may update g in between.
+func (g *GeoIP) Prepare(cfg config.GeoIPConfig) (apply func(), err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next, err := g.prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.install(cfg, next)
+	}, nil
+}
+
+// install swaps next in. Callers must hold g.mu.
+func (g *GeoIP) install(cfg config.GeoIPConfig, next *geoState) {
+	if prev := g.state.Load(); (prev == nil || prev.db != next.db) && !next.db.Empty() {
+		logger.Info("GeoIP databases loaded", "country_db", cfg.CountryDB, "asn_db", cfg.ASNDB)
+	}
+	g.state.Store(next)
+}
+
+// prepare builds the state for cfg, reusing the open databases when their
+// files are unchanged.
+func (g *GeoIP) prepare(cfg config.GeoIPConfig) (*geoState, error) {
+	next := &geoState{}
+	for _, p := range cfg.Policies {
+		if len(p.Countries) == 0 && len(p.ASNs) == 0 {
+			return nil, fmt.Errorf("geo policy %s needs countries or asns", p.Name)
+		}
+		if p.Action != "" && p.Action != "block" && p.Action != "log" {
+			return nil, fmt.Errorf("invalid action %q for geo policy %s", p.Action, p.Name)
+		}
+		next.policies = append(next.policies, &geoPolicy{
+			requestMatcher: requestMatcher{paths: p.Paths, methods: p.Methods, countries: p.Countries, asns: p.ASNs},
+			name:           p.Name,
+			block:          p.Action != "log",
+		})
+	}
+
+	for i, path := range []string{cfg.CountryDB, cfg.ASNDB} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		next.files[i] = geoFile{path: path, modTime: info.ModTime()}
+	}
+
+	prev := g.state.Load()
+	if prev != nil && prev.files == next.files {
+		next.db = prev.db
+	} else {
+		db, err := geoip.OpenDB(next.files[0].path, next.files[1].path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+		}
+		next.db = db
+	}
+	return next, nil
+}
+
+func (g *GeoIP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := g.state.Load()
+		if state.db.Empty() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr, err := netip.ParseAddr(ClientIP(r))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := state.db.Lookup(addr)
+		r = r.WithContext(context.WithValue(r.Context(), geoKey{}, info))
+
+		for _, p := range state.policies {
+			if !p.matches(r) {
+				continue
+			}
+			if !p.block {
+				logger.Info("Geo policy matched", "client_ip", addr.String(), "policy", p.name, "country", info.Country, "asn", info.ASN)
+				continue
+			}
+			geoBlockedRequests.Add(1)
+			logger.Warn("Request blocked by geo policy", "client_ip", addr.String(), "policy", p.name, "country", info.Country, "asn", info.ASN)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/botverify"
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+var (
+	goodBotsVerified = expvar.NewMap("good_bots_verified")
+	botsImpersonated = expvar.NewMap("bots_impersonated")
+)
+
+type goodBotState struct {
+	enabled     bool
+	block       bool
+	verifierKey string // resolver and cache settings the verifier was built with
+	bots        []config.GoodBot
+	verifier    *botverify.Verifier
+}
+
+type verifiedBotKey struct{}
+
+// isVerifiedBot reports whether GoodBots confirmed the client is the crawler
+// its User-Agent claims to be.
+func isVerifiedBot(r *http.Request) bool {
+	verified, _ := r.Context().Value(verifiedBotKey{}).(bool)
+	return verified
+}
+
+// GoodBots verifies clients claiming to be search engine crawlers. Verified
+// crawlers are exempt from User-Agent blocking only; their requests are still
+// inspected like any other.
+type GoodBots struct {
+	mu    sync.Mutex // serializes Update
+	state atomic.Pointer[goodBotState]
+}
+
+func NewGoodBots(cfg config.GoodBotConfig) (*GoodBots, error) {
+	g := &GoodBots{}
+	if err := g.Update(cfg); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// validate reports the error Update would return for cfg.
+func (g *GoodBots) validate(cfg config.GoodBotConfig) error {
+	if cfg.Action != "" && cfg.Action != "block" && cfg.Action != "log" {
+		return fmt.Errorf("invalid good bot action %q", cfg.Action)
+	}
+	for _, bot := range cfg.Bots {
+		if len(bot.UserAgents) == 0 || len(bot.Domains) == 0 {
+			return fmt.Errorf("good bot %s needs user_agents and domains", bot.Name)
+		}
+	}
+	return nil
+}
+
+// Update applies a new configuration. Cached verdicts are kept unless the
+// resolver or the cache settings change.
+func (g *GoodBots) Update(cfg config.GoodBotConfig) error {
+	if err := g.validate(cfg); err != nil {
+		return err
+	}
+	g.apply(cfg)
+	return nil
+}
+
+// Prepare checks cfg. The returned function applies it and cannot fail.
+func (g *GoodBots) Prepare(cfg config.GoodBotConfig) (apply func(), err error) {
+	if err := g.validate(cfg); err != nil {
+		return nil, err
+	}
+	return func() { g.apply(cfg) }, nil
+}
+
+func (g *GoodBots) apply(cfg config.GoodBotConfig) {
+	bots := cfg.Bots
+	if len(bots) == 0 {
+		bots = botverify.DefaultBots
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next := &goodBotState{
+		enabled:     cfg.Enabled,
+		block:       cfg.Action != "log",
+		verifierKey: fmt.Sprintf("%s|%s|%s", cfg.Resolver, cfg.CacheTTL, cfg.Timeout),
+		bots:        bots,
+	}
+	if prev := g.state.Load(); prev != nil && prev.verifierKey == next.verifierKey {
+		next.verifier = prev.verifier
+	} else {
+		next.verifier = botverify.New(botverify.NewResolver(cfg.Resolver), cfg.CacheTTL, cfg.Timeout)
+	}
+	g.state.Store(next)
+}
+
+func (g *GoodBots) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := g.state.Load()
+		if !state.enabled || isAllowlisted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bot, ok := botverify.Match(state.bots, r.UserAgent())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r)
+		verified, err := state.verifier.Verify(r.Context(), ip, bot.Domains)
+		if err != nil {
+			// Unverified but not proven fake: inspect it like any other client
+			logger.Warn("Bot verification failed", "client_ip", ip, "bot", bot.Name, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if verified {
+			goodBotsVerified.Add(bot.Name, 1)
+			r = r.WithContext(context.WithValue(r.Context(), verifiedBotKey{}, true))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		botsImpersonated.Add(bot.Name, 1)
+		if !state.block {
+			logger.Info("Unverified crawler", "client_ip", ip, "bot", bot.Name)
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Warn("Request blocked: crawler impersonation", "client_ip", ip, "bot", bot.Name)
+		reportViolation(r, ViolationRule)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
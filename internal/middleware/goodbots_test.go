@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yxorp/internal/botverify"
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+// stubResolver answers reverse and forward lookups from maps.
+type stubResolver struct {
+	ptr   map[string][]string
+	hosts map[string][]string
+}
+
+func (s stubResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := s.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (s stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := s.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestGoodBots(t *testing.T) {
+	logger.Init()
+	g, err := NewGoodBots(config.GoodBotConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("NewGoodBots: %v", err)
+	}
+	g.state.Load().verifier = botverify.New(stubResolver{
+		ptr:   map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+		hosts: map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+	}, 0, 0)
+
+	engine, _ := rules.NewEngine([]config.SecurityRule{
+		{Name: "Traversal", Pattern: `\.\./`, Location: "uri"},
+	})
+	security := SecurityMiddleware(func() config.SecurityConfig {
+		return config.SecurityConfig{BlockUserAgents: []string{"bot"}}
+	}, func() *rules.Engine { return engine })
+	handler := g.Middleware(security(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	tests := []struct {
+		name string
+		ip   string
+		xff  string
+		path string
+		ua   string
+		want int
+	}{
+		{"verified crawler skips UA blocking", "66.249.66.1", "", "/", googlebot, http.StatusOK},
+		{"verified crawler is still inspected", "66.249.66.1", "", "/a/../etc/passwd", googlebot, http.StatusForbidden},
+		{"imposter", "192.0.2.1", "", "/", googlebot, http.StatusForbidden},
+		{"imposter with forged address", "192.0.2.1", "66.249.66.1", "/", googlebot, http.StatusForbidden},
+		{"browser", "192.0.2.1", "", "/", "Mozilla/5.0 Firefox/130.0", http.StatusOK},
+		{"other bot", "192.0.2.1", "", "/", "scrapybot/2.0", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = tt.path
+		req.RemoteAddr = tt.ip + ":1234"
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		req.Header.Set("User-Agent", tt.ua)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	if v := botsImpersonated.Get("googlebot"); v == nil || v.String() == "0" {
+		t.Errorf("expected the imposter to be counted, got %v", v)
+	}
+}
+
+func TestGoodBots_Update(t *testing.T) {
+	g, err := NewGoodBots(config.GoodBotConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("NewGoodBots: %v", err)
+	}
+	verifier := g.state.Load().verifier
+
+	if err := g.Update(config.GoodBotConfig{Enabled: true, Action: "log"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if g.state.Load().verifier != verifier {
+		t.Error("expected cached verdicts to survive a reload")
+	}
+	if err := g.Update(config.GoodBotConfig{Action: "drop"}); err == nil {
+		t.Error("expected error for an invalid action")
+	}
+	if err := g.Update(config.GoodBotConfig{Bots: []config.GoodBot{{Name: "nodomains", UserAgents: []string{"x"}}}}); err == nil {
+		t.Error("expected error for a bot without domains")
+	}
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes (see google.golang.org/grpc/codes)
+const (
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcDataLoss          = 15
+	grpcUnauthenticated   = 16
+)
+
+// IsGRPC reports whether r is a gRPC call. gRPC-Web, which carries its
+// status in the body, is not.
+func IsGRPC(r *http.Request) bool {
+	ct, ok := strings.CutPrefix(r.Header.Get("Content-Type"), "application/grpc")
+	return ok && (ct == "" || ct[0] == '+' || ct[0] == ';')
+}
+
+// GRPCStatus returns the gRPC status for an HTTP error status, following
+// gRPC's HTTP to gRPC status mapping except that rate limits and oversized
+// requests get RESOURCE_EXHAUSTED, so clients do not retry them right away.
+func GRPCStatus(httpStatus int) int {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	}
+	return grpcUnknown
+}
+
+// GRPCMiddleware turns the HTTP errors that gRPC calls get from the WAF or
+// the proxy into trailers-only gRPC responses, which gRPC clients can read.
+// Upstream gRPC responses, always HTTP 200, pass through untouched.
+func GRPCMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&grpcWriter{ResponseWriter: w}, r)
+	})
+}
+
+type grpcWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	rejected    bool // the body is an HTTP error page and is dropped
+}
+
+func (w *grpcWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.rejected = true
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(GRPCStatus(code)))
+	h.Set("Grpc-Message", http.StatusText(code))
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (w *grpcWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *grpcWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
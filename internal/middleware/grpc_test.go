@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestIsGRPC(t *testing.T) {
+	tests := map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/grpc-web+proto":     false,
+		"application/json":               false,
+		"":                               false,
+	}
+	for ct, want := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+		r.Header.Set("Content-Type", ct)
+		if got := IsGRPC(r); got != want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
+
+func TestGRPCMiddleware(t *testing.T) {
+	status := http.StatusForbidden
+	handler := GRPCMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			http.Error(w, "Forbidden", status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("message"))
+	}))
+
+	serve := func(contentType string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("application/grpc")
+	if w.Code != http.StatusOK || w.Header().Get("Grpc-Status") != "7" || w.Body.Len() != 0 {
+		t.Errorf("blocked call: status %d, grpc-status %q, body %q", w.Code, w.Header().Get("Grpc-Status"), w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/grpc" {
+		t.Errorf("blocked call content type = %q", ct)
+	}
+
+	if w := serve("text/html"); w.Code != http.StatusForbidden {
+		t.Errorf("plain HTTP request: status %d, want 403", w.Code)
+	}
+
+	status = http.StatusOK
+	if w := serve("application/grpc"); w.Body.String() != "message" || w.Header().Get("Grpc-Status") != "" {
+		t.Errorf("allowed call changed: body %q, grpc-status %q", w.Body.String(), w.Header().Get("Grpc-Status"))
+	}
+
+	for code, want := range map[int]int{429: grpcResourceExhausted, 503: grpcUnavailable, 504: grpcDeadlineExceeded, 500: grpcUnknown} {
+		if got := GRPCStatus(code); got != want {
+			t.Errorf("GRPCStatus(%d) = %d, want %d", code, got, want)
+		}
+	}
+}
+
+type failingBody struct{}
+
+func (failingBody) Read([]byte) (int, error) { return 0, errors.New("body read") }
+
+func TestSecurityMiddleware_GRPC(t *testing.T) {
+	logger.Init()
+	engine, _ := rules.NewEngine([]config.SecurityRule{
+		{Name: "admin", Pattern: `^admin\.v1\.AdminService/`, Location: "grpc"},
+	})
+	handler := SecurityMiddleware(func() config.SecurityConfig { return config.SecurityConfig{} }, func() *rules.Engine { return engine })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path        string
+		contentType string
+		want        int
+	}{
+		{"/admin.v1.AdminService/DeleteUser", "application/grpc", http.StatusForbidden},
+		{"/shop.v1.Catalog/List", "application/grpc+proto", http.StatusOK},
+		// Not a gRPC call, so the grpc location does not apply
+		{"/admin.v1.AdminService/DeleteUser", "application/json", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		// The body fails when read: gRPC streams must be left alone
+		r := httptest.NewRequest(http.MethodPost, tt.path, failingBody{})
+		r.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s (%s): status %d, want %d", tt.path, tt.contentType, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"encoding/json"
+	"expvar"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/stats"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	honeypotReason = "honeypot"
+
+	// maxHoneypotBody bounds how much of a request body is searched for
+	// hidden form fields. Larger bodies are passed on unchecked.
+	maxHoneypotBody = 64 * 1024
+)
+
+var honeypotHits = expvar.NewMap("honeypot_hits")
+
+type honeypotState struct {
+	cfg    config.HoneypotConfig
+	fields map[string]struct{}
+}
+
+// Honeypot bans clients that touch decoy paths or fill in hidden form fields.
+// Only scanners and form-filling bots do either, so a single hit is enough.
+type Honeypot struct {
+	jail    *Jail
+	state   atomic.Pointer[honeypotState]
+	tarpits atomic.Int64
+}
+
+func NewHoneypot(cfg config.HoneypotConfig, jail *Jail) *Honeypot {
+	h := &Honeypot{jail: jail}
+	h.Update(cfg)
+	return h
+}
+
+func (h *Honeypot) Update(cfg config.HoneypotConfig) {
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = time.Hour
+	}
+	if cfg.TarpitInterval <= 0 {
+		cfg.TarpitInterval = time.Second
+	}
+	if cfg.TarpitDuration <= 0 {
+		cfg.TarpitDuration = time.Minute
+	}
+	if cfg.MaxTarpits <= 0 {
+		cfg.MaxTarpits = 100
+	}
+
+	next := &honeypotState{cfg: cfg, fields: make(map[string]struct{}, len(cfg.FormFields))}
+	for _, f := range cfg.FormFields {
+		next.fields[f] = struct{}{}
+	}
+	h.state.Store(next)
+}
+
+// Flagged returns the clients currently banned by the honeypot.
+func (h *Honeypot) Flagged() []Ban {
+	flagged := []Ban{}
+	for _, ban := range h.jail.Bans() {
+		if strings.HasPrefix(ban.Reason, honeypotReason) {
+			flagged = append(flagged, ban)
+		}
+	}
+	return flagged
+}
+
+// decoyPath returns the decoy that path falls under, if any.
+func (s *honeypotState) decoyPath(path string) (string, bool) {
+	for _, p := range s.cfg.Paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// filledField returns the first hidden field that has a value in the query
+// string or a form or JSON body. The body is restored for the next handler.
+func (s *honeypotState) filledField(r *http.Request) (string, bool) {
+	if len(s.fields) == 0 {
+		return "", false
+	}
+
+	for name, values := range r.URL.Query() {
+		if _, ok := s.fields[name]; ok && strings.Join(values, "") != "" {
+			return name, true
+		}
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return "", false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" {
+		return "", false
+	}
+
+	body, ok := peekBody(r, maxHoneypotBody)
+	if !ok {
+		return "", false
+	}
+
+	if mediaType == "application/json" {
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) != nil {
+			return "", false
+		}
+		for name, v := range fields {
+			if _, ok := s.fields[name]; ok && v != nil && v != "" {
+				return name, true
+			}
+		}
+		return "", false
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", false
+	}
+	for name, values := range form {
+		if _, ok := s.fields[name]; ok && strings.Join(values, "") != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (h *Honeypot) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := h.state.Load()
+		if !state.cfg.Enabled || isAllowlisted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		trap, decoy := state.decoyPath(r.URL.Path)
+		if !decoy {
+			field, filled := state.filledField(r)
+			if !filled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			trap = "field:" + field
+		}
+
+		ip := ClientIP(r)
+		honeypotHits.Add(trap, 1)
+		h.jail.Ban(ip, honeypotReason+" "+trap, state.cfg.BanTime)
+		logger.Warn("Honeypot triggered", "client_ip", ip, "trap", trap, "path", r.URL.Path)
+		stats.AddLog(stats.LogEntry{
+			Timestamp:  time.Now().Format(time.RFC3339),
+			ClientIP:   ip,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			StatusCode: http.StatusNotFound,
+			Latency:    "0s",
+			Action:     "TRAPPED",
+		})
+
+		if decoy && state.cfg.Tarpit {
+			h.tarpit(w, r, state.cfg)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// tarpit keeps the scanner waiting by writing the response one byte at a
+// time. Once MaxTarpits connections are held, further clients get a plain 404.
+func (h *Honeypot) tarpit(w http.ResponseWriter, r *http.Request, cfg config.HoneypotConfig) {
+	if h.tarpits.Add(1) > int64(cfg.MaxTarpits) {
+		h.tarpits.Add(-1)
+		http.NotFound(w, r)
+		return
+	}
+	defer h.tarpits.Add(-1)
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(cfg.TarpitDuration + 10*time.Second))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(cfg.TarpitInterval)
+	defer ticker.Stop()
+	deadline := time.After(cfg.TarpitDuration)
+	for {
+		if _, err := w.Write([]byte{' '}); err != nil {
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
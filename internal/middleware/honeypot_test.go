@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestHoneypot_Traps(t *testing.T) {
+	logger.Init()
+	jail, _ := NewJail(config.JailConfig{})
+	h := NewHoneypot(config.HoneypotConfig{
+		Enabled:    true,
+		Paths:      []string{"/wp-admin", "/.env"},
+		FormFields: []string{"website"},
+	}, jail)
+
+	var body string
+	handler := jail.Middleware(h.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	makeRequest := func(ip, method, path, contentType, payload string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(payload))
+		req.RemoteAddr = ip + ":1234"
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		payload     string
+		trapped     bool
+	}{
+		{"normal page", "GET", "/wp-administrator", "", "", false},
+		{"decoy path", "GET", "/wp-admin/install.php", "", "", true},
+		{"exact decoy", "GET", "/.env", "", "", true},
+		{"empty hidden field", "POST", "/signup", "application/x-www-form-urlencoded", "user=alice&website=", false},
+		{"filled hidden field", "POST", "/signup", "application/x-www-form-urlencoded", "user=bot&website=http://spam", true},
+		{"filled JSON field", "POST", "/api/signup", "application/json", `{"user":"bot","website":"x"}`, true},
+		{"query field", "GET", "/contact?website=x", "", "", true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := "192.0.2." + string(rune('1'+i))
+			code := makeRequest(ip, tt.method, tt.path, tt.contentType, tt.payload)
+			if tt.trapped {
+				if code != http.StatusNotFound {
+					t.Errorf("Expected decoy 404, got %d", code)
+				}
+				if code := makeRequest(ip, "GET", "/", "", ""); code != http.StatusForbidden {
+					t.Errorf("Expected trapped client to be banned, got %d", code)
+				}
+				return
+			}
+			if code != http.StatusOK {
+				t.Errorf("Expected OK, got %d", code)
+			}
+			if body != tt.payload {
+				t.Errorf("Expected body %q to reach the handler, got %q", tt.payload, body)
+			}
+		})
+	}
+
+	if flagged := h.Flagged(); len(flagged) != 5 {
+		t.Errorf("Expected 5 flagged clients, got %d", len(flagged))
+	}
+
+	// A client cannot frame someone else through X-Forwarded-For
+	req := httptest.NewRequest("GET", "/.env", nil)
+	req.RemoteAddr = "192.0.2.100:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.50")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if jail.IsBanned("203.0.113.50") || !jail.IsBanned("192.0.2.100") {
+		t.Error("Expected the ban to land on the connecting client")
+	}
+}
+
+func TestHoneypot_Tarpit(t *testing.T) {
+	logger.Init()
+	jail, _ := NewJail(config.JailConfig{})
+	h := NewHoneypot(config.HoneypotConfig{
+		Enabled:        true,
+		Paths:          []string{"/phpmyadmin"},
+		Tarpit:         true,
+		TarpitInterval: 5 * time.Millisecond,
+		TarpitDuration: 50 * time.Millisecond,
+	}, jail)
+	handler := h.Middleware(http.NotFoundHandler())
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/phpmyadmin/", nil))
+
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Expected the tarpit to hold the request")
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() < 2 || !rec.Flushed {
+		t.Errorf("Expected a trickled response, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/iptrie"
+	"github.com/yxorp/pkg/logger"
+)
+
+var deniedRequests = expvar.NewInt("requests_ip_denied")
+
+type allowlistedKey struct{}
+
+// isAllowlisted reports whether the IP filter let the request through on an
+// allow list, in which case content inspection is skipped.
+func isAllowlisted(r *http.Request) bool {
+	allowed, _ := r.Context().Value(allowlistedKey{}).(bool)
+	return allowed
+}
+
+type ipLists struct {
+	allow *iptrie.Trie[struct{}]
+	deny  *iptrie.Trie[struct{}]
+}
+
+// IPFilter allows or denies clients by network. Lists are swapped atomically
+// on Update, so a reload never blocks requests.
+type IPFilter struct {
+	lists atomic.Pointer[ipLists]
+}
+
+func NewIPFilter(cfg config.IPFilterConfig) (*IPFilter, error) {
+	f := &IPFilter{}
+	if err := f.Update(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func buildList(inline, files []string) (*iptrie.Trie[struct{}], error) {
+	trie := iptrie.New[struct{}]()
+	for _, entry := range inline {
+		p, err := iptrie.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP filter entry %q: %w", entry, err)
+		}
+		trie.Insert(p, struct{}{})
+	}
+	for _, path := range files {
+		prefixes, err := iptrie.ReadListFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range prefixes {
+			trie.Insert(p, struct{}{})
+		}
+	}
+	return trie, nil
+}
+
+func buildLists(cfg config.IPFilterConfig) (*ipLists, error) {
+	allow, err := buildList(cfg.Allow, cfg.AllowFiles)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := buildList(cfg.Deny, cfg.DenyFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &ipLists{allow: allow, deny: deny}, nil
+}
+
+// Update rebuilds the allow and deny lists, re-reading any list files. On
+// error the previous lists stay in place.
+func (f *IPFilter) Update(cfg config.IPFilterConfig) error {
+	apply, err := f.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare builds the lists for cfg without installing them. The returned
+// function installs them and cannot fail.
+func (f *IPFilter) Prepare(cfg config.IPFilterConfig) (apply func(), err error) {
+	lists, err := buildLists(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		f.lists.Store(lists)
+		logger.Info("IP filter loaded", "allow", lists.allow.Len(), "deny", lists.deny.Len())
+	}, nil
+}
+
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists := f.lists.Load()
+		if lists.allow.Len() == 0 && lists.deny.Len() == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r)
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if lists.allow.Contains(addr) {
+			r = r.WithContext(context.WithValue(r.Context(), allowlistedKey{}, true))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if lists.deny.Contains(addr) {
+			deniedRequests.Add(1)
+			logger.Warn("Request denied by IP filter", "client_ip", ip)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
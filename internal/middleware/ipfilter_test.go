@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestIPFilter(t *testing.T) {
+	logger.Init()
+
+	denyFile := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(denyFile, []byte("# scanners\n198.51.100.0/24\n2001:db8:bad::/48\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := NewIPFilter(config.IPFilterConfig{
+		Allow:     []string{"198.51.100.10", "10.0.0.0/8"},
+		Deny:      []string{"203.0.113.0/24"},
+		DenyFiles: []string{denyFile},
+	})
+	if err != nil {
+		t.Fatalf("NewIPFilter: %v", err)
+	}
+
+	engine, _ := rules.NewEngine([]config.SecurityRule{
+		{Name: "SQLi", Pattern: "UNION SELECT", Location: "query_params"},
+	})
+	handler := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		filter.Middleware,
+		SecurityMiddleware(func() config.SecurityConfig { return config.SecurityConfig{} }, func() *rules.Engine { return engine }),
+	)
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		url            string
+		expectedStatus int
+	}{
+		{"Unlisted client", "192.0.2.1:1234", "/", http.StatusOK},
+		{"Inline deny", "203.0.113.5:1234", "/", http.StatusForbidden},
+		{"File deny", "198.51.100.20:1234", "/", http.StatusForbidden},
+		{"File deny IPv6", "[2001:db8:bad::1]:1234", "/", http.StatusForbidden},
+		{"Allow overrides deny", "198.51.100.10:1234", "/", http.StatusOK},
+		{"Allowlisted skips rules", "10.1.2.3:1234", "/?q=UNION%20SELECT", http.StatusOK},
+		{"Unlisted client hits rules", "192.0.2.1:1234", "/?q=UNION%20SELECT", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+		})
+	}
+
+	// A broken list keeps the previous lists in place
+	if err := filter.Update(config.IPFilterConfig{Deny: []string{"bogus"}}); err == nil {
+		t.Fatal("expected an error for an invalid entry")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected previous deny list to stay active, got %d", rec.Code)
+	}
+}
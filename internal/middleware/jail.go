@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/lru"
+	"github.com/yxorp/pkg/logger"
+)
+
+var bannedRequests = expvar.NewInt("requests_banned")
+
+// Violation is a kind of client misbehaviour counted by the Jail.
+type Violation int
+
+const (
+	ViolationRule      Violation = iota // Request blocked by a security rule
+	ViolationRateLimit                  // Request rejected by the rate limiter
+	ViolationNotFound                   // Request answered with 404
+	numViolations
+)
+
+func (v Violation) String() string {
+	switch v {
+	case ViolationRule:
+		return "security rule hits"
+	case ViolationRateLimit:
+		return "rate limit rejections"
+	case ViolationNotFound:
+		return "not found burst"
+	}
+	return "unknown"
+}
+
+type violationKey struct{}
+
+type violationRecorder struct {
+	violation Violation
+	reported  bool
+}
+
+// reportViolation lets downstream middleware tell the Jail why a request was
+// rejected. It is a no-op when the Jail is not in the chain.
+func reportViolation(r *http.Request, v Violation) {
+	if rec, ok := r.Context().Value(violationKey{}).(*violationRecorder); ok {
+		rec.violation = v
+		rec.reported = true
+	}
+}
+
+// Ban describes a client that is currently rejected by the Jail.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Count     int       `json:"count"`
+}
+
+type offender struct {
+	windowStart time.Time
+	counts      [numViolations]int
+	banCount    int
+	lastSeen    time.Time
+	ban         *Ban // the current ban, if any
+}
+
+// banned reports whether the offender is banned at now.
+func (o *offender) banned(now time.Time) bool {
+	return o.ban != nil && now.Before(o.ban.ExpiresAt)
+}
+
+// Jail bans clients that keep hitting security rules, rate limits or missing
+// pages, in the spirit of fail2ban. Bans grow longer for repeat offenders.
+// At most MaxClients offenders are tracked; when full, the least recently
+// seen ones that are not banned are forgotten first.
+type Jail struct {
+	mu        sync.Mutex // serializes Update
+	cfg       atomic.Pointer[config.JailConfig]
+	offenders *lru.Cache[offender]
+}
+
+func NewJail(cfg config.JailConfig) (*Jail, error) {
+	j := &Jail{}
+	if err := j.Update(cfg); err != nil {
+		return nil, err
+	}
+	go j.cleanup()
+	return j, nil
+}
+
+// Update applies a new configuration. Offenders and their bans are kept.
+func (j *Jail) Update(cfg config.JailConfig) error {
+	apply, err := j.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare checks cfg and fills in its defaults. The returned function applies
+// it and cannot fail.
+func (j *Jail) Prepare(cfg config.JailConfig) (apply func(), err error) {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.MaxRuleHits <= 0 {
+		cfg.MaxRuleHits = 5
+	}
+	if cfg.MaxRateLimitHits <= 0 {
+		cfg.MaxRateLimitHits = 20
+	}
+	if cfg.MaxNotFound <= 0 {
+		cfg.MaxNotFound = 30
+	}
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = 10 * time.Minute
+	}
+	if cfg.MaxBanTime <= 0 {
+		cfg.MaxBanTime = 24 * time.Hour
+	}
+	if cfg.BanMultiplier < 1 {
+		cfg.BanMultiplier = 2
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = defaultMaxClients
+	}
+	if cfg.MaxBanTime < cfg.BanTime {
+		return nil, fmt.Errorf("jail max_ban_time %s is shorter than ban_time %s", cfg.MaxBanTime, cfg.BanTime)
+	}
+
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.offenders == nil {
+			j.offenders = lru.New(cfg.MaxClients, func(o *offender) bool { return o.banned(time.Now()) })
+		} else {
+			j.offenders.SetCapacity(cfg.MaxClients)
+		}
+		j.cfg.Store(&cfg)
+	}, nil
+}
+
+func (j *Jail) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		now := time.Now()
+		maxBanTime := j.cfg.Load().MaxBanTime
+		j.offenders.DeleteFunc(func(_ string, o *offender) bool {
+			if o.ban != nil && !o.banned(now) {
+				o.ban = nil
+			}
+			// Forget offenders once a maximum-length ban would have expired
+			return o.ban == nil && now.Sub(o.lastSeen) > maxBanTime
+		})
+	}
+}
+
+func (j *Jail) limit(cfg *config.JailConfig, v Violation) int {
+	switch v {
+	case ViolationRule:
+		return cfg.MaxRuleHits
+	case ViolationRateLimit:
+		return cfg.MaxRateLimitHits
+	}
+	return cfg.MaxNotFound
+}
+
+// IsBanned reports whether ip is currently banned.
+func (j *Jail) IsBanned(ip string) bool {
+	banned := false
+	j.offenders.View(ip, func(o *offender) {
+		banned = o.banned(time.Now())
+	})
+	return banned
+}
+
+// Record counts a violation for ip and bans it once the threshold for that
+// kind of violation is crossed within the window.
+func (j *Jail) Record(ip string, v Violation) {
+	cfg := j.cfg.Load()
+	j.offenders.Update(ip, func(o *offender) {
+		now := time.Now()
+		if now.Sub(o.windowStart) > cfg.Window {
+			o.windowStart = now
+			o.counts = [numViolations]int{}
+		}
+		o.lastSeen = now
+		o.counts[v]++
+
+		if o.counts[v] >= j.limit(cfg, v) {
+			o.counts = [numViolations]int{}
+			j.ban(cfg, ip, o, v.String(), 0)
+		}
+	})
+}
+
+// ban bans ip for the given duration, or for the offender's next escalating
+// ban time when ttl is zero.
+func (j *Jail) ban(cfg *config.JailConfig, ip string, o *offender, reason string, ttl time.Duration) {
+	now := time.Now()
+	o.banCount++
+	o.lastSeen = now
+
+	if ttl <= 0 {
+		ttl = cfg.BanTime
+		for i := 1; i < o.banCount && ttl < cfg.MaxBanTime; i++ {
+			ttl = time.Duration(float64(ttl) * cfg.BanMultiplier)
+		}
+		if ttl > cfg.MaxBanTime {
+			ttl = cfg.MaxBanTime
+		}
+	}
+
+	o.ban = &Ban{
+		IP:        ip,
+		Reason:    reason,
+		BannedAt:  now,
+		ExpiresAt: now.Add(ttl),
+		Count:     o.banCount,
+	}
+	logger.Warn("Client banned", "client_ip", ip, "reason", reason, "ttl", ttl.String(), "count", o.banCount)
+}
+
+// Ban bans ip immediately. A zero ttl uses the escalating ban time.
+func (j *Jail) Ban(ip, reason string, ttl time.Duration) {
+	cfg := j.cfg.Load()
+	j.offenders.Update(ip, func(o *offender) {
+		if o.windowStart.IsZero() {
+			o.windowStart = time.Now()
+		}
+		j.ban(cfg, ip, o, reason, ttl)
+	})
+}
+
+// Unban lifts the ban on ip and reports whether one existed.
+func (j *Jail) Unban(ip string) bool {
+	lifted := false
+	j.offenders.View(ip, func(o *offender) {
+		lifted = o.ban != nil
+		o.ban = nil
+	})
+	if lifted {
+		logger.Info("Client ban lifted", "client_ip", ip)
+	}
+	return lifted
+}
+
+// Bans returns the active bans, soonest to expire first.
+func (j *Jail) Bans() []Ban {
+	now := time.Now()
+	var bans []Ban
+	j.offenders.Range(func(_ string, o *offender) {
+		if o.banned(now) {
+			bans = append(bans, *o.ban)
+		}
+	})
+	sort.Slice(bans, func(a, b int) bool { return bans[a].ExpiresAt.Before(bans[b].ExpiresAt) })
+	return bans
+}
+
+func (j *Jail) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		if j.IsBanned(ip) {
+			bannedRequests.Add(1)
+			logger.Warn("Request from banned client rejected", "client_ip", ip, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// Explicit bans are enforced even without automatic banning
+		if !j.cfg.Load().Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &violationRecorder{}
+		r = r.WithContext(context.WithValue(r.Context(), violationKey{}, rec))
+
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if rec.reported {
+			j.Record(ip, rec.violation)
+		} else if rw.statusCode == http.StatusNotFound {
+			j.Record(ip, ViolationNotFound)
+		}
+	})
+}
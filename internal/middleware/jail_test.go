@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestJail_BansAfterRuleHits(t *testing.T) {
+	logger.Init()
+
+	jail, _ := NewJail(config.JailConfig{Enabled: true, MaxRuleHits: 3})
+	engine, _ := rules.NewEngine([]config.SecurityRule{
+		{Name: "SQLi", Pattern: "UNION SELECT", Location: "query_params"},
+	})
+
+	handler := Chain(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		jail.Middleware,
+		SecurityMiddleware(func() config.SecurityConfig { return config.SecurityConfig{} }, func() *rules.Engine { return engine }),
+	)
+
+	makeRequest := func(url string) int {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		makeRequest("/?q=UNION%20SELECT")
+	}
+
+	if !jail.IsBanned("192.0.2.1") {
+		t.Fatal("expected client to be banned after 3 rule hits")
+	}
+	if code := makeRequest("/?q=hello"); code != http.StatusForbidden {
+		t.Errorf("expected banned client to get %d, got %d", http.StatusForbidden, code)
+	}
+
+	if !jail.Unban("192.0.2.1") {
+		t.Fatal("expected Unban to find the ban")
+	}
+	if code := makeRequest("/?q=hello"); code != http.StatusOK {
+		t.Errorf("expected OK after unban, got %d", code)
+	}
+}
+
+func TestJail_NotFoundBurst(t *testing.T) {
+	logger.Init()
+
+	jail, _ := NewJail(config.JailConfig{Enabled: true, MaxNotFound: 2})
+	handler := jail.Middleware(http.NotFoundHandler())
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/missing", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		// Not from a trusted proxy, so the header names no one
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if !jail.IsBanned("192.0.2.1") {
+		t.Error("expected client to be banned after a 404 burst")
+	}
+	if jail.IsBanned("198.51.100.7") {
+		t.Error("ban landed on the address the client put in X-Forwarded-For")
+	}
+}
+
+func TestJail_BanTimeGrows(t *testing.T) {
+	logger.Init()
+
+	jail, _ := NewJail(config.JailConfig{
+		Enabled:       true,
+		BanTime:       time.Minute,
+		MaxBanTime:    3 * time.Minute,
+		BanMultiplier: 2,
+	})
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}
+	for i, want := range expected {
+		jail.Ban("192.0.2.1", "test", 0)
+		ban := jail.Bans()[0]
+		if got := ban.ExpiresAt.Sub(ban.BannedAt); got != want {
+			t.Errorf("ban %d: expected ttl %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestJail_Bounded(t *testing.T) {
+	logger.Init()
+
+	jail, _ := NewJail(config.JailConfig{Enabled: true, MaxClients: 1000})
+	jail.Ban("192.0.2.1", "test", time.Hour)
+
+	// A flood of one-off offenders evicts the others, not the banned client
+	for i := range 100000 {
+		jail.Record(fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff), ViolationNotFound)
+	}
+	if n := jail.offenders.Len(); n > 1000 {
+		t.Errorf("Expected at most 1000 offenders, got %d", n)
+	}
+	if !jail.IsBanned("192.0.2.1") {
+		t.Error("Expected the ban to survive eviction pressure")
+	}
+}
+
+func TestJail_Update(t *testing.T) {
+	logger.Init()
+
+	jail, _ := NewJail(config.JailConfig{Enabled: true, MaxRuleHits: 1})
+	if err := jail.Update(config.JailConfig{BanTime: time.Hour, MaxBanTime: time.Minute}); err == nil {
+		t.Error("Expected max_ban_time shorter than ban_time to be rejected")
+	}
+
+	jail.Ban("192.0.2.1", "test", time.Hour)
+	if err := jail.Update(config.JailConfig{Enabled: false}); err != nil {
+		t.Fatal(err)
+	}
+	if !jail.IsBanned("192.0.2.1") {
+		t.Error("Expected bans to survive a reload")
+	}
+	jail.Record("192.0.2.2", ViolationRule)
+	if jail.IsBanned("192.0.2.2") {
+		t.Error("Expected the new thresholds to apply")
+	}
+}
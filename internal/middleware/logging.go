@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"bufio"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/yxorp/internal/route"
 	"github.com/yxorp/internal/stats"
+	"github.com/yxorp/internal/tlsfp"
 	"github.com/yxorp/pkg/logger"
 )
 
@@ -18,6 +22,21 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack records a protocol switch, whose 101 response is written on the
+// hijacked connection rather than through WriteHeader.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
 func RequestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -32,24 +51,47 @@ func RequestLogger(next http.Handler) http.Handler {
 			action = "BLOCKED"
 		}
 
+		geo := geoInfo(r)
+		var ja3, ja4 string
+		if fp := tlsfp.FromContext(r.Context()); fp != nil {
+			ja3, ja4 = fp.JA3Hash, fp.JA4
+		}
+
+		var routeName string
+		if rt := route.FromContext(r.Context()); rt != nil {
+			routeName = rt.Name
+		}
+
 		logger.Info("Request processed",
 			"client_ip", r.RemoteAddr,
 			"method", r.Method,
+			"host", r.Host,
 			"path", r.URL.Path,
+			"route", routeName,
 			"status_code", rw.statusCode,
 			"latency", latency.String(),
 			"action", action,
+			"country", geo.Country,
+			"asn", geo.ASN,
+			"ja3", ja3,
+			"ja4", ja4,
+			"threat_score", threatScore(r),
 		)
 
 		// Send to Dashboard Stats
 		stats.AddLog(stats.LogEntry{
-			Timestamp:  time.Now().Format(time.RFC3339),
-			ClientIP:   r.RemoteAddr,
-			Method:     r.Method,
-			Path:       r.URL.Path,
-			StatusCode: rw.statusCode,
-			Latency:    latency.String(),
-			Action:     action,
+			Timestamp:   time.Now().Format(time.RFC3339),
+			ClientIP:    r.RemoteAddr,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			StatusCode:  rw.statusCode,
+			Latency:     latency.String(),
+			Action:      action,
+			Country:     geo.Country,
+			ASN:         geo.ASN,
+			JA3:         ja3,
+			JA4:         ja4,
+			ThreatScore: threatScore(r),
 		})
 	})
 }
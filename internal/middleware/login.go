@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"encoding/json"
+	"expvar"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	defaultLoginWindow       = 15 * time.Minute
+	defaultMaxUserFailures   = 5
+	defaultMaxIPFailures     = 20
+	defaultMaxUsernamesPerIP = 10
+
+	// maxLoginBody bounds how much of a login request is read to find the
+	// username. Larger bodies are only tracked per IP.
+	maxLoginBody = 64 * 1024
+)
+
+var (
+	loginFailures = expvar.NewInt("login_failures")
+	loginBlocked  = expvar.NewInt("login_blocked")
+)
+
+// loginStores holds the failure counters of a loginGuard. They outlive
+// configuration reloads.
+type loginStores struct {
+	users     *bucketStore // failures per username
+	ips       *bucketStore // failures per client IP
+	usernames *bucketStore // distinct usernames per client IP
+	seen      *bucketStore // ip + username pairs already counted
+	cleared   *bucketStore // failures past a limit after solving a challenge
+}
+
+func newLoginStores(maxClients int) *loginStores {
+	return &loginStores{
+		users:     newBucketStore(maxClients),
+		ips:       newBucketStore(maxClients),
+		usernames: newBucketStore(maxClients),
+		seen:      newBucketStore(maxClients),
+		cleared:   newBucketStore(maxClients),
+	}
+}
+
+func (s *loginStores) setCapacity(maxClients int) {
+	s.users.setCapacity(maxClients)
+	s.ips.setCapacity(maxClients)
+	s.usernames.setCapacity(maxClients)
+	s.seen.setCapacity(maxClients)
+	s.cleared.setCapacity(maxClients)
+}
+
+// loginGuard tracks failed logins per username and per client IP. Each
+// counter is a token bucket holding the allowed failures and refilling over
+// the window, so a key is blocked while its bucket is empty.
+type loginGuard struct {
+	requestMatcher
+	field     string
+	failures  []int
+	window    time.Duration
+	maxUser   float64
+	maxIP     float64
+	maxNames  float64
+	challenge bool
+	*loginStores
+}
+
+func newLoginGuard(cfg config.LoginConfig) *loginGuard {
+	g := &loginGuard{
+		requestMatcher: requestMatcher{paths: cfg.Paths, methods: []string{http.MethodPost}},
+		field:          cfg.UsernameField,
+		failures:       cfg.FailureStatuses,
+		window:         cfg.Window,
+		maxUser:        float64(cfg.MaxUserFailures),
+		maxIP:          float64(cfg.MaxIPFailures),
+		maxNames:       float64(cfg.MaxUsernamesPerIP),
+		challenge:      cfg.Action == "challenge",
+	}
+	if g.field == "" {
+		g.field = "username"
+	}
+	if len(g.failures) == 0 {
+		g.failures = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	if g.window <= 0 {
+		g.window = defaultLoginWindow
+	}
+	if g.maxUser <= 0 {
+		g.maxUser = defaultMaxUserFailures
+	}
+	if g.maxIP <= 0 {
+		g.maxIP = defaultMaxIPFailures
+	}
+	if g.maxNames <= 0 {
+		g.maxNames = defaultMaxUsernamesPerIP
+	}
+	return g
+}
+
+// rate returns how fast a counter with the given limit recovers, in tokens
+// per second.
+func (g *loginGuard) rate(limit float64) float64 {
+	return limit / g.window.Seconds()
+}
+
+// username reads the configured field from a form or JSON login body. The
+// body is restored for the next handler.
+func (g *loginGuard) username(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" {
+		return ""
+	}
+	body, ok := peekBody(r, maxLoginBody)
+	if !ok {
+		return ""
+	}
+
+	var user string
+	if mediaType == "application/json" {
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) != nil {
+			return ""
+		}
+		user, _ = fields[g.field].(string)
+	} else {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		user = form.Get(g.field)
+	}
+	return strings.ToLower(strings.TrimSpace(user))
+}
+
+// blocked returns the reason the login attempt is refused, if any. Clients
+// that solved a challenge get up to clearedRateFactor times each limit.
+func (g *loginGuard) blocked(ip, user string, cleared bool, now int64) (string, bool) {
+	if user != "" && g.exhausted(g.users, "username", user, g.maxUser, cleared, now) {
+		return "username", true
+	}
+	if g.exhausted(g.ips, "ip", ip, g.maxIP, cleared, now) {
+		return "ip", true
+	}
+	if g.exhausted(g.usernames, "usernames", ip, g.maxNames, cleared, now) {
+		return "usernames", true
+	}
+	return "", false
+}
+
+// exhausted reports whether key has no failures left in store, or, for a
+// cleared client, in its overflow bucket as well.
+func (g *loginGuard) exhausted(store *bucketStore, kind, key string, limit float64, cleared bool, now int64) bool {
+	if store.tokens(key, now, g.rate(limit), limit) >= 1 {
+		return false
+	}
+	if !cleared {
+		return true
+	}
+	const extra = clearedRateFactor - 1
+	return g.cleared.tokens(kind+"\x00"+key, now, g.rate(limit)*extra, limit*extra) < 1
+}
+
+// fail counts a failure for key. Once store is empty the failure can only
+// have come from a cleared client and is drawn from its overflow bucket.
+func (g *loginGuard) fail(store *bucketStore, kind, key string, limit float64, now int64) {
+	if !store.take(key, now, g.rate(limit), limit) && g.challenge {
+		const extra = clearedRateFactor - 1
+		g.cleared.take(kind+"\x00"+key, now, g.rate(limit)*extra, limit*extra)
+	}
+}
+
+// record counts the attempt against its username and IP if the upstream
+// rejected it.
+func (g *loginGuard) record(ip, user string, status int, now int64) {
+	if !slices.Contains(g.failures, status) {
+		return
+	}
+	loginFailures.Add(1)
+	g.fail(g.ips, "ip", ip, g.maxIP, now)
+	if user == "" {
+		return
+	}
+	g.fail(g.users, "username", user, g.maxUser, now)
+	// Only the first failure for a username within the window counts
+	// towards the distinct usernames of the IP
+	if g.seen.take(ip+"\x00"+user, now, 1/g.window.Seconds(), 1) {
+		g.fail(g.usernames, "usernames", ip, g.maxNames, now)
+	}
+}
+
+// serve refuses attempts from blocked usernames and IPs and records the
+// outcome of the others. A client that solved a challenge is refused outright
+// once it reaches the clearedRateFactor ceiling, as solving again would only
+// get it another cookie.
+func (g *loginGuard) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	ip := ClientIP(r)
+	user := g.username(r)
+	cleared := g.challenge && challengePassed(r)
+
+	if reason, blocked := g.blocked(ip, user, cleared, time.Now().UnixNano()); blocked {
+		loginBlocked.Add(1)
+		if g.challenge && !cleared && serveChallenge(w, r) {
+			logger.Info("Login attempts exceeded, challenging client", "client_ip", ip, "username", user, "reason", reason)
+			return
+		}
+		logger.Warn("Login attempts exceeded", "client_ip", ip, "username", user, "reason", reason)
+		reportViolation(r, ViolationRateLimit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(g.window.Seconds())))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	next.ServeHTTP(rw, r)
+	g.record(ip, user, rw.statusCode, time.Now().UnixNano())
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func newLoginHandler(cfg config.LoginConfig) (*RateLimiter, http.Handler) {
+	rl, _ := NewRateLimiter(config.RateLimitConfig{Login: cfg})
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "secret") {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	return rl, handler
+}
+
+func login(handler http.Handler, ip, contentType, body string) int {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestLoginGuard_PerUsername(t *testing.T) {
+	logger.Init()
+	_, handler := newLoginHandler(config.LoginConfig{
+		Enabled:         true,
+		Paths:           []string{"/login"},
+		MaxUserFailures: 3,
+	})
+	form := "application/x-www-form-urlencoded"
+
+	// Failures for one username are counted across IPs
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if code := login(handler, ip, form, "username=alice&password=guess"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected upstream 401, got %d", i+1, code)
+		}
+	}
+	if code := login(handler, "192.0.2.4", form, "username=Alice&password=secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected username to be locked, got %d", code)
+	}
+
+	// Other usernames from the same IPs are unaffected
+	if code := login(handler, "192.0.2.1", "application/json", `{"username":"bob","password":"secret"}`); code != http.StatusOK {
+		t.Errorf("Expected OK for another username, got %d", code)
+	}
+}
+
+func TestLoginGuard_PerIP(t *testing.T) {
+	logger.Init()
+	_, handler := newLoginHandler(config.LoginConfig{
+		Enabled:           true,
+		Paths:             []string{"/login"},
+		MaxIPFailures:     100,
+		MaxUsernamesPerIP: 3,
+	})
+	form := "application/x-www-form-urlencoded"
+
+	for _, user := range []string{"a", "b", "c"} {
+		login(handler, "192.0.2.1", form, "username="+user)
+		// Repeated failures for a username count as one
+		login(handler, "192.0.2.1", form, "username="+user)
+	}
+	if code := login(handler, "192.0.2.1", form, "username=d&password=secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected IP spraying usernames to be blocked, got %d", code)
+	}
+	if code := login(handler, "192.0.2.2", form, "username=d&password=secret"); code != http.StatusOK {
+		t.Errorf("Expected OK from another IP, got %d", code)
+	}
+
+	// Non-login requests are not checked
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code == http.StatusTooManyRequests {
+		t.Error("Expected GET to bypass login protection")
+	}
+}
+
+func TestLoginGuard_Update(t *testing.T) {
+	logger.Init()
+	cfg := config.LoginConfig{Enabled: true, Paths: []string{"/login"}, MaxIPFailures: 2, Action: "challenge"}
+	rl, handler := newLoginHandler(cfg)
+	handler = NewChallenge(config.ChallengeConfig{}).Middleware(handler)
+
+	login(handler, "192.0.2.1", "text/plain", "")
+	login(handler, "192.0.2.1", "text/plain", "")
+
+	// Counters survive a reload
+	rl.Update(config.RateLimitConfig{Login: cfg})
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), challengePath) {
+		t.Errorf("Expected a challenge page, got %d", rec.Code)
+	}
+	if v := loginBlocked.Value(); v == 0 {
+		t.Error("Expected login_blocked to be counted")
+	}
+}
+
+func TestLoginGuard_ClearedCeiling(t *testing.T) {
+	logger.Init()
+	_, handler := newLoginHandler(config.LoginConfig{Enabled: true, Paths: []string{"/login"}, MaxUserFailures: 2, Action: "challenge"})
+	handler = NewChallenge(config.ChallengeConfig{Difficulty: 8}).Middleware(handler)
+	form := "application/x-www-form-urlencoded"
+
+	attempt := func(body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", form)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	attempt("username=alice")
+	attempt("username=alice")
+	rec := attempt("username=alice")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), challengePath) {
+		t.Fatalf("Expected a challenge page, got %d", rec.Code)
+	}
+	cookies := solveChallenge(t, handler, rec.Body.String(), "").Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatal("Expected clearance cookie")
+	}
+
+	// Solving the challenge buys more attempts, but not unlimited ones
+	for i := range 2 * (clearedRateFactor - 1) {
+		if rec := attempt("username=alice", cookies[0]); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected upstream 401 with clearance, got %d", i+1, rec.Code)
+		}
+	}
+	if rec := attempt("username=alice&password=secret", cookies[0]); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected cleared client to be locked out at the ceiling, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/yxorp/internal/route"
+)
+
+// requestMatcher selects requests by path prefix, method, header values and
+// the client's GeoIP country and ASN. Every non-empty condition has to match;
+// an empty matcher matches all. Path prefixes match whole segments, so
+// "/login" covers "/login/sso" but not "/login-help".
+type requestMatcher struct {
+	paths     []string
+	methods   []string
+	headers   map[string]string
+	countries []string
+	asns      []uint
+}
+
+func (m requestMatcher) matches(r *http.Request) bool {
+	if len(m.paths) > 0 {
+		matched := false
+		for _, p := range m.paths {
+			if route.HasPathPrefix(r.URL.Path, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(m.methods) > 0 {
+		matched := false
+		for _, method := range m.methods {
+			if strings.EqualFold(r.Method, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(m.countries) > 0 || len(m.asns) > 0 {
+		geo := geoInfo(r)
+		matched := false
+		for _, c := range m.countries {
+			if strings.EqualFold(geo.Country, c) {
+				matched = true
+				break
+			}
+		}
+		if !matched && geo.ASN != 0 && slices.Contains(m.asns, geo.ASN) {
+			matched = true
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, value := range m.headers {
+		got := r.Header.Get(name)
+		// An empty value only requires the header to be present
+		if (value == "" && got == "") || (value != "" && got != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// peekBody reads up to limit bytes of the request body and puts them back so
+// the next handler still sees the whole body. It reports false when the body
+// is larger than limit or cannot be read.
+func peekBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, err == nil && int64(len(body)) <= limit
+}
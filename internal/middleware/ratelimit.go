@@ -1,123 +1,275 @@
 package middleware
 
 import (
-	"net"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/tlsfp"
 	"github.com/yxorp/pkg/logger"
 )
 
-type Client struct {
-	tokens     float64
-	lastUpdate time.Time
-}
+const defaultMaxClients = 100000
 
-type RateLimiter struct {
-	mu              sync.Mutex
-	clients         map[string]*Client
-	rate            float64 // tokens per second
-	burst           float64 // max tokens
-	cleanupInterval time.Duration
+// defaultPolicyName names the policy for requests no other policy matches.
+const defaultPolicyName = "default"
+
+// clearedRateFactor caps clients that solved a challenge at this multiple of
+// a policy's limit. Past it they are blocked, as solving again would only get
+// them another cookie.
+const clearedRateFactor = 4
+
+// rateLimitPolicy is a token bucket configuration together with the buckets
+// of the clients it has seen.
+type rateLimitPolicy struct {
+	requestMatcher
+	name    string
+	key     string
+	rate    float64 // tokens per second
+	burst   float64 // max tokens
+	buckets *bucketStore
+
+	// challenge lets clients past the limit once they solve a challenge.
+	// Their overflow is drawn from cleared, which holds the buckets of the
+	// rest of the clearedRateFactor ceiling.
+	challenge bool
+	cleared   *bucketStore
 }
 
-func NewRateLimiter(cfg config.RateLimitConfig) *RateLimiter {
+func newRateLimitPolicy(name, key, action string, requestsPerMinute, burst int) *rateLimitPolicy {
 	// Convert requests per minute to tokens per second
-	rate := float64(cfg.RequestsPerMinute) / 60.0
+	rate := float64(requestsPerMinute) / 60.0
 	if rate <= 0 {
 		rate = 1 // Default to something safe if 0
 	}
+	if burst <= 0 {
+		burst = requestsPerMinute // Burst size = 1 minute worth of requests
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	if key == "" {
+		key = "ip"
+	}
 
-	rl := &RateLimiter{
-		clients:         make(map[string]*Client),
-		rate:            rate,
-		burst:           float64(cfg.RequestsPerMinute), // Burst size = 1 minute worth of requests
-		cleanupInterval: 10 * time.Minute,
+	return &rateLimitPolicy{
+		name:      name,
+		key:       key,
+		rate:      rate,
+		burst:     float64(burst),
+		challenge: action == "challenge",
+	}
+}
+
+func (p *rateLimitPolicy) clientKey(r *http.Request, ip string) string {
+	switch p.key {
+	case "country":
+		if c := geoInfo(r).Country; c != "" {
+			return c
+		}
+	case "asn":
+		if asn := geoInfo(r).ASN; asn != 0 {
+			return "AS" + strconv.FormatUint(uint64(asn), 10)
+		}
+	case "ja3":
+		if fp := tlsfp.FromContext(r.Context()); fp != nil {
+			return fp.JA3Hash
+		}
+	case "ja4":
+		if fp := tlsfp.FromContext(r.Context()); fp != nil {
+			return fp.JA4
+		}
+	default:
+		// The value is taken as is, so the header has to come from a
+		// trusted upstream rather than the client
+		if name, ok := strings.CutPrefix(p.key, "header:"); ok {
+			if v := r.Header.Get(name); v != "" {
+				return v
+			}
+		}
 	}
+	return ip
+}
 
-	// Background cleanup routine
-	go rl.cleanup()
+// rateLimiterState is an immutable snapshot of the limiter configuration.
+// Requests load it atomically, so reloads never block the request path.
+type rateLimiterState struct {
+	enabled       bool
+	policies      []*rateLimitPolicy // checked in order before the default
+	defaultPolicy *rateLimitPolicy
+	login         *loginGuard // nil unless login protection is enabled
+}
 
-	return rl
+type RateLimiter struct {
+	mu    sync.Mutex // serializes Update
+	state atomic.Pointer[rateLimiterState]
 }
 
-func (rl *RateLimiter) cleanup() {
-	ticker := time.NewTicker(rl.cleanupInterval)
-	for range ticker.C {
-		rl.mu.Lock()
-		// Remove clients that haven't been seen for a while (e.g., 1 hour)
-		expiry := time.Now().Add(-1 * time.Hour)
-		for ip, client := range rl.clients {
-			if client.lastUpdate.Before(expiry) {
-				delete(rl.clients, ip)
-			}
+func NewRateLimiter(cfg config.RateLimitConfig) (*RateLimiter, error) {
+	rl := &RateLimiter{}
+	if err := rl.Update(cfg); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// validate reports the error Update would return for cfg. Policies need
+// unique names, as their buckets are carried over by name.
+func (rl *RateLimiter) validate(cfg config.RateLimitConfig) error {
+	seen := map[string]bool{defaultPolicyName: true}
+	for _, pc := range cfg.Policies {
+		if pc.Name == "" {
+			return errors.New("rate limit policy needs a name")
 		}
-		rl.mu.Unlock()
+		if seen[pc.Name] {
+			return fmt.Errorf("duplicate rate limit policy %s", pc.Name)
+		}
+		seen[pc.Name] = true
 	}
+	return nil
 }
 
-func (rl *RateLimiter) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For first
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		// XFF can contain multiple IPs, the first one is the client
-		ips := strings.Split(xff, ",")
-		clientIP := strings.TrimSpace(ips[0])
-		if clientIP != "" {
-			return clientIP
+// Update applies a new configuration. Client buckets are carried over for
+// every policy that keeps its name and key, so a reload does not hand every
+// client a fresh burst.
+func (rl *RateLimiter) Update(cfg config.RateLimitConfig) error {
+	if err := rl.validate(cfg); err != nil {
+		return err
+	}
+	rl.apply(cfg)
+	return nil
+}
+
+// Prepare checks cfg without touching any buckets. The returned function
+// applies it as Update would and cannot fail.
+func (rl *RateLimiter) Prepare(cfg config.RateLimitConfig) (apply func(), err error) {
+	if err := rl.validate(cfg); err != nil {
+		return nil, err
+	}
+	return func() { rl.apply(cfg) }, nil
+}
+
+func (rl *RateLimiter) apply(cfg config.RateLimitConfig) {
+	maxClients := cfg.MaxClients
+	if maxClients <= 0 {
+		maxClients = defaultMaxClients
+	}
+
+	next := &rateLimiterState{
+		enabled:       cfg.Enabled,
+		defaultPolicy: newRateLimitPolicy(defaultPolicyName, "ip", cfg.Action, cfg.RequestsPerMinute, cfg.Burst),
+	}
+	for _, pc := range cfg.Policies {
+		p := newRateLimitPolicy(pc.Name, pc.Key, pc.Action, pc.RequestsPerMinute, pc.Burst)
+		p.requestMatcher = requestMatcher{paths: pc.Paths, methods: pc.Methods, countries: pc.Countries, asns: pc.ASNs}
+		next.policies = append(next.policies, p)
+	}
+	if cfg.Login.Enabled {
+		next.login = newLoginGuard(cfg.Login)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	old := make(map[string]*rateLimitPolicy)
+	if prev := rl.state.Load(); prev != nil {
+		for _, p := range prev.policies {
+			old[p.name] = p
 		}
+		old[prev.defaultPolicy.name] = prev.defaultPolicy
 	}
 
-	// Check X-Real-IP
-	xri := r.Header.Get("X-Real-IP")
-	if xri != "" {
-		return xri
+	for _, p := range append([]*rateLimitPolicy{next.defaultPolicy}, next.policies...) {
+		// Tokens above a lowered burst are clamped on the next refill
+		if prev, ok := old[p.name]; ok && prev.key == p.key {
+			p.buckets = prev.buckets
+			p.buckets.setCapacity(maxClients)
+			p.cleared = prev.cleared
+		} else {
+			p.buckets = newBucketStore(maxClients)
+		}
+		switch {
+		case !p.challenge:
+			p.cleared = nil
+		case p.cleared == nil:
+			p.cleared = newBucketStore(maxClients)
+		default:
+			p.cleared.setCapacity(maxClients)
+		}
 	}
 
-	// Fallback to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+	if next.login != nil {
+		if prev := rl.state.Load(); prev != nil && prev.login != nil {
+			next.login.loginStores = prev.login.loginStores
+			next.login.setCapacity(maxClients)
+		} else {
+			next.login.loginStores = newLoginStores(maxClients)
+		}
 	}
-	return ip
+
+	rl.state.Store(next)
 }
 
+// Middleware limits request rates. Login attempts are additionally checked
+// against the failure counters, even when rate limiting itself is disabled.
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	limited := rl.limit(next)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := rl.getClientIP(r)
-
-		rl.mu.Lock()
-		client, exists := rl.clients[ip]
-		if !exists {
-			client = &Client{
-				tokens:     rl.burst,
-				lastUpdate: time.Now(),
-			}
-			rl.clients[ip] = client
+		if login := rl.state.Load().login; login != nil && login.matches(r) {
+			login.serve(w, r, limited)
+			return
 		}
+		limited.ServeHTTP(w, r)
+	})
+}
 
-		now := time.Now()
-		elapsed := now.Sub(client.lastUpdate).Seconds()
+func (rl *RateLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := rl.state.Load()
+		if !state.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		// Refill tokens
-		client.tokens += elapsed * rl.rate
-		if client.tokens > rl.burst {
-			client.tokens = rl.burst
+		policy := state.defaultPolicy
+		for _, p := range state.policies {
+			if p.matches(r) {
+				policy = p
+				break
+			}
 		}
-		client.lastUpdate = now
 
-		if client.tokens >= 1.0 {
-			client.tokens -= 1.0
-			rl.mu.Unlock()
+		ip := ClientIP(r)
+		key := policy.clientKey(r, ip)
+
+		now := time.Now().UnixNano()
+		if policy.buckets.take(key, now, policy.rate, policy.burst) {
 			next.ServeHTTP(w, r)
-		} else {
-			rl.mu.Unlock()
-			logger.Warn("Rate limit exceeded", "client_ip", ip)
-			w.Header().Set("Retry-After", "60") // Simple retry hint
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
 		}
+
+		if policy.challenge {
+			if challengePassed(r) {
+				const extra = clearedRateFactor - 1
+				if policy.cleared.take(key, now, policy.rate*extra, policy.burst*extra) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			} else if serveChallenge(w, r) {
+				logger.Info("Rate limit exceeded, challenging client", "client_ip", ip, "policy", policy.name)
+				return
+			}
+		}
+
+		logger.Warn("Rate limit exceeded", "client_ip", ip, "policy", policy.name)
+		reportViolation(r, ViolationRateLimit)
+		w.Header().Set("Retry-After", "60") // Simple retry hint
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 	})
 }
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/lru"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	scannerReason = "scanner"
+
+	// scannerSlots is the resolution of the sliding window: counts age out
+	// one slot (Window / scannerSlots) at a time.
+	scannerSlots = 6
+)
+
+var scannersDetected = expvar.NewInt("scanners_detected")
+
+type scanSlot struct {
+	epoch    int64 // now / slot length
+	requests int
+	errors   int
+}
+
+// scanClient is the recent response history of one client.
+type scanClient struct {
+	slots        [scannerSlots]scanSlot
+	paths        map[uint32]int64 // error path hash -> last error, unix nanoseconds
+	flaggedUntil int64
+	lastSeen     int64
+}
+
+// scanStats summarizes a client's sliding window.
+type scanStats struct {
+	requests int
+	errors   int
+	paths    int
+}
+
+// ScannerDetector watches the status codes each client gets back and
+// classifies clients that collect errors across many different paths as
+// vulnerability scanners.
+type ScannerDetector struct {
+	jail *Jail
+	cfg  atomic.Pointer[config.ScannerConfig]
+
+	mu      sync.Mutex // serializes Update
+	clients *lru.Cache[scanClient]
+}
+
+func NewScannerDetector(cfg config.ScannerConfig, jail *Jail) (*ScannerDetector, error) {
+	d := &ScannerDetector{jail: jail}
+	if err := d.Update(cfg); err != nil {
+		return nil, err
+	}
+	go d.cleanup()
+	return d, nil
+}
+
+// validate reports the error Update would return for cfg.
+func (d *ScannerDetector) validate(cfg config.ScannerConfig) error {
+	switch cfg.Action {
+	case "", "ban", "challenge", "log":
+	default:
+		return fmt.Errorf("invalid scanner detection action %q", cfg.Action)
+	}
+	return nil
+}
+
+// Update applies a new configuration. Client history is kept unless the
+// window length changes.
+func (d *ScannerDetector) Update(cfg config.ScannerConfig) error {
+	if err := d.validate(cfg); err != nil {
+		return err
+	}
+	d.apply(cfg)
+	return nil
+}
+
+// Prepare checks cfg without changing the detector. The returned function
+// applies it and cannot fail.
+func (d *ScannerDetector) Prepare(cfg config.ScannerConfig) (apply func(), err error) {
+	if err := d.validate(cfg); err != nil {
+		return nil, err
+	}
+	return func() { d.apply(cfg) }, nil
+}
+
+func (d *ScannerDetector) apply(cfg config.ScannerConfig) {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if len(cfg.ErrorStatuses) == 0 {
+		cfg.ErrorStatuses = []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed}
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.ErrorRatio <= 0 {
+		cfg.ErrorRatio = 0.5
+	}
+	if cfg.DistinctPaths <= 0 {
+		cfg.DistinctPaths = 10
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = defaultMaxClients
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clients == nil {
+		// Clients flagged as scanners are evicted last
+		d.clients = lru.New(cfg.MaxClients, func(c *scanClient) bool { return time.Now().UnixNano() <= c.flaggedUntil })
+	} else {
+		d.clients.SetCapacity(cfg.MaxClients)
+	}
+	if prev := d.cfg.Load(); prev != nil && prev.Window != cfg.Window {
+		d.clients.DeleteFunc(func(string, *scanClient) bool { return true })
+	}
+	d.cfg.Store(&cfg)
+}
+
+func (d *ScannerDetector) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		now, window := time.Now().UnixNano(), int64(d.cfg.Load().Window)
+		// Forget clients that have been idle for a whole window and are
+		// not flagged
+		d.clients.DeleteFunc(func(_ string, c *scanClient) bool {
+			return now-c.lastSeen > window && now > c.flaggedUntil
+		})
+	}
+}
+
+// flagged reports whether ip was classified as a scanner within the window.
+func (d *ScannerDetector) flagged(ip string, now int64) bool {
+	flagged := false
+	d.clients.View(ip, func(c *scanClient) {
+		flagged = now <= c.flaggedUntil
+	})
+	return flagged
+}
+
+// observe records a response to ip and reports whether it just turned the
+// client into a scanner. When the detector is full, the least recently seen
+// client that is not flagged is forgotten.
+func (d *ScannerDetector) observe(cfg *config.ScannerConfig, ip, path string, status int, now int64) (stats scanStats, detected bool) {
+	d.clients.Update(ip, func(c *scanClient) {
+		stats, detected = c.observe(cfg, path, status, now)
+	})
+	return stats, detected
+}
+
+func (c *scanClient) observe(cfg *config.ScannerConfig, path string, status int, now int64) (scanStats, bool) {
+	if c.paths == nil {
+		c.paths = make(map[uint32]int64)
+	}
+	c.lastSeen = now
+
+	epoch := now / max(int64(cfg.Window)/scannerSlots, 1)
+	slot := &c.slots[epoch%scannerSlots]
+	if slot.epoch != epoch {
+		*slot = scanSlot{epoch: epoch}
+	}
+	slot.requests++
+
+	if !slices.Contains(cfg.ErrorStatuses, status) {
+		return scanStats{}, false
+	}
+	slot.errors++
+
+	// Keep enough paths to classify, not every path a scanner tries
+	h := fnv1a(path)
+	if _, seen := c.paths[h]; seen || len(c.paths) < 2*cfg.DistinctPaths {
+		c.paths[h] = now
+	}
+
+	if now <= c.flaggedUntil {
+		return scanStats{}, false
+	}
+
+	var stats scanStats
+	for _, s := range c.slots {
+		if epoch-s.epoch < scannerSlots {
+			stats.requests += s.requests
+			stats.errors += s.errors
+		}
+	}
+	if stats.requests < cfg.MinRequests || float64(stats.errors) < cfg.ErrorRatio*float64(stats.requests) {
+		return stats, false
+	}
+	for ph, last := range c.paths {
+		if now-last > int64(cfg.Window) {
+			delete(c.paths, ph)
+		}
+	}
+	stats.paths = len(c.paths)
+	if stats.paths < cfg.DistinctPaths {
+		return stats, false
+	}
+
+	c.flaggedUntil = now + int64(cfg.Window)
+	return stats, true
+}
+
+func (d *ScannerDetector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := d.cfg.Load()
+		if !cfg.Enabled || isAllowlisted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r)
+		if cfg.Action == "challenge" && !challengePassed(r) && d.flagged(ip, time.Now().UnixNano()) && serveChallenge(w, r) {
+			return
+		}
+
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		stats, detected := d.observe(cfg, ip, r.URL.Path, rw.statusCode, time.Now().UnixNano())
+		if !detected {
+			return
+		}
+		scannersDetected.Add(1)
+		logger.Warn("Scanner detected", "client_ip", ip, "action", cfg.Action,
+			"requests", stats.requests, "errors", stats.errors, "paths", stats.paths)
+		if cfg.Action == "" || cfg.Action == "ban" {
+			d.jail.Ban(ip, scannerReason, cfg.BanTime)
+		}
+	})
+}
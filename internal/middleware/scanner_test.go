@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestScannerDetector_Ban(t *testing.T) {
+	logger.Init()
+	jail, _ := NewJail(config.JailConfig{})
+	d, err := NewScannerDetector(config.ScannerConfig{
+		Enabled:       true,
+		MinRequests:   10,
+		DistinctPaths: 5,
+	}, jail)
+	if err != nil {
+		t.Fatalf("NewScannerDetector: %v", err)
+	}
+	handler := jail.Middleware(d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.NotFound(w, r)
+	})))
+
+	makeRequest := func(ip, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		// Spoofed by every client; they must still be told apart
+		req.Header.Set("X-Forwarded-For", "198.51.100.99")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A broken link hit over and over is not a scanner
+	for range 20 {
+		makeRequest("192.0.2.1", "/missing.png")
+	}
+	if code := makeRequest("192.0.2.1", "/"); code != http.StatusOK {
+		t.Errorf("Expected repeated 404s on one path to pass, got %d", code)
+	}
+
+	// Mostly successful browsing with a few errors is not a scanner
+	for i := range 20 {
+		makeRequest("192.0.2.2", "/")
+		if i%4 == 0 {
+			makeRequest("192.0.2.2", fmt.Sprintf("/old/%d", i))
+		}
+	}
+	if code := makeRequest("192.0.2.2", "/"); code != http.StatusOK {
+		t.Errorf("Expected a low error ratio to pass, got %d", code)
+	}
+
+	// Errors across many paths are
+	for _, path := range []string{"/.git/config", "/wp-login.php", "/admin", "/phpinfo.php", "/.env", "/backup.zip", "/config.php", "/server-status", "/console", "/actuator"} {
+		makeRequest("192.0.2.3", path)
+	}
+	if code := makeRequest("192.0.2.3", "/"); code != http.StatusForbidden {
+		t.Errorf("Expected scanner to be banned, got %d", code)
+	}
+	if bans := jail.Bans(); len(bans) != 1 || bans[0].IP != "192.0.2.3" || bans[0].Reason != scannerReason {
+		t.Errorf("Expected one scanner ban, got %+v", bans)
+	}
+}
+
+func TestScannerDetector_SlidingWindow(t *testing.T) {
+	jail, _ := NewJail(config.JailConfig{})
+	d, err := NewScannerDetector(config.ScannerConfig{
+		Enabled:       true,
+		Window:        time.Minute,
+		MinRequests:   4,
+		DistinctPaths: 4,
+		Action:        "log",
+	}, jail)
+	if err != nil {
+		t.Fatalf("NewScannerDetector: %v", err)
+	}
+	cfg := d.cfg.Load()
+	now := time.Now().UnixNano()
+
+	for i := range 3 {
+		d.observe(cfg, "192.0.2.1", fmt.Sprintf("/%d", i), http.StatusNotFound, now)
+	}
+	// The first errors have aged out of the window by the time of the fourth
+	later := now + int64(2*time.Minute)
+	if _, detected := d.observe(cfg, "192.0.2.1", "/3", http.StatusNotFound, later); detected {
+		t.Error("Expected old errors to age out of the window")
+	}
+	for i := 4; i < 6; i++ {
+		d.observe(cfg, "192.0.2.1", fmt.Sprintf("/%d", i), http.StatusNotFound, later)
+	}
+	stats, detected := d.observe(cfg, "192.0.2.1", "/6", http.StatusForbidden, later)
+	if !detected || stats.requests != 4 || stats.paths != 4 {
+		t.Errorf("Expected detection from the current window, got %+v %v", stats, detected)
+	}
+	if !d.flagged("192.0.2.1", later) || d.flagged("192.0.2.1", later+int64(2*time.Minute)) {
+		t.Error("Expected the client to stay flagged for one window")
+	}
+
+	if err := d.Update(config.ScannerConfig{Action: "drop"}); err == nil {
+		t.Error("Expected error for an invalid action")
+	}
+}
+
+func TestScannerDetector_FlaggedSurvivesEviction(t *testing.T) {
+	jail, _ := NewJail(config.JailConfig{})
+	d, err := NewScannerDetector(config.ScannerConfig{
+		Enabled:       true,
+		MinRequests:   2,
+		DistinctPaths: 2,
+		MaxClients:    1000,
+		Action:        "log",
+	}, jail)
+	if err != nil {
+		t.Fatalf("NewScannerDetector: %v", err)
+	}
+	cfg := d.cfg.Load()
+	now := time.Now().UnixNano()
+
+	d.observe(cfg, "192.0.2.1", "/a", http.StatusNotFound, now)
+	if _, detected := d.observe(cfg, "192.0.2.1", "/b", http.StatusNotFound, now); !detected {
+		t.Fatal("Expected the client to be flagged")
+	}
+
+	// A flood of new clients evicts the others, not the flagged scanner
+	for i := range 100000 {
+		d.observe(cfg, fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff), "/", http.StatusOK, now)
+	}
+	if n := d.clients.Len(); n > 1000 {
+		t.Errorf("Expected at most 1000 clients, got %d", n)
+	}
+	if !d.flagged("192.0.2.1", now) {
+		t.Error("Expected the flagged client to survive eviction pressure")
+	}
+}
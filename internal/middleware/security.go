@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/route"
 	"github.com/yxorp/internal/rules"
 	"github.com/yxorp/pkg/logger"
 )
@@ -14,9 +15,28 @@ import (
 func SecurityMiddleware(cfgGetter func() config.SecurityConfig, engineGetter func() *rules.Engine) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Allowlisted networks skip inspection entirely
+			if isAllowlisted(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			cfg := cfgGetter()
 			ruleEngine := engineGetter()
 
+			// Routes can relax inspection for their requests
+			var skipRules []string
+			if rt := route.FromContext(r.Context()); rt != nil {
+				if rt.Security.SkipInspection {
+					next.ServeHTTP(w, r)
+					return
+				}
+				skipRules = rt.Security.SkipRules
+				if rt.Security.MaxBodySize > 0 {
+					cfg.MaxBodySize = rt.Security.MaxBodySize
+				}
+			}
+
 			// 1. User-Agent Blocking
 			userAgent := r.UserAgent()
 
@@ -29,14 +49,20 @@ func SecurityMiddleware(cfgGetter func() config.SecurityConfig, engineGetter fun
 				// Actually, let's just check if the user agent contains any of the blocked strings.
 			}
 
+			// Verified crawlers are expected to look like bots
+			if isVerifiedBot(r) {
+				cfg.BlockUserAgents = nil
+			}
 			for _, blockedAgent := range cfg.BlockUserAgents {
 				if blockedAgent == "" && userAgent == "" {
 					logger.Warn("Blocked suspicious User-Agent", "client_ip", r.RemoteAddr, "user_agent", "empty")
+					reportViolation(r, ViolationRule)
 					http.Error(w, "Forbidden", http.StatusForbidden)
 					return
 				}
 				if blockedAgent != "" && strings.Contains(strings.ToLower(userAgent), strings.ToLower(blockedAgent)) {
 					logger.Warn("Blocked suspicious User-Agent", "client_ip", r.RemoteAddr, "user_agent", userAgent)
+					reportViolation(r, ViolationRule)
 					http.Error(w, "Forbidden", http.StatusForbidden)
 					return
 				}
@@ -46,8 +72,10 @@ func SecurityMiddleware(cfgGetter func() config.SecurityConfig, engineGetter fun
 			if ruleEngine != nil {
 				var bodyBytes []byte
 				// Only read body if method implies a body and we have rules that might check it
-				// For simplicity, we read it if it's not GET/HEAD/DELETE/OPTIONS
-				if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch {
+				// For simplicity, we read it if it's not GET/HEAD/DELETE/OPTIONS.
+				// gRPC bodies are protobuf streams that may stay open for the
+				// whole call, so waiting for their end would stall streaming calls.
+				if (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) && !IsGRPC(r) {
 					maxSize := cfg.MaxBodySize
 					if maxSize <= 0 {
 						maxSize = 10 * 1024 * 1024 // 10MB default
@@ -75,9 +103,13 @@ func SecurityMiddleware(cfgGetter func() config.SecurityConfig, engineGetter fun
 					r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 				}
 
-				matched, ruleName := ruleEngine.Check(r, bodyBytes)
-				if matched {
-					logger.Warn("Request blocked by security rule", "client_ip", r.RemoteAddr, "rule", ruleName)
+				if rule := ruleEngine.MatchExcept(r, bodyBytes, challengePassed(r), skipRules); rule != nil {
+					if rule.Action == "challenge" && serveChallenge(w, r) {
+						logger.Info("Request challenged by security rule", "client_ip", r.RemoteAddr, "rule", rule.Name)
+						return
+					}
+					logger.Warn("Request blocked by security rule", "client_ip", r.RemoteAddr, "rule", rule.Name)
+					reportViolation(r, ViolationRule)
 					http.Error(w, "Forbidden", http.StatusForbidden)
 					return
 				}
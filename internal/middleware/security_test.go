@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/route"
 	"github.com/yxorp/internal/rules"
 )
 
@@ -83,3 +84,41 @@ func TestSecurityMiddleware_Rules(t *testing.T) {
 		})
 	}
 }
+
+func TestSecurityMiddleware_RoutePolicy(t *testing.T) {
+	cfg := config.SecurityConfig{BlockUserAgents: []string{"curl"}}
+	engine, _ := rules.NewEngine([]config.SecurityRule{
+		{Name: "SQLi", Pattern: "UNION SELECT", Location: "query_params"},
+		{Name: "XSS", Pattern: "<script", Location: "query_params"},
+	})
+	table, _ := route.NewTable([]config.RouteConfig{
+		{Name: "health", Paths: []string{"/healthz"}, Security: config.RouteSecurity{SkipInspection: true}},
+		{Name: "cms", Paths: []string{"/cms"}, Security: config.RouteSecurity{SkipRules: []string{"XSS"}}},
+	})
+
+	middleware := SecurityMiddleware(func() config.SecurityConfig { return cfg }, func() *rules.Engine { return engine })
+	handler := table.Middleware(middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	tests := []struct {
+		url            string
+		userAgent      string
+		expectedStatus int
+	}{
+		{"/healthz", "curl/8.0", http.StatusOK},
+		{"/status", "curl/8.0", http.StatusForbidden},
+		{"/cms/edit?body=%3Cscript%3E", "Mozilla/5.0", http.StatusOK},
+		{"/cms/edit?q=UNION%20SELECT", "Mozilla/5.0", http.StatusForbidden},
+		{"/search?q=%3Cscript%3E", "Mozilla/5.0", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.url, tt.expectedStatus, rec.Code)
+		}
+	}
+}
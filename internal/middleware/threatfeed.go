@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/iptrie"
+	"github.com/yxorp/internal/threatfeed"
+	"github.com/yxorp/pkg/logger"
+)
+
+const defaultFeedRefresh = time.Hour
+
+var threatFeedHits = expvar.NewMap("threat_feed_hits")
+
+type threatScoreKey struct{}
+
+// threatScore returns the reputation score the threat feeds gave the request.
+func threatScore(r *http.Request) int {
+	score, _ := r.Context().Value(threatScoreKey{}).(int)
+	return score
+}
+
+// threatFeedList is a loaded feed. It is replaced, never modified, when the
+// feed is refreshed.
+type threatFeedList struct {
+	cfg      config.ThreatFeed
+	entries  *iptrie.Trie[int] // value is the CSV score
+	loadedAt time.Time
+}
+
+type threatFeedState struct {
+	blockScore int
+	feeds      []*threatFeedList
+}
+
+// ThreatFeeds matches clients against IP reputation lists and applies each
+// feed's action. Feeds are read and re-read in the background.
+type ThreatFeeds struct {
+	mu      sync.Mutex // serializes state changes; never held while loading
+	state   atomic.Pointer[threatFeedState]
+	loading sync.WaitGroup
+}
+
+func NewThreatFeeds(cfg config.ThreatFeedConfig) (*ThreatFeeds, error) {
+	f := &ThreatFeeds{}
+	if err := f.Update(cfg); err != nil {
+		return nil, err
+	}
+	go f.refreshLoop()
+	return f, nil
+}
+
+// sameSource reports whether two feed configurations load the same entries.
+func sameSource(a, b config.ThreatFeed) bool {
+	return a.Path == b.Path && a.URL == b.URL && a.Format == b.Format &&
+		a.IPColumn == b.IPColumn && a.ScoreColumn == b.ScoreColumn && a.MinScore == b.MinScore
+}
+
+func loadThreatFeed(cfg config.ThreatFeed) (*threatFeedList, error) {
+	entries, err := threatfeed.Load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	trie := iptrie.New[int]()
+	for _, e := range entries {
+		trie.Insert(e.Prefix, e.Score)
+	}
+	logger.Info("Threat feed loaded", "feed", cfg.Name, "entries", trie.Len())
+	return &threatFeedList{cfg: cfg, entries: trie, loadedAt: time.Now()}, nil
+}
+
+// validate reports the error Update would return for cfg. Feed contents are
+// not checked, as they load in the background.
+func (f *ThreatFeeds) validate(cfg config.ThreatFeedConfig) error {
+	for _, fc := range cfg.Feeds {
+		if fc.Name == "" {
+			return errors.New("threat feed needs a name")
+		}
+		if !threatfeed.ValidFormat(fc.Format) {
+			return fmt.Errorf("invalid format %q for threat feed %s", fc.Format, fc.Name)
+		}
+		switch fc.Action {
+		case "", "block", "challenge", "score":
+		default:
+			return fmt.Errorf("invalid action %q for threat feed %s", fc.Action, fc.Name)
+		}
+	}
+	return nil
+}
+
+// Update applies a new configuration. Feeds whose source is unchanged keep
+// their entries; new feeds start empty and are loaded in the background, so
+// a slow download does not hold up a reload. A feed that fails to load stays
+// empty and is retried on the next refresh.
+func (f *ThreatFeeds) Update(cfg config.ThreatFeedConfig) error {
+	if err := f.validate(cfg); err != nil {
+		return err
+	}
+	f.apply(cfg)
+	return nil
+}
+
+// Prepare checks cfg without changing anything. The returned function
+// applies it and cannot fail; feeds still load in the background.
+func (f *ThreatFeeds) Prepare(cfg config.ThreatFeedConfig) (apply func(), err error) {
+	if err := f.validate(cfg); err != nil {
+		return nil, err
+	}
+	return func() { f.apply(cfg) }, nil
+}
+
+func (f *ThreatFeeds) apply(cfg config.ThreatFeedConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := make(map[string]*threatFeedList)
+	if prev := f.state.Load(); prev != nil {
+		for _, feed := range prev.feeds {
+			old[feed.cfg.Name] = feed
+		}
+	}
+
+	next := &threatFeedState{blockScore: cfg.BlockScore}
+	var pending []*threatFeedList
+	for _, fc := range cfg.Feeds {
+		if prev, ok := old[fc.Name]; ok && sameSource(prev.cfg, fc) {
+			next.feeds = append(next.feeds, &threatFeedList{cfg: fc, entries: prev.entries, loadedAt: prev.loadedAt})
+			continue
+		}
+		feed := &threatFeedList{cfg: fc, entries: iptrie.New[int](), loadedAt: time.Now()}
+		next.feeds = append(next.feeds, feed)
+		pending = append(pending, feed)
+	}
+
+	f.state.Store(next)
+	if len(pending) > 0 {
+		f.loading.Add(1)
+		go func() {
+			defer f.loading.Done()
+			for _, feed := range pending {
+				loaded, err := loadThreatFeed(feed.cfg)
+				if err != nil {
+					logger.Error("Failed to load threat feed", "feed", feed.cfg.Name, "error", err)
+					continue
+				}
+				f.install(feed, loaded)
+			}
+		}()
+	}
+}
+
+// install swaps the entries of loaded in for those of feed, unless a reload
+// has since dropped the feed or changed its source.
+func (f *ThreatFeeds) install(feed, loaded *threatFeedList) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := f.state.Load()
+	i := slices.IndexFunc(state.feeds, func(cur *threatFeedList) bool { return cur.entries == feed.entries })
+	if i < 0 {
+		return
+	}
+	next := &threatFeedState{blockScore: state.blockScore, feeds: slices.Clone(state.feeds)}
+	next.feeds[i] = &threatFeedList{cfg: state.feeds[i].cfg, entries: loaded.entries, loadedAt: loaded.loadedAt}
+	f.state.Store(next)
+}
+
+func (f *ThreatFeeds) refreshLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.refresh()
+	}
+}
+
+// refresh re-reads every feed whose refresh interval has passed. On error the
+// previous entries stay in place.
+func (f *ThreatFeeds) refresh() {
+	for _, feed := range f.state.Load().feeds {
+		interval := feed.cfg.Refresh
+		if interval <= 0 {
+			interval = defaultFeedRefresh
+		}
+		if time.Since(feed.loadedAt) < interval {
+			continue
+		}
+
+		loaded, err := loadThreatFeed(feed.cfg)
+		if err != nil {
+			logger.Error("Failed to refresh threat feed", "feed", feed.cfg.Name, "error", err)
+			loaded = &threatFeedList{cfg: feed.cfg, entries: feed.entries, loadedAt: time.Now()}
+		}
+		f.install(feed, loaded)
+	}
+}
+
+func (f *ThreatFeeds) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := f.state.Load()
+		if len(state.feeds) == 0 || isAllowlisted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIP(r)
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		score := 0
+		for _, feed := range state.feeds {
+			entryScore, ok := feed.entries.Lookup(addr)
+			if !ok {
+				continue
+			}
+			threatFeedHits.Add(feed.cfg.Name, 1)
+
+			switch feed.cfg.Action {
+			case "score":
+				if feed.cfg.Score != 0 {
+					score += feed.cfg.Score
+				} else {
+					score += entryScore
+				}
+				continue
+			case "challenge":
+				if challengePassed(r) {
+					continue
+				}
+				if serveChallenge(w, r) {
+					logger.Info("Request challenged by threat feed", "client_ip", ip, "feed", feed.cfg.Name)
+					return
+				}
+			}
+
+			logger.Warn("Request blocked by threat feed", "client_ip", ip, "feed", feed.cfg.Name)
+			reportViolation(r, ViolationRule)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if state.blockScore > 0 && score >= state.blockScore {
+			logger.Warn("Request blocked by threat score", "client_ip", ip, "score", score)
+			reportViolation(r, ViolationRule)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if score > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), threatScoreKey{}, score))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestThreatFeeds_Actions(t *testing.T) {
+	logger.Init()
+	dir := t.TempDir()
+	dropPath := filepath.Join(dir, "drop.txt")
+	os.WriteFile(dropPath, []byte("192.0.2.0/24 ; SBL1\n"), 0o644)
+	scoresPath := filepath.Join(dir, "scores.csv")
+	os.WriteFile(scoresPath, []byte("ip,score\n198.51.100.1,30\n198.51.100.2,80\n"), 0o644)
+
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.0/24\n"))
+	}))
+	defer feedServer.Close()
+
+	f, err := NewThreatFeeds(config.ThreatFeedConfig{
+		BlockScore: 50,
+		Feeds: []config.ThreatFeed{
+			{Name: "drop", Path: dropPath, Format: "spamhaus"},
+			{Name: "reputation", Path: scoresPath, Format: "csv", Action: "score"},
+			{Name: "remote", URL: feedServer.URL, Action: "challenge"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewThreatFeeds: %v", err)
+	}
+	f.loading.Wait()
+
+	c := NewChallenge(config.ChallengeConfig{})
+	jail, _ := NewJail(config.JailConfig{Enabled: true, MaxRuleHits: 1})
+	var score int
+	handler := jail.Middleware(c.Middleware(f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		score = threatScore(r)
+		w.WriteHeader(http.StatusOK)
+	}))))
+
+	tests := []struct {
+		ip         string
+		wantStatus int
+		wantScore  int
+	}{
+		{"192.0.2.10", http.StatusForbidden, 0},
+		{"198.51.100.1", http.StatusOK, 30},
+		{"198.51.100.2", http.StatusForbidden, 0},
+		{"203.0.113.5", http.StatusForbidden, 0}, // challenge page
+		{"10.0.0.1", http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		score = 0
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus || score != tt.wantScore {
+			t.Errorf("%s: got status %d score %d, want %d and %d", tt.ip, rec.Code, score, tt.wantStatus, tt.wantScore)
+		}
+	}
+
+	if hits := threatFeedHits.Get("drop"); hits == nil || hits.String() == "0" {
+		t.Errorf("expected hits for the drop feed, got %v", hits)
+	}
+	if !jail.IsBanned("192.0.2.10") || !jail.IsBanned("198.51.100.2") || jail.IsBanned("198.51.100.1") {
+		t.Errorf("expected feed blocks to count as violations, got %+v", jail.Bans())
+	}
+}
+
+func TestThreatFeeds_UpdateDoesNotWait(t *testing.T) {
+	logger.Init()
+	release := make(chan struct{})
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("192.0.2.1\n"))
+	}))
+	defer feedServer.Close()
+
+	f, err := NewThreatFeeds(config.ThreatFeedConfig{})
+	if err != nil {
+		t.Fatalf("NewThreatFeeds: %v", err)
+	}
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	status := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- f.Update(config.ThreatFeedConfig{Feeds: []config.ThreatFeed{{Name: "slow", URL: feedServer.URL}}})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update waited for the feed download")
+	}
+	if status() != http.StatusOK {
+		t.Error("expected the feed to start empty")
+	}
+
+	close(release)
+	f.loading.Wait()
+	if status() != http.StatusForbidden {
+		t.Error("expected the downloaded entries to be swapped in")
+	}
+}
+
+func TestThreatFeeds_Refresh(t *testing.T) {
+	logger.Init()
+	path := filepath.Join(t.TempDir(), "list.txt")
+	os.WriteFile(path, []byte("192.0.2.1\n"), 0o644)
+
+	f, err := NewThreatFeeds(config.ThreatFeedConfig{
+		Feeds: []config.ThreatFeed{{Name: "list", Path: path, Refresh: time.Nanosecond}},
+	})
+	if err != nil {
+		t.Fatalf("NewThreatFeeds: %v", err)
+	}
+	f.loading.Wait()
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	status := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	os.WriteFile(path, []byte("192.0.2.2\n"), 0o644)
+	f.refresh()
+	if status("192.0.2.1") != http.StatusOK || status("192.0.2.2") != http.StatusForbidden {
+		t.Error("expected refreshed entries to replace the old ones")
+	}
+
+	// A broken file keeps the previous entries
+	os.WriteFile(path, []byte("not an ip\n"), 0o644)
+	f.refresh()
+	if status("192.0.2.2") != http.StatusForbidden {
+		t.Error("expected previous entries to survive a failed refresh")
+	}
+
+	if err := f.Update(config.ThreatFeedConfig{Feeds: []config.ThreatFeed{{Name: "list", Path: path, Action: "drop"}}}); err == nil {
+		t.Error("expected error for an invalid action")
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/tlsfp"
+	"github.com/yxorp/pkg/logger"
+)
+
+var fingerprintBlockedRequests = expvar.NewInt("requests_fingerprint_blocked")
+
+// TLSFingerprint blocks clients whose TLS fingerprint is on the configured
+// lists. Scripted clients cannot hide their TLS stack behind a browser
+// User-Agent.
+type TLSFingerprint struct {
+	blocked atomic.Pointer[map[string]struct{}]
+}
+
+func NewTLSFingerprint(cfg config.TLSFingerprintConfig) *TLSFingerprint {
+	f := &TLSFingerprint{}
+	f.Update(cfg)
+	return f
+}
+
+func (f *TLSFingerprint) Update(cfg config.TLSFingerprintConfig) {
+	blocked := make(map[string]struct{}, len(cfg.BlockJA3)+len(cfg.BlockJA4))
+	for _, fp := range cfg.BlockJA3 {
+		blocked[strings.ToLower(strings.TrimSpace(fp))] = struct{}{}
+	}
+	for _, fp := range cfg.BlockJA4 {
+		blocked[strings.ToLower(strings.TrimSpace(fp))] = struct{}{}
+	}
+	f.blocked.Store(&blocked)
+}
+
+func (f *TLSFingerprint) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked := *f.blocked.Load()
+		fp := tlsfp.FromContext(r.Context())
+		if len(blocked) == 0 || fp == nil || isAllowlisted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, ja3Hash := blocked[fp.JA3Hash]
+		_, ja3 := blocked[fp.JA3]
+		_, ja4 := blocked[fp.JA4]
+		if ja3Hash || ja3 || ja4 {
+			fingerprintBlockedRequests.Add(1)
+			logger.Warn("Request blocked by TLS fingerprint", "client_ip", ClientIP(r), "ja3", fp.JA3Hash, "ja4", fp.JA4)
+			reportViolation(r, ViolationRule)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
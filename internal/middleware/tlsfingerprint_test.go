@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/tlsfp"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestTLSFingerprint_Block(t *testing.T) {
+	logger.Init()
+	f := NewTLSFingerprint(config.TLSFingerprintConfig{})
+
+	var seen *tlsfp.Fingerprint
+	srv := httptest.NewUnstartedServer(f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = tlsfp.FromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})))
+	srv.Listener = tlsfp.Listen(srv.Listener)
+	srv.Config.ConnContext = tlsfp.ConnContext
+	srv.TLS = &tls.Config{GetConfigForClient: tlsfp.Record}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func() int {
+		resp, err := srv.Client().Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK || seen == nil {
+		t.Fatalf("Expected OK with a fingerprint, got %d", code)
+	}
+
+	f.Update(config.TLSFingerprintConfig{BlockJA4: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"}})
+	if code := get(); code != http.StatusOK {
+		t.Errorf("Expected OK for an unlisted fingerprint, got %d", code)
+	}
+
+	f.Update(config.TLSFingerprintConfig{BlockJA3: []string{seen.JA3Hash}})
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("Expected Forbidden for a blocked JA3, got %d", code)
+	}
+
+	f.Update(config.TLSFingerprintConfig{BlockJA4: []string{seen.JA4}})
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("Expected Forbidden for a blocked JA4, got %d", code)
+	}
+}
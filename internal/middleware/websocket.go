@@ -0,0 +1,392 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/route"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// Close codes sent to the client when the WAF ends a connection
+const (
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+)
+
+var (
+	wsConnections = expvar.NewInt("websocket_connections")
+	wsClosed      = expvar.NewMap("websocket_closed")
+)
+
+var errWebSocketClosed = errors.New("websocket connection closed by the WAF")
+
+// IsUpgrade reports whether r asks to switch to another protocol, such as
+// WebSocket.
+func IsUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+func isWebSocket(r *http.Request) bool {
+	return IsUpgrade(r) && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hijackWriter lets a middleware take part when the connection is hijacked,
+// as the reverse proxy does once an upgrade is accepted. onHijack gets the
+// hijacked connection and returns the one handed to the hijacker.
+type hijackWriter struct {
+	http.ResponseWriter
+	onHijack func(net.Conn, *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter)
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	conn, brw = w.onHijack(conn, brw)
+	return conn, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *hijackWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WebSocket limits, and optionally inspects, the messages clients send on
+// upgraded WebSocket connections. The upgrade request itself goes through
+// the rest of the chain like any other.
+type WebSocket struct {
+	cfg    atomic.Pointer[config.WebSocketConfig]
+	engine func() *rules.Engine
+}
+
+func NewWebSocket(cfg config.WebSocketConfig, engineGetter func() *rules.Engine) *WebSocket {
+	ws := &WebSocket{engine: engineGetter}
+	ws.Update(cfg)
+	return ws
+}
+
+// Update applies to connections upgraded from now on.
+func (ws *WebSocket) Update(cfg config.WebSocketConfig) {
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 1 << 20
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = max(1, int(math.Ceil(cfg.MessagesPerSecond)))
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = 5 * time.Minute
+	}
+	ws.cfg.Store(&cfg)
+}
+
+// wsSession is what a connection needs to know about the request that
+// upgraded it.
+type wsSession struct {
+	cfg             config.WebSocketConfig
+	engine          func() *rules.Engine // nil when messages are not inspected
+	challengePassed bool
+	skipRules       []string
+	clientIP        string
+	path            string
+}
+
+func (ws *WebSocket) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s := &wsSession{cfg: *ws.cfg.Load(), clientIP: ClientIP(r), path: r.URL.Path}
+		if s.cfg.Inspect && !isAllowlisted(r) {
+			s.engine = ws.engine
+			s.challengePassed = challengePassed(r)
+			if rt := route.FromContext(r.Context()); rt != nil {
+				if rt.Security.SkipInspection {
+					s.engine = nil
+				}
+				s.skipRules = rt.Security.SkipRules
+			}
+		}
+		if s.engine != nil {
+			// Compressed messages could not be inspected
+			r.Header.Del("Sec-WebSocket-Extensions")
+		}
+
+		next.ServeHTTP(&hijackWriter{ResponseWriter: w, onHijack: s.wrap}, r)
+	})
+}
+
+// wrap puts the limits and inspection between the client connection and
+// whoever hijacked it.
+func (s *wsSession) wrap(conn net.Conn, brw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+	c := &wsConn{Conn: conn, r: brw.Reader, s: s, tokens: float64(s.cfg.Burst)}
+	c.touch()
+	if s.cfg.IdleTimeout > 0 {
+		c.idle = time.AfterFunc(s.cfg.IdleTimeout, c.checkIdle)
+	}
+	wsConnections.Add(1)
+	return c, bufio.NewReadWriter(bufio.NewReader(c), brw.Writer)
+}
+
+// wsConn is the client side of a WebSocket connection. Reads parse the
+// client's frames and pass them on unchanged, holding back text messages
+// until they have been inspected; a message that breaks a limit or matches
+// a rule ends the connection instead.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader // may hold bytes read before the hijack
+	s *wsSession
+
+	// Read side, used by a single reader
+	buf        [14 + 125]byte // longest frame header plus a control frame payload
+	pending    []byte         // frame bytes ready to be read
+	remaining  int64          // payload bytes of the current frame still to pass through
+	inMessage  bool           // a data message has started and not finished
+	inspecting bool           // the current message is held for inspection
+	size       int64          // payload bytes of the current message so far
+	held       []byte         // raw frames of the message being inspected
+	message    []byte         // its unmasked payload
+	tokens     float64
+	lastMsg    time.Time
+
+	writeMu    sync.Mutex
+	lastActive atomic.Int64 // unix nanoseconds
+	idle       *time.Timer
+	closeOnce  sync.Once
+}
+
+func (c *wsConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			c.touch()
+			return n, nil
+		}
+		if c.remaining > 0 {
+			n, err := c.r.Read(p[:min(int64(len(p)), c.remaining)])
+			c.remaining -= int64(n)
+			c.touch()
+			return n, err
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.touch()
+	return c.Conn.Write(p)
+}
+
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		wsConnections.Add(-1)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// readFrame reads the next frame header from the client. Control frames and
+// data frames that are not inspected are queued right away; the frames of an
+// inspected message are queued once the whole message has passed.
+func (c *wsConn) readFrame() error {
+	hdr := c.buf[:2]
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		hdr = c.buf[:4]
+		if _, err := io.ReadFull(c.r, hdr[2:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(hdr[2:]))
+	case 127:
+		hdr = c.buf[:10]
+		if _, err := io.ReadFull(c.r, hdr[2:]); err != nil {
+			return err
+		}
+		if length = int64(binary.BigEndian.Uint64(hdr[2:])); length < 0 {
+			return c.fail(wsCloseProtocolError, "protocol", "invalid frame length")
+		}
+	}
+	if !masked {
+		return c.fail(wsCloseProtocolError, "protocol", "unmasked client frame")
+	}
+	n := len(hdr)
+	hdr = c.buf[:n+4]
+	if _, err := io.ReadFull(c.r, hdr[n:]); err != nil {
+		return err
+	}
+	mask := hdr[n:]
+
+	if opcode >= wsOpClose {
+		if length > 125 || !fin {
+			return c.fail(wsCloseProtocolError, "protocol", "invalid control frame")
+		}
+		frame := c.buf[:len(hdr)+int(length)]
+		if _, err := io.ReadFull(c.r, frame[len(hdr):]); err != nil {
+			return err
+		}
+		c.pending = frame
+		return nil
+	}
+
+	switch opcode {
+	case wsOpText, wsOpBinary:
+		if c.inMessage {
+			return c.fail(wsCloseProtocolError, "protocol", "new message before the last one finished")
+		}
+		if !c.allowMessage() {
+			return c.fail(wsClosePolicyViolation, "rate_limit", "message rate exceeded")
+		}
+		c.inMessage = true
+		c.inspecting = opcode == wsOpText && c.s.engine != nil
+		c.size = 0
+	case wsOpContinuation:
+		if !c.inMessage {
+			return c.fail(wsCloseProtocolError, "protocol", "continuation without a message")
+		}
+	default:
+		return c.fail(wsCloseProtocolError, "protocol", "unknown opcode")
+	}
+	if c.size += length; c.size > c.s.cfg.MaxMessageSize {
+		return c.fail(wsCloseTooBig, "message_size", "message too big")
+	}
+	c.inMessage = !fin
+
+	if !c.inspecting {
+		c.pending = hdr
+		c.remaining = length
+		return nil
+	}
+
+	start := len(c.held)
+	c.held = append(c.held, hdr...)
+	c.held = append(c.held, make([]byte, length)...)
+	payload := c.held[start+len(hdr):]
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	for i, b := range payload {
+		c.message = append(c.message, b^mask[i%4])
+	}
+	if !fin {
+		return nil
+	}
+
+	if engine := c.s.engine(); engine != nil {
+		if rule := engine.MatchMessage(c.message, c.s.challengePassed, c.s.skipRules); rule != nil {
+			logger.Warn("WebSocket message blocked by security rule", "client_ip", c.s.clientIP, "path", c.s.path, "rule", rule.Name)
+			return c.fail(wsClosePolicyViolation, "rule", "message blocked")
+		}
+	}
+	c.pending, c.held, c.message = c.held, nil, c.message[:0]
+	return nil
+}
+
+// allowMessage takes a token from the connection's message bucket.
+func (c *wsConn) allowMessage() bool {
+	rate := c.s.cfg.MessagesPerSecond
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if !c.lastMsg.IsZero() {
+		c.tokens = min(float64(c.s.cfg.Burst), c.tokens+now.Sub(c.lastMsg).Seconds()*rate)
+	}
+	c.lastMsg = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// fail tells the client why the connection is being closed and returns the
+// error that ends the copy to the upstream. The close frame may land in the
+// middle of an upstream frame being written, but the connection is going
+// away either way.
+func (c *wsConn) fail(code int, reason, text string) error {
+	wsClosed.Add(reason, 1)
+	if reason != "rule" {
+		logger.Warn("WebSocket connection closed", "client_ip", c.s.clientIP, "path", c.s.path, "reason", text)
+	}
+	c.writeClose(code, text)
+	return errWebSocketClosed
+}
+
+func (c *wsConn) writeClose(code int, text string) {
+	frame := []byte{0x80 | wsOpClose, byte(2 + len(text)), byte(code >> 8), byte(code)}
+	frame = append(frame, text...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(frame)
+}
+
+// checkIdle closes the connection once nothing has been sent either way for
+// the idle timeout.
+func (c *wsConn) checkIdle() {
+	idle := time.Since(time.Unix(0, c.lastActive.Load()))
+	if left := c.s.cfg.IdleTimeout - idle; left > 0 {
+		c.idle.Reset(left)
+		return
+	}
+	wsClosed.Add("idle", 1)
+	c.writeClose(wsCloseGoingAway, "idle timeout")
+	c.Close()
+}
@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/rules"
+	"github.com/yxorp/pkg/logger"
+)
+
+// echoUpstream accepts any upgrade and sends back whatever the client writes.
+func echoUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("upstream hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Extensions: " + r.Header.Get("Sec-WebSocket-Extensions") + "\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// wsDial upgrades a connection to srv and returns it with the handshake
+// response.
+func wsDial(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	return conn, br, resp
+}
+
+// wsFrame encodes a masked client frame.
+func wsFrame(opcode byte, fin bool, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readClose reads until the WAF's close frame and returns its code.
+func readClose(t *testing.T, br *bufio.Reader) int {
+	t.Helper()
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			t.Fatalf("no close frame: %v", err)
+		}
+		if b != 0x80|wsOpClose {
+			continue
+		}
+		n, _ := br.ReadByte()
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil || n < 2 {
+			t.Fatalf("short close frame: %v", err)
+		}
+		return int(binary.BigEndian.Uint16(payload))
+	}
+}
+
+func webSocketServer(t *testing.T, cfg config.WebSocketConfig, ruleCfg []config.SecurityRule) *httptest.Server {
+	t.Helper()
+	logger.Init()
+	upstream := echoUpstream(t)
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+
+	engine, err := rules.NewEngine(ruleCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebSocket(cfg, func() *rules.Engine { return engine })
+	handler := Chain(httputil.NewSingleHostReverseProxy(target), MetricsMiddleware, ws.Middleware, RequestLogger)
+
+	// Hijacked connections outlive srv.Close; wait for their handlers so
+	// they do not log into the next test
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(wg.Wait)
+	return srv
+}
+
+func TestWebSocket_PassThrough(t *testing.T) {
+	srv := webSocketServer(t, config.WebSocketConfig{}, nil)
+	conn, br, resp := wsDial(t, srv)
+	if resp.Header.Get("X-Extensions") != "permessage-deflate" {
+		t.Errorf("extensions removed without inspection: %q", resp.Header.Get("X-Extensions"))
+	}
+
+	frames := [][]byte{
+		wsFrame(wsOpText, true, []byte("hello")),
+		wsFrame(wsOpBinary, true, bytes.Repeat([]byte{7}, 70000)),
+		wsFrame(0x9, true, []byte("ping")),
+	}
+	for _, frame := range frames {
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(frame))
+		if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, frame) {
+			t.Fatalf("frame changed on the way through")
+		}
+	}
+}
+
+func TestWebSocket_Inspection(t *testing.T) {
+	ruleCfg := []config.SecurityRule{{Name: "sqli", Pattern: `(?i)drop\s+table`, Location: "websocket"}}
+	srv := webSocketServer(t, config.WebSocketConfig{Inspect: true}, ruleCfg)
+
+	conn, br, resp := wsDial(t, srv)
+	if ext := resp.Header.Get("X-Extensions"); ext != "" {
+		t.Errorf("compression offered to the upstream while inspecting: %q", ext)
+	}
+	clean := wsFrame(wsOpText, true, []byte("select 1"))
+	conn.Write(clean)
+	got := make([]byte, len(clean))
+	if _, err := io.ReadFull(br, got); err != nil || !bytes.Equal(got, clean) {
+		t.Fatalf("clean message not passed on: %v", err)
+	}
+
+	// The match spans two fragments, so neither reaches the upstream
+	conn.Write(wsFrame(wsOpText, false, []byte("x; DROP ")))
+	conn.Write(wsFrame(wsOpContinuation, true, []byte("TABLE users")))
+	if code := readClose(t, br); code != wsClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, wsClosePolicyViolation)
+	}
+
+	// Binary messages are not inspected
+	conn, br, _ = wsDial(t, srv)
+	binaryMsg := wsFrame(wsOpBinary, true, []byte("DROP TABLE users"))
+	conn.Write(binaryMsg)
+	got = make([]byte, len(binaryMsg))
+	if _, err := io.ReadFull(br, got); err != nil || !bytes.Equal(got, binaryMsg) {
+		t.Fatalf("binary message not passed on: %v", err)
+	}
+}
+
+func TestWebSocket_Limits(t *testing.T) {
+	t.Run("message size", func(t *testing.T) {
+		srv := webSocketServer(t, config.WebSocketConfig{MaxMessageSize: 16}, nil)
+		conn, br, _ := wsDial(t, srv)
+		conn.Write(wsFrame(wsOpText, false, []byte("0123456789")))
+		conn.Write(wsFrame(wsOpContinuation, true, []byte("0123456789")))
+		if code := readClose(t, br); code != wsCloseTooBig {
+			t.Errorf("close code = %d, want %d", code, wsCloseTooBig)
+		}
+	})
+
+	t.Run("message rate", func(t *testing.T) {
+		srv := webSocketServer(t, config.WebSocketConfig{MessagesPerSecond: 1, Burst: 2}, nil)
+		conn, br, _ := wsDial(t, srv)
+		for range 3 {
+			conn.Write(wsFrame(wsOpText, true, []byte("hi")))
+		}
+		if code := readClose(t, br); code != wsClosePolicyViolation {
+			t.Errorf("close code = %d, want %d", code, wsClosePolicyViolation)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		srv := webSocketServer(t, config.WebSocketConfig{IdleTimeout: 50 * time.Millisecond}, nil)
+		_, br, _ := wsDial(t, srv)
+		if code := readClose(t, br); code != wsCloseGoingAway {
+			t.Errorf("close code = %d, want %d", code, wsCloseGoingAway)
+		}
+	})
+
+	t.Run("unmasked frame", func(t *testing.T) {
+		srv := webSocketServer(t, config.WebSocketConfig{}, nil)
+		conn, br, _ := wsDial(t, srv)
+		conn.Write([]byte{0x80 | wsOpText, 2, 'h', 'i'})
+		if code := readClose(t, br); code != wsCloseProtocolError {
+			t.Errorf("close code = %d, want %d", code, wsCloseProtocolError)
+		}
+	})
+}
+
+func TestIsUpgrade(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	if IsUpgrade(r) {
+		t.Error("Upgrade without Connection: upgrade counted as an upgrade")
+	}
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	if !IsUpgrade(r) || !isWebSocket(r) {
+		t.Error("WebSocket upgrade not recognized")
+	}
+	r.Header.Set("Upgrade", "h2c")
+	if !IsUpgrade(r) || isWebSocket(r) {
+		t.Error("h2c upgrade taken for WebSocket")
+	}
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/middleware"
+)
+
+const (
+	// ringReplicas is the number of points per unit of weight on the hash ring.
+	ringReplicas = 100
+
+	// maglevTableSize is the Maglev lookup table size. It must be prime and
+	// much larger than the number of backends.
+	maglevTableSize = 65537
+)
+
+// exclusion marks backends that were chosen but could not take the request.
+// A nil exclusion excludes nothing.
+type exclusion []bool
+
+func (e exclusion) has(i int) bool {
+	return e != nil && e[i]
+}
+
+// balancer chooses the backend for a request. choose returns the index of a
+// backend that is alive and not in skip, or -1 when none is left.
+type balancer interface {
+	choose(r *http.Request, skip exclusion) int
+}
+
+// validateBalancer checks cfg without building a balancer.
+func validateBalancer(cfg config.BalancerConfig) error {
+	switch cfg.HashKey {
+	case "", "ip":
+	default:
+		if !strings.HasPrefix(cfg.HashKey, "header:") && !strings.HasPrefix(cfg.HashKey, "cookie:") {
+			return fmt.Errorf("invalid hash key %q", cfg.HashKey)
+		}
+	}
+	switch cfg.Strategy {
+	case "", "round_robin", "least_requests", "p2c_ewma", "random", "ring_hash", "maglev":
+		return nil
+	}
+	return fmt.Errorf("unknown balancing strategy %q", cfg.Strategy)
+}
+
+func newBalancer(cfg config.BalancerConfig, backends []*Backend) (balancer, error) {
+	if err := validateBalancer(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Strategy {
+	case "", "round_robin":
+		return &roundRobin{backends: backends, current: make([]int, len(backends))}, nil
+	case "least_requests":
+		return &leastRequests{backends: backends}, nil
+	case "p2c_ewma":
+		return &p2cEWMA{backends: backends}, nil
+	case "random":
+		return &weightedRandom{backends: backends}, nil
+	case "ring_hash":
+		return newRingHash(backends, cfg.HashKey), nil
+	case "maglev":
+		return newMaglev(backends, cfg.HashKey), nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", cfg.Strategy)
+}
+
+func usable(b *Backend, skip exclusion, i int) bool {
+	return !skip.has(i) && !b.Draining() && b.IsAlive()
+}
+
+// roundRobin is nginx's smooth weighted round robin: every pick adds each
+// backend's weight to its current value and takes the highest, which spreads
+// a heavy backend's turns evenly instead of sending them back to back.
+type roundRobin struct {
+	backends []*Backend
+	mu       sync.Mutex
+	current  []int
+}
+
+func (rr *roundRobin) choose(_ *http.Request, skip exclusion) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	best, total := -1, 0
+	for i, b := range rr.backends {
+		if !usable(b, skip, i) {
+			continue
+		}
+		w := b.Weight()
+		rr.current[i] += w
+		total += w
+		if best < 0 || rr.current[i] > rr.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		rr.current[best] -= total
+	}
+	return best
+}
+
+// leastRequests picks the backend with the fewest outstanding requests per
+// unit of weight. Ties go to whichever comes first from a random offset.
+type leastRequests struct {
+	backends []*Backend
+}
+
+func (lr *leastRequests) choose(_ *http.Request, skip exclusion) int {
+	n := len(lr.backends)
+	if n == 0 {
+		return -1
+	}
+	best, bestLoad := -1, 0.0
+	offset := rand.IntN(n)
+	for k := range n {
+		i := (offset + k) % n
+		b := lr.backends[i]
+		if !usable(b, skip, i) {
+			continue
+		}
+		load := float64(b.Outstanding()) / float64(b.Weight())
+		if best < 0 || load < bestLoad {
+			best, bestLoad = i, load
+		}
+	}
+	return best
+}
+
+// p2cEWMA compares two random backends and picks the one with the lower
+// expected cost: its latency EWMA scaled by its outstanding requests.
+type p2cEWMA struct {
+	backends []*Backend
+}
+
+func (p *p2cEWMA) cost(b *Backend) float64 {
+	return b.LatencyEWMA().Seconds() * float64(b.Outstanding()+1) / float64(b.Weight())
+}
+
+func (p *p2cEWMA) choose(_ *http.Request, skip exclusion) int {
+	count := 0
+	for i, b := range p.backends {
+		if usable(b, skip, i) {
+			count++
+		}
+	}
+	switch count {
+	case 0:
+		return -1
+	case 1:
+		for i, b := range p.backends {
+			if usable(b, skip, i) {
+				return i
+			}
+		}
+	}
+
+	// Pick two distinct usable backends by their rank among the usable ones
+	first := rand.IntN(count)
+	second := rand.IntN(count - 1)
+	if second >= first {
+		second++
+	}
+	a, c := -1, -1
+	rank := 0
+	for i, b := range p.backends {
+		if !usable(b, skip, i) {
+			continue
+		}
+		switch rank {
+		case first:
+			a = i
+		case second:
+			c = i
+		}
+		rank++
+	}
+	if p.cost(p.backends[c]) < p.cost(p.backends[a]) {
+		return c
+	}
+	return a
+}
+
+// weightedRandom picks a backend with probability proportional to its weight.
+type weightedRandom struct {
+	backends []*Backend
+}
+
+func (wr *weightedRandom) choose(_ *http.Request, skip exclusion) int {
+	// One pass, so weights changing underneath cannot skew the pick: each
+	// backend replaces the pick with probability weight / running total
+	best, total := -1, 0
+	for i, b := range wr.backends {
+		if !usable(b, skip, i) {
+			continue
+		}
+		w := b.Weight()
+		total += w
+		if rand.IntN(total) < w {
+			best = i
+		}
+	}
+	return best
+}
+
+// hashKey returns the request attribute consistent hashing is keyed on.
+func hashKey(r *http.Request, key string) string {
+	if name, ok := strings.CutPrefix(key, "header:"); ok {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	} else if name, ok := strings.CutPrefix(key, "cookie:"); ok {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return middleware.ClientIP(r)
+}
+
+// hash64 is 64-bit FNV-1a followed by the splitmix64 finalizer, which FNV
+// needs to spread short, similar keys such as IP addresses.
+func hash64(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+// ringHash places every backend on a hash ring ringReplicas times per unit of
+// weight. A request goes to the first usable backend clockwise from its key,
+// so removing a backend only moves the keys that mapped to it.
+type ringHash struct {
+	backends []*Backend
+	key      string
+	points   []ringPoint
+}
+
+func newRingHash(backends []*Backend, key string) *ringHash {
+	rh := &ringHash{backends: backends, key: key}
+	for i, b := range backends {
+		id := b.URL.String()
+		for r := range b.Weight() * ringReplicas {
+			rh.points = append(rh.points, ringPoint{hash: hash64(id + "#" + strconv.Itoa(r)), index: i})
+		}
+	}
+	slices.SortFunc(rh.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return rh
+}
+
+func (rh *ringHash) choose(r *http.Request, skip exclusion) int {
+	if len(rh.points) == 0 {
+		return -1
+	}
+	h := hash64(hashKey(r, rh.key))
+	start, _ := slices.BinarySearchFunc(rh.points, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for k := range len(rh.points) {
+		p := rh.points[(start+k)%len(rh.points)]
+		if usable(rh.backends[p.index], skip, p.index) {
+			return p.index
+		}
+	}
+	return -1
+}
+
+// maglev is Google's Maglev consistent hashing: a lookup table filled from
+// per-backend permutations gives an even spread and constant-time lookups.
+// Backends fill table slots in proportion to their weight.
+type maglev struct {
+	backends []*Backend
+	key      string
+	table    []int
+}
+
+func newMaglev(backends []*Backend, key string) *maglev {
+	m := &maglev{backends: backends, key: key}
+	if len(backends) == 0 {
+		return m
+	}
+
+	const size = maglevTableSize
+	offsets := make([]uint64, len(backends))
+	skips := make([]uint64, len(backends))
+	next := make([]uint64, len(backends))
+	for i, b := range backends {
+		id := b.URL.String()
+		offsets[i] = hash64(id) % size
+		skips[i] = hash64(id+"#skip")%(size-1) + 1
+	}
+
+	m.table = make([]int, size)
+	for i := range m.table {
+		m.table[i] = -1
+	}
+	for filled := 0; filled < size; {
+		for i, b := range backends {
+			for w := 0; w < b.Weight() && filled < size; w++ {
+				slot := (offsets[i] + next[i]*skips[i]) % size
+				for m.table[slot] >= 0 {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % size
+				}
+				m.table[slot] = i
+				next[i]++
+				filled++
+			}
+		}
+	}
+	return m
+}
+
+func (m *maglev) choose(r *http.Request, skip exclusion) int {
+	if len(m.table) == 0 {
+		return -1
+	}
+	h := hash64(hashKey(r, m.key))
+	// Probe onwards from the key's slot when its backend is unusable
+	for k := range uint64(len(m.table)) {
+		i := m.table[(h+k)%uint64(len(m.table))]
+		if usable(m.backends[i], skip, i) {
+			return i
+		}
+	}
+	return -1
+}
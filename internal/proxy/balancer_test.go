@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/middleware"
+	"github.com/yxorp/pkg/logger"
+)
+
+func testBackends(weights ...int) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, w := range weights {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		cb, _ := middleware.NewCircuitBreaker(config.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Minute}, nil)
+		backends[i] = &Backend{URL: u, Alive: true, CB: cb}
+		backends[i].setWeight(w)
+	}
+	return backends
+}
+
+func mustBalancer(t *testing.T, strategy string, backends []*Backend) balancer {
+	t.Helper()
+	b, err := newBalancer(config.BalancerConfig{Strategy: strategy}, backends)
+	if err != nil {
+		t.Fatalf("newBalancer(%s): %v", strategy, err)
+	}
+	return b
+}
+
+func TestRoundRobin_Smooth(t *testing.T) {
+	bal := mustBalancer(t, "round_robin", testBackends(5, 1, 1))
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var seq strings.Builder
+	for range 7 {
+		seq.WriteByte("abc"[bal.choose(req, nil)])
+	}
+	// nginx's smooth weighted round robin interleaves the heavy backend
+	if got := seq.String(); got != "aabacaa" {
+		t.Errorf("got sequence %s, want aabacaa", got)
+	}
+}
+
+func TestLeastRequests(t *testing.T) {
+	backends := testBackends(1, 2, 1)
+	backends[0].outstanding.Store(3)
+	backends[1].outstanding.Store(4) // 2 per unit of weight
+	backends[2].outstanding.Store(5)
+	bal := mustBalancer(t, "least_requests", backends)
+
+	if i := bal.choose(httptest.NewRequest("GET", "/", nil), nil); i != 1 {
+		t.Errorf("got backend %d, want 1", i)
+	}
+	backends[1].SetAlive(false)
+	if i := bal.choose(httptest.NewRequest("GET", "/", nil), nil); i != 0 {
+		t.Errorf("got backend %d after the best went down, want 0", i)
+	}
+}
+
+func TestP2CEWMA(t *testing.T) {
+	backends := testBackends(1, 1)
+	backends[0].observeLatency(500 * time.Millisecond)
+	backends[1].observeLatency(10 * time.Millisecond)
+	bal := mustBalancer(t, "p2c_ewma", backends)
+
+	for range 10 {
+		if i := bal.choose(httptest.NewRequest("GET", "/", nil), nil); i != 1 {
+			t.Fatalf("got backend %d, want the faster one", i)
+		}
+	}
+	if i := bal.choose(httptest.NewRequest("GET", "/", nil), exclusion{false, true}); i != 0 {
+		t.Errorf("got backend %d with the faster one excluded, want 0", i)
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	bal := mustBalancer(t, "random", testBackends(3, 1))
+	counts := make([]int, 2)
+	for range 4000 {
+		counts[bal.choose(httptest.NewRequest("GET", "/", nil), nil)]++
+	}
+	if counts[0] < 2700 || counts[0] > 3300 {
+		t.Errorf("expected about 3000 picks of the heavy backend, got %v", counts)
+	}
+}
+
+func TestConsistentHashing(t *testing.T) {
+	for _, strategy := range []string{"ring_hash", "maglev"} {
+		t.Run(strategy, func(t *testing.T) {
+			backends := testBackends(1, 1, 1)
+			bal, err := newBalancer(config.BalancerConfig{Strategy: strategy, HashKey: "header:X-User"}, backends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pick := func(user string) int {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-User", user)
+				return bal.choose(req, nil)
+			}
+
+			before := make(map[string]int)
+			counts := make([]int, len(backends))
+			for i := range 3000 {
+				user := fmt.Sprintf("user-%d", i)
+				before[user] = pick(user)
+				counts[before[user]]++
+			}
+			for i, c := range counts {
+				if c < 700 || c > 1300 {
+					t.Errorf("backend %d got %d of 3000 keys", i, c)
+				}
+			}
+			if pick("user-1") != before["user-1"] {
+				t.Error("expected the same key to map to the same backend")
+			}
+
+			// Only the keys of a backend that goes down move
+			backends[2].SetAlive(false)
+			for user, was := range before {
+				now := pick(user)
+				if was != 2 && now != was {
+					t.Fatalf("%s moved from %d to %d", user, was, now)
+				}
+				if now == 2 {
+					t.Fatalf("%s still mapped to the down backend", user)
+				}
+			}
+		})
+	}
+}
+
+func TestGetNextPeer_SkipsOpenCircuit(t *testing.T) {
+	logger.Init()
+	backends := testBackends(1, 1)
+	bal := mustBalancer(t, "round_robin", backends)
+	lb := &LoadBalancer{}
+	lb.state.Store(&poolState{backends: backends, balancer: bal})
+	backends[0].CB.RecordFailure() // threshold 1
+
+	for range 4 {
+		if peer := lb.GetNextPeer(httptest.NewRequest("GET", "/", nil)); peer != backends[1] {
+			t.Fatalf("got %v, want the backend with a closed circuit", peer.URL)
+		}
+	}
+	backends[1].SetAlive(false)
+	if peer := lb.GetNextPeer(httptest.NewRequest("GET", "/", nil)); peer != nil {
+		t.Errorf("got %v, want nil with no usable backend", peer.URL)
+	}
+}
+
+func TestNewBalancer_Invalid(t *testing.T) {
+	if _, err := newBalancer(config.BalancerConfig{Strategy: "fastest"}, nil); err == nil {
+		t.Error("expected error for an unknown strategy")
+	}
+	if _, err := newBalancer(config.BalancerConfig{Strategy: "ring_hash", HashKey: "query:id"}, nil); err == nil {
+		t.Error("expected error for an invalid hash key")
+	}
+}
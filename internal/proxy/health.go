@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+// maxHealthBody bounds how much of a health check response is read to match
+// Body and BodyRegex.
+const maxHealthBody = 64 * 1024
+
+// HealthStatus is the outcome of a backend's recent health checks.
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	Successes int       `json:"consecutive_successes"`
+	Failures  int       `json:"consecutive_failures"`
+}
+
+type statusRange struct {
+	lo, hi int
+}
+
+// parseStatusRanges parses "200", "200-299" or a comma-separated list of both.
+func parseStatusRanges(s string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected status %q", s)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || to < from {
+				return nil, fmt.Errorf("invalid expected status %q", s)
+			}
+		}
+		ranges = append(ranges, statusRange{from, to})
+	}
+	return ranges, nil
+}
+
+// healthChecker probes the backends of one pool.
+type healthChecker struct {
+	cfg       config.HealthCheckConfig
+	statuses  []statusRange
+	bodyRegex *regexp.Regexp
+	client    *http.Client
+}
+
+// newHealthChecker probes through transport, the pool's own, so checks see
+// the same TLS settings as requests. A nil transport uses the default one.
+func newHealthChecker(cfg config.HealthCheckConfig, transport http.RoundTripper) (*healthChecker, error) {
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+	if cfg.ExpectedStatus == "" {
+		cfg.ExpectedStatus = "200-399"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 2
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 3
+	}
+	if cfg.Scheme != "" && cfg.Scheme != "http" && cfg.Scheme != "https" {
+		return nil, fmt.Errorf("invalid health check scheme %q", cfg.Scheme)
+	}
+
+	hc := &healthChecker{cfg: cfg}
+	var err error
+	if hc.statuses, err = parseStatusRanges(cfg.ExpectedStatus); err != nil {
+		return nil, err
+	}
+	if cfg.BodyRegex != "" {
+		if hc.bodyRegex, err = regexp.Compile(cfg.BodyRegex); err != nil {
+			return nil, fmt.Errorf("invalid health check body_regex: %w", err)
+		}
+	}
+	hc.client = &http.Client{
+		Transport: transport,
+		// A redirect is the answer to check, not something to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return hc, nil
+}
+
+// probe checks one backend and returns why it is unhealthy, or nil.
+func (hc *healthChecker) probe(ctx context.Context, target *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.cfg.Timeout)
+	defer cancel()
+
+	if hc.cfg.Path == "" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", hostPort(target))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u := *target
+	if hc.cfg.Scheme != "" {
+		u.Scheme = hc.cfg.Scheme
+	}
+	u.Path, u.RawQuery, _ = strings.Cut(hc.cfg.Path, "?")
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, hc.cfg.Method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if hc.cfg.Host != "" {
+		req.Host = hc.cfg.Host
+	}
+	req.Header.Set("User-Agent", "yxorp-health-check")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	ok := false
+	for _, r := range hc.statuses {
+		if resp.StatusCode >= r.lo && resp.StatusCode <= r.hi {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if hc.cfg.Body == "" && hc.bodyRegex == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return err
+	}
+	if hc.cfg.Body != "" && !strings.Contains(string(body), hc.cfg.Body) {
+		return errors.New("response body does not contain the expected text")
+	}
+	if hc.bodyRegex != nil && !hc.bodyRegex.Match(body) {
+		return errors.New("response body does not match body_regex")
+	}
+	return nil
+}
+
+// hostPort returns the target's host with the scheme's default port added.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// recordCheck applies a probe result to the backend and reports whether the
+// backend changed between healthy and unhealthy.
+func (b *Backend) recordCheck(err error, healthyThreshold, unhealthyThreshold int) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.health.LastCheck = time.Now()
+	if err == nil {
+		b.health.LastError = ""
+		b.health.Successes++
+		b.health.Failures = 0
+		if !b.Alive && b.health.Successes >= healthyThreshold {
+			b.Alive = true
+			return true
+		}
+		return false
+	}
+
+	b.health.LastError = err.Error()
+	b.health.Failures++
+	b.health.Successes = 0
+	if b.Alive && b.health.Failures >= unhealthyThreshold {
+		b.Alive = false
+		return true
+	}
+	return false
+}
+
+// Health returns the backend's health check status.
+func (b *Backend) Health() HealthStatus {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	status := b.health
+	status.Healthy = b.Alive
+	return status
+}
+
+// HealthCheck probes every backend each interval, in parallel, and marks
+// them up or down once the thresholds are reached. It returns when the pool
+// is closed.
+func (lb *LoadBalancer) HealthCheck() {
+	for {
+		hc := lb.state.Load().health
+		var wg sync.WaitGroup
+		for _, b := range lb.state.Load().backends {
+			wg.Go(func() {
+				err := hc.probe(lb.ctx, b.URL)
+				if lb.ctx.Err() != nil || !b.recordCheck(err, hc.cfg.HealthyThreshold, hc.cfg.UnhealthyThreshold) {
+					return
+				}
+				if err != nil {
+					logger.Warn("Backend marked unhealthy", "pool", lb.name, "url", b.URL.String(), "error", err)
+				} else {
+					logger.Info("Backend marked healthy", "pool", lb.name, "url", b.URL.String())
+				}
+			})
+		}
+		wg.Wait()
+
+		t := time.NewTimer(hc.cfg.Interval)
+		select {
+		case <-t.C:
+		case <-lb.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+)
+
+func TestHealthChecker_Probe(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	var host atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"status":"up","db":"ok"}`))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name    string
+		cfg     config.HealthCheckConfig
+		status  int
+		healthy bool
+	}{
+		{"tcp", config.HealthCheckConfig{}, http.StatusServiceUnavailable, true},
+		{"http ok", config.HealthCheckConfig{Path: "/health"}, http.StatusOK, true},
+		{"http 503", config.HealthCheckConfig{Path: "/health"}, http.StatusServiceUnavailable, false},
+		{"status list", config.HealthCheckConfig{Path: "/health", ExpectedStatus: "200,204"}, http.StatusAccepted, false},
+		{"body", config.HealthCheckConfig{Path: "/health", Body: `"status":"up"`}, http.StatusOK, true},
+		{"body mismatch", config.HealthCheckConfig{Path: "/health", Body: "down"}, http.StatusOK, false},
+		{"body regex", config.HealthCheckConfig{Path: "/health", BodyRegex: `"db":"(ok|degraded)"`}, http.StatusOK, true},
+		{"wrong path", config.HealthCheckConfig{Path: "/status"}, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		hc, err := newHealthChecker(tt.cfg, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		status.Store(int64(tt.status))
+		if err := hc.probe(context.Background(), target); (err == nil) != tt.healthy {
+			t.Errorf("%s: got error %v, want healthy=%v", tt.name, err, tt.healthy)
+		}
+	}
+
+	hc, _ := newHealthChecker(config.HealthCheckConfig{Path: "/health", Host: "app.internal"}, nil)
+	hc.probe(context.Background(), target)
+	if got := host.Load(); got != "app.internal" {
+		t.Errorf("expected Host header app.internal, got %v", got)
+	}
+}
+
+func TestBackend_RecordCheck(t *testing.T) {
+	b := testBackends(1)[0]
+	down := context.DeadlineExceeded
+
+	// Two failures stay below the unhealthy threshold of three
+	b.recordCheck(down, 2, 3)
+	b.recordCheck(down, 2, 3)
+	if !b.IsAlive() {
+		t.Fatal("expected backend to stay healthy below the threshold")
+	}
+	if !b.recordCheck(down, 2, 3) || b.IsAlive() {
+		t.Fatal("expected backend to turn unhealthy")
+	}
+	if h := b.Health(); h.Failures != 3 || h.LastError == "" {
+		t.Errorf("unexpected health status %+v", h)
+	}
+
+	if b.recordCheck(nil, 2, 3) || b.IsAlive() {
+		t.Fatal("expected one success to be below the healthy threshold")
+	}
+	if !b.recordCheck(nil, 2, 3) || !b.IsAlive() {
+		t.Fatal("expected backend to recover")
+	}
+}
+
+func TestNewHealthChecker_Invalid(t *testing.T) {
+	for _, cfg := range []config.HealthCheckConfig{
+		{ExpectedStatus: "2xx"},
+		{ExpectedStatus: "299-200"},
+		{BodyRegex: "("},
+		{Scheme: "ftp"},
+	} {
+		if _, err := newHealthChecker(cfg, nil); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/route"
+	"github.com/yxorp/pkg/logger"
+)
+
+// DefaultPool is the name of the pool built from the top-level proxy targets.
+const DefaultPool = "default"
+
+var (
+	ErrUnknownPool   = errors.New("unknown upstream pool")
+	ErrUnknownTarget = errors.New("unknown upstream target")
+	ErrTargetExists  = errors.New("upstream target already exists")
+)
+
+// Pools holds the upstream pools and sends each request to the pool of the
+// route it matched.
+type Pools struct {
+	mu        sync.Mutex // serializes Update
+	pools     atomic.Pointer[map[string]*LoadBalancer]
+	observers []LatencyObserver
+}
+
+// NewPools builds every pool in cfg and checks that the routes only name
+// pools that exist.
+func NewPools(cfg config.ProxyConfig) (*Pools, error) {
+	p := &Pools{}
+	if err := p.Update(cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// poolConfigs returns the pools of cfg, with the top-level targets as the
+// default pool.
+func poolConfigs(cfg config.ProxyConfig) []config.PoolConfig {
+	if len(cfg.Targets) == 0 {
+		return cfg.Pools
+	}
+	return append([]config.PoolConfig{{Name: DefaultPool, Targets: cfg.Targets, Balancer: cfg.Balancer}}, cfg.Pools...)
+}
+
+// Update applies a new proxy configuration. Pools are matched by name and
+// updated in place (see LoadBalancer.Update), new pools are started, and
+// removed pools stop their health checks while requests already sent to them
+// finish. If any pool is invalid, nothing changes.
+func (p *Pools) Update(cfg config.ProxyConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.current()
+	next, updates, err := p.prepare(cfg, current)
+	if err != nil {
+		return err
+	}
+	p.commit(current, next, updates)
+	return nil
+}
+
+// Prepare does the work of Update that can fail, without changing anything
+// in use. The returned function switches to the result and cannot fail. The
+// pools must not be updated in between.
+func (p *Pools) Prepare(cfg config.ProxyConfig) (apply func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.current()
+	next, updates, err := p.prepare(cfg, current)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.commit(current, next, updates)
+	}, nil
+}
+
+func (p *Pools) current() map[string]*LoadBalancer {
+	if m := p.pools.Load(); m != nil {
+		return *m
+	}
+	return map[string]*LoadBalancer{}
+}
+
+// commit switches from the current pools to the prepared ones.
+func (p *Pools) commit(current, next map[string]*LoadBalancer, updates map[string]*poolUpdate) {
+	for name, lb := range next {
+		lb.mu.Lock()
+		lb.apply(updates[name])
+		lb.mu.Unlock()
+		if _, ok := current[name]; !ok {
+			lb.ctx, lb.cancel = context.WithCancel(context.Background())
+			go lb.HealthCheck()
+			if len(current) > 0 {
+				logger.Info("Upstream pool added", "pool", name)
+			}
+		}
+	}
+	p.pools.Store(&next)
+	for name, lb := range current {
+		if _, ok := next[name]; !ok {
+			lb.Close()
+			logger.Info("Upstream pool removed", "pool", name)
+		}
+	}
+}
+
+// prepare builds the next set of pools from cfg, reusing those in current by
+// name, and checks that the routes only name pools that exist.
+func (p *Pools) prepare(cfg config.ProxyConfig, current map[string]*LoadBalancer) (map[string]*LoadBalancer, map[string]*poolUpdate, error) {
+	next := make(map[string]*LoadBalancer)
+	updates := make(map[string]*poolUpdate)
+	for _, pc := range poolConfigs(cfg) {
+		if pc.Name == "" {
+			return nil, nil, errors.New("upstream pool needs a name")
+		}
+		if _, dup := next[pc.Name]; dup {
+			return nil, nil, fmt.Errorf("duplicate upstream pool %s", pc.Name)
+		}
+		lb, ok := current[pc.Name]
+		if !ok {
+			lb = &LoadBalancer{name: pc.Name, observers: slices.Clone(p.observers)}
+		}
+		u, err := lb.prepare(pc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pool %s: %w", pc.Name, err)
+		}
+		next[pc.Name] = lb
+		updates[pc.Name] = u
+	}
+
+	for i, rc := range cfg.Routes {
+		pool := rc.Pool
+		if pool == "" {
+			pool = DefaultPool
+		}
+		if _, ok := next[pool]; !ok {
+			return nil, nil, fmt.Errorf("route %d (%s) uses unknown pool %s", i+1, rc.Name, pool)
+		}
+	}
+	return next, updates, nil
+}
+
+// AddObserver registers o with every pool, including pools added later. It
+// must be called before the pools start serving traffic.
+func (p *Pools) AddObserver(o LatencyObserver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observers = append(p.observers, o)
+	for _, lb := range *p.pools.Load() {
+		lb.AddObserver(o)
+	}
+}
+
+// Pool returns the pool with the given name.
+func (p *Pools) Pool(name string) (*LoadBalancer, bool) {
+	lb, ok := (*p.pools.Load())[name]
+	return lb, ok
+}
+
+func (p *Pools) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := DefaultPool
+	if rt := route.FromContext(r.Context()); rt != nil && rt.Pool != "" {
+		name = rt.Pool
+	}
+	lb, ok := p.Pool(name)
+	if !ok {
+		logger.Warn("No upstream pool for request", "host", r.Host, "path", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	lb.ServeHTTP(w, r)
+}
+
+// Status returns the status of every pool, sorted by name.
+func (p *Pools) Status() []PoolStatus {
+	pools := *p.pools.Load()
+	status := make([]PoolStatus, 0, len(pools))
+	for _, lb := range pools {
+		status = append(status, lb.Status())
+	}
+	slices.SortFunc(status, func(a, b PoolStatus) int { return strings.Compare(a.Name, b.Name) })
+	return status
+}
+
+// SetDraining keeps a backend from new requests, or lets it take them again.
+// Drain state survives configuration updates but not restarts.
+func (p *Pools) SetDraining(pool, target string, draining bool) error {
+	lb, ok := p.Pool(pool)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPool, pool)
+	}
+	u, err := targetURL(target)
+	if err != nil {
+		return err
+	}
+	for _, b := range lb.state.Load().backends {
+		if b.URL.String() == u.String() {
+			b.SetDraining(draining)
+			logger.Info("Backend drain state changed", "pool", pool, "url", b.URL.String(), "draining", draining)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownTarget, target)
+}
+
+// EditTargets returns a copy of cfg with the targets of the named pool
+// replaced by edit's result. The default pool's targets are the top-level
+// ones when those are set. cfg itself is not modified.
+func EditTargets(cfg config.ProxyConfig, pool string, edit func([]config.Target) ([]config.Target, error)) (config.ProxyConfig, error) {
+	if pool == DefaultPool && len(cfg.Targets) > 0 {
+		targets, err := edit(slices.Clone(cfg.Targets))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Targets = targets
+		return cfg, nil
+	}
+	for i, pc := range cfg.Pools {
+		if pc.Name != pool {
+			continue
+		}
+		targets, err := edit(slices.Clone(pc.Targets))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Pools = slices.Clone(cfg.Pools)
+		cfg.Pools[i].Targets = targets
+		return cfg, nil
+	}
+	return cfg, fmt.Errorf("%w: %s", ErrUnknownPool, pool)
+}
+
+// TargetIndex returns the index of the target with the given URL, comparing
+// them the way pools do, or -1.
+func TargetIndex(targets []config.Target, target string) int {
+	want, err := targetURL(target)
+	if err != nil {
+		return -1
+	}
+	return slices.IndexFunc(targets, func(t config.Target) bool {
+		u, err := targetURL(t.URL)
+		return err == nil && u.String() == want.String()
+	})
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/middleware"
+	"github.com/yxorp/internal/route"
+	"github.com/yxorp/pkg/logger"
+)
+
+func namedUpstream(t *testing.T, name string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPools_Routing(t *testing.T) {
+	logger.Init()
+	web := namedUpstream(t, "web", 0)
+	api := namedUpstream(t, "api", 0)
+	slow := namedUpstream(t, "slow", time.Second)
+
+	cfg := config.ProxyConfig{
+		Targets: []config.Target{{URL: web.URL}},
+		Pools: []config.PoolConfig{
+			{Name: "api", Targets: []config.Target{{URL: api.URL}}, Balancer: config.BalancerConfig{Strategy: "least_requests"}},
+			{Name: "slow", Targets: []config.Target{{URL: slow.URL}}, Timeout: 50 * time.Millisecond},
+		},
+		Routes: []config.RouteConfig{
+			{Name: "api", Hosts: []string{"api.example.com"}, Pool: "api"},
+			{Name: "reports", Paths: []string{"/reports"}, Pool: "slow"},
+		},
+	}
+	pools, err := NewPools(cfg)
+	if err != nil {
+		t.Fatalf("NewPools: %v", err)
+	}
+	table, _ := route.NewTable(cfg.Routes)
+	handler := table.Middleware(pools)
+
+	tests := []struct {
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{"http://api.example.com/users", http.StatusOK, "api"},
+		{"http://www.example.com/", http.StatusOK, "web"},
+		{"http://www.example.com/reports/daily", http.StatusGatewayTimeout, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.url, nil))
+		if rec.Code != tt.wantStatus || (tt.wantBody != "" && rec.Body.String() != tt.wantBody) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.url, rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+		}
+	}
+}
+
+func TestNewPools_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ProxyConfig
+	}{
+		{"unknown pool", config.ProxyConfig{Routes: []config.RouteConfig{{Name: "r", Pool: "missing"}}}},
+		{"no default pool", config.ProxyConfig{Routes: []config.RouteConfig{{Name: "r"}}}},
+		{"duplicate pool", config.ProxyConfig{Pools: []config.PoolConfig{{Name: "a"}, {Name: "a"}}}},
+		{"unnamed pool", config.ProxyConfig{Pools: []config.PoolConfig{{}}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewPools(tt.cfg); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestPools_Update(t *testing.T) {
+	logger.Init()
+	web := namedUpstream(t, "web", 0)
+	api1 := namedUpstream(t, "api1", 0)
+	api2 := namedUpstream(t, "api2", 0)
+
+	cfg := config.ProxyConfig{
+		Targets: []config.Target{{URL: web.URL}},
+		Pools: []config.PoolConfig{{
+			Name:           "api",
+			Targets:        []config.Target{{URL: api1.URL}},
+			CircuitBreaker: config.CircuitBreakerConfig{ConsecutiveFailures: 1},
+		}},
+	}
+	pools, err := NewPools(cfg)
+	if err != nil {
+		t.Fatalf("NewPools: %v", err)
+	}
+	api, _ := pools.Pool("api")
+	kept := api.state.Load().backends[0]
+	kept.CB.RecordFailure()
+	kept.SetDraining(true)
+
+	// Add a target, reweight the existing one and move the routes to a new pool
+	cfg.Pools = []config.PoolConfig{
+		{Name: "api", Targets: []config.Target{{URL: api1.URL, Weight: 3}, {URL: api2.URL}}},
+		{Name: "v2", Targets: []config.Target{{URL: api2.URL}}},
+	}
+	cfg.Routes = []config.RouteConfig{{Name: "v2", Paths: []string{"/v2/"}, Pool: "v2"}}
+	if err := pools.Update(cfg); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if lb, _ := pools.Pool("api"); lb != api {
+		t.Fatal("expected the api pool to be updated in place")
+	}
+	backends := api.state.Load().backends
+	if len(backends) != 2 || backends[0] != kept {
+		t.Fatalf("expected the existing backend to be kept, got %v", backends)
+	}
+	if kept.Weight() != 3 || !kept.Draining() {
+		t.Errorf("expected weight 3 and drain state kept, got %d and %v", kept.Weight(), kept.Draining())
+	}
+	if state, _ := kept.CB.State(); state != middleware.StateOpen {
+		t.Errorf("expected the open circuit to be kept, got %v", state)
+	}
+
+	// The drained backend gets no new requests
+	for range 5 {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != "api2" {
+			t.Fatalf("expected the drained backend to be skipped, got %q", rec.Body.String())
+		}
+	}
+	if err := pools.SetDraining("api", api1.URL, false); err != nil {
+		t.Fatalf("SetDraining: %v", err)
+	}
+	if kept.Draining() {
+		t.Error("expected the backend to take requests again")
+	}
+	if err := pools.SetDraining("api", "http://10.9.9.9", true); !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("expected ErrUnknownTarget, got %v", err)
+	}
+
+	// Removing a pool stops its health checks
+	cfg.Pools = cfg.Pools[1:]
+	if err := pools.Update(cfg); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, ok := pools.Pool("api"); ok {
+		t.Error("expected the api pool to be removed")
+	}
+	if api.ctx.Err() == nil {
+		t.Error("expected the removed pool's health checks to stop")
+	}
+
+	// An invalid update changes nothing
+	v2, _ := pools.Pool("v2")
+	before := v2.state.Load()
+	bad := cfg
+	bad.Pools = []config.PoolConfig{{Name: "v2", Targets: []config.Target{{URL: web.URL}}, Balancer: config.BalancerConfig{Strategy: "fastest"}}}
+	if err := pools.Update(bad); err == nil {
+		t.Fatal("expected error for an invalid pool")
+	}
+	if v2.state.Load() != before {
+		t.Error("expected the failed update to leave the pool alone")
+	}
+
+	// Including the breakers of a valid pool listed before the invalid one
+	bad.Pools = []config.PoolConfig{
+		{Name: "v2", Targets: []config.Target{{URL: api2.URL}}, CircuitBreaker: config.CircuitBreakerConfig{IgnoreTimeouts: true}},
+		{Name: "broken", Targets: []config.Target{{URL: web.URL}}, CircuitBreaker: config.CircuitBreakerConfig{ErrorPercent: 150}},
+	}
+	if _, err := pools.Prepare(bad); err == nil {
+		t.Fatal("expected Prepare to reject an invalid breaker")
+	}
+	if err := pools.Update(bad); err == nil {
+		t.Fatal("expected error for an invalid breaker")
+	}
+	if !before.backends[0].CB.CountsTimeouts() {
+		t.Error("expected the failed update to leave the breaker settings alone")
+	}
+}
+
+func TestEditTargets(t *testing.T) {
+	cfg := config.ProxyConfig{
+		Targets: []config.Target{{URL: "http://10.0.0.1"}},
+		Pools:   []config.PoolConfig{{Name: "api", Targets: []config.Target{{URL: "10.0.1.1:9000"}}}},
+	}
+	add := func(targets []config.Target) ([]config.Target, error) {
+		return append(targets, config.Target{URL: "http://10.0.9.9"}), nil
+	}
+
+	got, err := EditTargets(cfg, DefaultPool, add)
+	if err != nil || len(got.Targets) != 2 || len(cfg.Targets) != 1 {
+		t.Fatalf("default pool: got %v, %v", got.Targets, err)
+	}
+	got, err = EditTargets(cfg, "api", add)
+	if err != nil || len(got.Pools[0].Targets) != 2 || len(cfg.Pools[0].Targets) != 1 {
+		t.Fatalf("api pool: got %v, %v", got.Pools, err)
+	}
+	if _, err := EditTargets(cfg, "missing", add); !errors.Is(err, ErrUnknownPool) {
+		t.Errorf("expected ErrUnknownPool, got %v", err)
+	}
+
+	if i := TargetIndex(cfg.Pools[0].Targets, "https://10.0.1.1:9000"); i != 0 {
+		t.Errorf("expected a scheme-less target to match its https URL, got %d", i)
+	}
+}
@@ -1,25 +1,69 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/yxorp/internal/config"
 	"github.com/yxorp/internal/middleware"
 	"github.com/yxorp/pkg/logger"
 )
 
+// ewmaWeight is how much each new latency sample moves a backend's EWMA.
+const ewmaWeight = 0.2
+
 type Backend struct {
 	URL   *url.URL
 	Proxy *httputil.ReverseProxy
 	Alive bool
 	CB    *middleware.CircuitBreaker
 	mux   sync.RWMutex
+
+	health      HealthStatus // guarded by mux
+	weight      atomic.Int64
+	draining    atomic.Bool
+	outstanding atomic.Int64
+	ewma        atomic.Uint64 // float64 bits, seconds
+}
+
+// Weight returns the backend's share of traffic relative to the others in
+// its pool.
+func (b *Backend) Weight() int {
+	return int(b.weight.Load())
+}
+
+func (b *Backend) setWeight(weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	b.weight.Store(int64(weight))
+}
+
+// Draining reports whether the backend is kept from new requests while the
+// ones in flight finish.
+func (b *Backend) Draining() bool {
+	return b.draining.Load()
+}
+
+func (b *Backend) SetDraining(draining bool) {
+	b.draining.Store(draining)
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -34,170 +78,597 @@ func (b *Backend) IsAlive() bool {
 	return b.Alive
 }
 
+// Outstanding returns the number of requests in flight to the backend.
+func (b *Backend) Outstanding() int64 {
+	return b.outstanding.Load()
+}
+
+// LatencyEWMA returns the exponentially weighted moving average of the
+// backend's response latency, or zero before the first response.
+func (b *Backend) LatencyEWMA() time.Duration {
+	return time.Duration(math.Float64frombits(b.ewma.Load()) * float64(time.Second))
+}
+
+func (b *Backend) observeLatency(latency time.Duration) {
+	sample := latency.Seconds()
+	for {
+		old := b.ewma.Load()
+		avg := math.Float64frombits(old)
+		if old == 0 {
+			avg = sample
+		} else {
+			avg += ewmaWeight * (sample - avg)
+		}
+		if b.ewma.CompareAndSwap(old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// LatencyObserver is notified of the latency and status code of every
+// request proxied to a backend.
+type LatencyObserver interface {
+	ObserveLatency(latency time.Duration, statusCode int)
+}
+
+// LoadBalancer spreads requests over the backends of one upstream pool.
 type LoadBalancer struct {
-	backends []*Backend
-	current  uint64
+	name      string
+	state     atomic.Pointer[poolState]
+	mu        sync.Mutex // serializes Update
+	ctx       context.Context
+	cancel    context.CancelFunc // stops the health checks
+	transport poolTransport      // shared by the backends and health checks
+	observers []LatencyObserver
+}
+
+// poolState is the configuration-derived part of a pool, replaced as a
+// whole on Update. Requests keep the state they started with.
+type poolState struct {
+	cfg       config.PoolConfig
+	backends  []*Backend
+	balancer  balancer
+	strategy  string
+	timeout   time.Duration
+	health    *healthChecker
+	retry     *retryPolicy
+	sticky    *affinity
+	transport *http.Transport
+}
+
+// poolUpdate is a validated pool configuration that has not been applied.
+type poolUpdate struct {
+	state   *poolState
+	weights []int
 }
 
-func NewLoadBalancer(targets []string) (*LoadBalancer, error) {
-	var backends []*Backend
+func NewLoadBalancer(cfg config.PoolConfig) (*LoadBalancer, error) {
+	lb := &LoadBalancer{name: cfg.Name}
+	u, err := lb.prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	lb.ctx, lb.cancel = context.WithCancel(context.Background())
+	lb.apply(u)
+
+	// Start health check
+	go lb.HealthCheck()
+
+	return lb, nil
+}
 
-	// Default CB settings: 5 failures, 30s timeout
-	// In a real app, pass these as config
-	cbThreshold := 5
-	cbTimeout := 30 * time.Second
+// Update applies a new pool configuration. Backends whose URL is still
+// listed are kept along with their circuit breaker, health, load and drain
+// state; requests in flight finish on the backends they started on.
+func (lb *LoadBalancer) Update(cfg config.PoolConfig) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	u, err := lb.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	lb.apply(u)
+	return nil
+}
 
-	for _, targetURL := range targets {
-		if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
-			// Assume HTTPS if no scheme provided, as it's safer/more common for modern web
-			targetURL = "https://" + targetURL
+// Close stops the pool's health checks and closes its idle upstream
+// connections. Requests in flight are not affected.
+func (lb *LoadBalancer) Close() {
+	lb.cancel()
+	if t := lb.transport.current.Load(); t != nil {
+		t.CloseIdleConnections()
+	}
+}
+
+// prepare validates cfg and builds the pool's next state without changing
+// anything in use.
+func (lb *LoadBalancer) prepare(cfg config.PoolConfig) (*poolUpdate, error) {
+	if err := validateBalancer(cfg.Balancer); err != nil {
+		return nil, err
+	}
+	if err := middleware.ValidateCircuitBreaker(cfg.CircuitBreaker); err != nil {
+		return nil, err
+	}
+	hc, err := newHealthChecker(cfg.HealthCheck, &lb.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := lb.state.Load()
+	existing := make(map[string]*Backend)
+	st := &poolState{cfg: cfg, timeout: cfg.Timeout, health: hc}
+	if prev != nil {
+		for _, b := range prev.backends {
+			existing[b.URL.String()] = b
+		}
+		// Keep the retry budget, the random cookie secret and the pooled
+		// connections when their settings are unchanged
+		if reflect.DeepEqual(prev.cfg.Retry, cfg.Retry) {
+			st.retry = prev.retry
+		}
+		if prev.cfg.Sticky == cfg.Sticky {
+			st.sticky = prev.sticky
+		}
+		if reflect.DeepEqual(prev.cfg.Transport, cfg.Transport) {
+			st.transport = prev.transport
+		}
+	}
+	if st.transport == nil {
+		if st.transport, err = newTransport(cfg.Transport); err != nil {
+			return nil, err
+		}
+	}
+	if st.retry == nil {
+		if st.retry, err = newRetryPolicy(cfg.Retry); err != nil {
+			return nil, err
 		}
+	}
+	if st.sticky == nil {
+		if st.sticky, err = newAffinity(cfg.Name, cfg.Sticky); err != nil {
+			return nil, err
+		}
+	}
 
-		target, err := url.Parse(targetURL)
+	u := &poolUpdate{state: st}
+	seen := make(map[string]bool)
+	for _, t := range cfg.Targets {
+		target, err := targetURL(t.URL)
 		if err != nil {
 			return nil, err
 		}
+		if seen[target.String()] {
+			return nil, fmt.Errorf("duplicate target %s", target)
+		}
+		seen[target.String()] = true
 
-		proxy := httputil.NewSingleHostReverseProxy(target)
-
-		// Customize Director
-		originalDirector := proxy.Director
-		proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			req.Host = target.Host
-			req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
-
-			// Forward all cookies and session headers
-			if cookie := req.Header.Get("Cookie"); cookie != "" {
-				req.Header.Set("Cookie", cookie)
+		b, ok := existing[target.String()]
+		if !ok {
+			if b, err = newBackend(cfg, target, &lb.transport); err != nil {
+				return nil, err
 			}
 		}
+		st.backends = append(st.backends, b)
+		u.weights = append(u.weights, t.Weight)
+	}
 
-		// ModifyResponse to check for 500 errors and trigger CB
-		proxy.ModifyResponse = func(resp *http.Response) error {
-			// This runs AFTER the request is sent to backend
-			// We can't easily access the specific backend struct here to call RecordFailure
-			// without complex context passing or closure.
-			// However, ServeHTTP below drives this.
-			// Actually, httputil.ReverseProxy doesn't return error on 500 status, it returns nil error and the response.
-			// So we can handle status codes in ServeHTTP wrapper or here.
-			// But since we have multiple backends, passing the CB into this closure is cleanest.
-			return nil
-		}
+	st.strategy = cfg.Balancer.Strategy
+	if st.strategy == "" {
+		st.strategy = "round_robin"
+	}
+	return u, nil
+}
 
-		cb := middleware.NewCircuitBreaker(cbThreshold, cbTimeout)
+// apply switches the pool to a prepared state.
+func (lb *LoadBalancer) apply(u *poolUpdate) {
+	st := u.state
+	for i, b := range st.backends {
+		b.setWeight(u.weights[i])
+		// prepare already validated the breaker settings
+		b.CB.Update(st.cfg.CircuitBreaker)
+	}
+	// validateBalancer already accepted the configuration
+	st.balancer, _ = newBalancer(st.cfg.Balancer, st.backends)
+	lb.transport.swap(st.transport)
+	lb.state.Store(st)
+}
 
-		backends = append(backends, &Backend{
-			URL:   target,
-			Proxy: proxy,
-			Alive: true,
-			CB:    cb,
-		})
+// targetURL parses a target, assuming HTTPS when it has no scheme.
+func targetURL(raw string) (*url.URL, error) {
+	if !strings.HasPrefix(raw, "http://") && !strings.HasPrefix(raw, "https://") {
+		// Assume HTTPS if no scheme provided, as it's safer/more common for modern web
+		raw = "https://" + raw
 	}
+	return url.Parse(raw)
+}
+
+func newBackend(cfg config.PoolConfig, target *url.URL, transport http.RoundTripper) (*Backend, error) {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	// Customize Director
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		req.Host = target.Host
+		req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 
-	lb := &LoadBalancer{
-		backends: backends,
+		// Forward all cookies and session headers
+		if cookie := req.Header.Get("Cookie"); cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
 	}
 
-	// Start health check
-	go lb.HealthCheck()
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if rw, ok := w.(*responseWriter); ok {
+			rw.err = err
+		}
+		if isTimeout(err) {
+			logger.Warn("Upstream request timed out", "url", target.String(), "path", req.URL.Path)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		logger.Error("Upstream request failed", "url", target.String(), "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 
-	return lb, nil
+	cb, err := middleware.NewCircuitBreaker(cfg.CircuitBreaker, func(from, to middleware.State) {
+		if to == middleware.StateOpen {
+			logger.Warn("Circuit breaker opened", "pool", cfg.Name, "url", target.String(), "from", from.String())
+			return
+		}
+		logger.Info("Circuit breaker state changed", "pool", cfg.Name, "url", target.String(), "from", from.String(), "to", to.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		URL:   target,
+		Proxy: proxy,
+		Alive: true,
+		CB:    cb,
+	}, nil
 }
 
-func (lb *LoadBalancer) NextIndex() int {
-	return int(atomic.AddUint64(&lb.current, 1) % uint64(len(lb.backends)))
+// AddObserver registers o to receive upstream latencies. It must be called
+// before the load balancer starts serving traffic.
+func (lb *LoadBalancer) AddObserver(o LatencyObserver) {
+	lb.observers = append(lb.observers, o)
 }
 
-func (lb *LoadBalancer) GetNextPeer() *Backend {
-	next := lb.NextIndex()
-	l := len(lb.backends) + next // start from next and loop
-	for i := next; i < l; i++ {
-		idx := i % len(lb.backends)
-		if lb.backends[idx].IsAlive() && lb.backends[idx].CB.AllowRequest() {
-			if i != next {
-				atomic.StoreUint64(&lb.current, uint64(idx))
-			}
-			return lb.backends[idx]
+// GetNextPeer returns the backend r is pinned to by the pool's affinity, or
+// else the one the balancing strategy picks. A backend whose circuit breaker
+// rejects the request is skipped and the choice made again.
+func (lb *LoadBalancer) GetNextPeer(r *http.Request) *Backend {
+	return lb.state.Load().nextPeer(r, nil)
+}
+
+// nextPeer is GetNextPeer without the backends in skip. Backends whose
+// circuit breaker rejects the request are added to skip when it is not nil.
+func (st *poolState) nextPeer(r *http.Request, skip exclusion) *Backend {
+	for range st.backends {
+		i := -1
+		if st.sticky != nil {
+			i = st.sticky.pick(r, st.backends, skip)
+		}
+		if i < 0 {
+			i = st.balancer.choose(r, skip)
+		}
+		if i < 0 {
+			return nil
 		}
+		if st.backends[i].CB.AllowRequest() {
+			return st.backends[i]
+		}
+		if skip == nil {
+			skip = make(exclusion, len(st.backends))
+		}
+		skip[i] = true
 	}
 	return nil
 }
 
+// untried reports whether a live backend outside tried, with a circuit that
+// would let the retry through, is left to retry on.
+func (st *poolState) untried(tried exclusion) bool {
+	for i, b := range st.backends {
+		if usable(b, tried, i) && b.CB.Ready() {
+			return true
+		}
+	}
+	return false
+}
+
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	peer := lb.GetNextPeer()
-	if peer != nil {
-		// Use a custom ResponseWriter to capture the status code
-		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		peer.Proxy.ServeHTTP(rw, r)
+	st := lb.state.Load()
+	// The timeout would cut upgraded connections short; the transport's
+	// response header timeout still bounds the upgrade itself
+	if st.timeout > 0 && !middleware.IsUpgrade(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), st.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
-		// Update Circuit Breaker based on response
-		// Note: httputil.ReverseProxy handles network errors by calling ErrorHandler (logging mostly)
-		// and returning 502. We need to catch that too.
-		// Ideally we wrap the ErrorHandler but for now checking status code is a good proxy.
-		if rw.statusCode >= 500 {
-			peer.CB.RecordFailure()
-		} else {
-			peer.CB.RecordSuccess()
+	// Buffer the body up front so a failed attempt can be replayed. gRPC
+	// streams are not: a streaming call may not end its body before it gets
+	// a response.
+	var body []byte
+	replayable := false
+	if st.retry.enabled() {
+		st.retry.budget.addRequest()
+		if !middleware.IsGRPC(r) {
+			body, replayable = st.retry.bufferBody(r)
+		}
+	}
+	retryAny := idempotent(r)
+
+	tried := make(exclusion, len(st.backends))
+	var last *responseWriter
+	for attempt := 0; ; attempt++ {
+		peer := st.nextPeer(r, tried)
+		if peer == nil {
+			break
+		}
+		tried[slices.Index(st.backends, peer)] = true
+
+		rw := newResponseWriter(w)
+		if st.sticky != nil {
+			st.sticky.stick(rw.Header(), r, peer)
+		}
+		if replayable && attempt < st.retry.cfg.MaxRetries && st.untried(tried) && st.retry.budget.available() {
+			rw.retryConnect = true
+			if retryAny {
+				rw.retryStatuses = st.retry.cfg.Statuses
+			}
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		}
+		lb.forward(peer, rw, r)
+		if !rw.discarded {
+			return
+		}
+
+		last = rw
+		if !st.retry.budget.spend() {
+			retryBudgetExhausted.Add(1)
+			break
 		}
+		if !st.retry.backoff(r.Context(), attempt+1) {
+			break
+		}
+		upstreamRetries.Add(1)
+		logger.Info("Retrying upstream request", "pool", lb.name, "url", peer.URL.String(), "status", rw.statusCode, "attempt", attempt+1)
+	}
+
+	if last != nil {
+		// No retry was possible after all; answer with the failed attempt
+		last.commitDiscarded()
 		return
 	}
 	// Log which backends are down
-	logger.Error("All backends unavailable")
-	for _, b := range lb.backends {
+	logger.Error("All backends unavailable", "pool", lb.name)
+	for _, b := range st.backends {
 		logger.Info("Backend status", "url", b.URL.String(), "alive", b.IsAlive())
 	}
 	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 }
 
-// Simple wrapper to capture status code
+// forward sends r to peer and feeds the outcome to the latency observers
+// and the peer's circuit breaker.
+func (lb *LoadBalancer) forward(peer *Backend, rw *responseWriter, r *http.Request) {
+	start := time.Now()
+	peer.outstanding.Add(1)
+	func() {
+		done := false
+		defer func() {
+			peer.outstanding.Add(-1)
+			if !done {
+				// The proxy aborted the response; give back a half-open probe slot
+				peer.CB.RecordCanceled()
+			}
+		}()
+		peer.Proxy.ServeHTTP(rw, r)
+		done = true
+	}()
+	// The lifetime of an upgraded connection says nothing about latency
+	if rw.statusCode != http.StatusSwitchingProtocols {
+		latency := time.Since(start)
+		peer.observeLatency(latency)
+		for _, o := range lb.observers {
+			o.ObserveLatency(latency, rw.statusCode)
+		}
+	}
+
+	// Update Circuit Breaker based on response. Transport errors reach
+	// ErrorHandler, which leaves them on rw.
+	switch {
+	case rw.err != nil && errors.Is(r.Context().Err(), context.Canceled):
+		// The client went away; that says nothing about the backend
+		peer.CB.RecordCanceled()
+	case rw.err != nil && isTimeout(rw.err) && !peer.CB.CountsTimeouts():
+		peer.CB.RecordCanceled()
+	case rw.err != nil, peer.CB.IsFailure(rw.statusCode):
+		peer.CB.RecordFailure()
+	case middleware.IsGRPC(r) && peer.CB.IsGRPCFailure(rw.grpcStatus()):
+		peer.CB.RecordFailure()
+	default:
+		peer.CB.RecordSuccess()
+	}
+}
+
+// maxDiscardedBody bounds how much of a discarded response is kept, so that
+// it can still be sent when the retry does not happen after all.
+const maxDiscardedBody = 64 << 10
+
+// responseWriter captures the status code and transport error of one
+// attempt. It keeps the response headers to itself until the status is
+// written, so that a response that is going to be retried — a status in
+// retryStatuses, or a connection failure when retryConnect is set — can be
+// discarded without reaching the client.
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	header        http.Header
+	statusCode    int
+	err           error
+	retryStatuses []int
+	retryConnect  bool
+	wroteHeader   bool
+	discarded     bool
+	body          []byte // of the discarded response, up to maxDiscardedBody
+	bodyLost      bool   // the discarded body was larger
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, header: w.Header().Clone(), statusCode: http.StatusOK}
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses such as 103 Early Hints pass straight through
+		maps.Copy(rw.ResponseWriter.Header(), rw.header)
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
 	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
-func (lb *LoadBalancer) HealthCheck() {
-	// Wait 3 seconds before first check to avoid race condition on startup
-	time.Sleep(3 * time.Second)
-
-	t := time.NewTicker(time.Second * 10)
-	for range t.C {
-		for _, b := range lb.backends {
-			alive := isBackendAlive(b.URL)
-			b.SetAlive(alive)
-			status := "healthy"
-			if !alive {
-				status = "down"
-				logger.Warn("Backend health check failed", "url", b.URL.String(), "status", status)
-			} else {
-				logger.Info("Backend health check", "url", b.URL.String(), "status", status)
-			}
-		}
+
+	retryable := rw.err != nil && !isTimeout(rw.err) && !errors.Is(rw.err, context.Canceled)
+	if slices.Contains(rw.retryStatuses, code) && (rw.err == nil || retryable) ||
+		rw.retryConnect && isConnectError(rw.err) {
+		rw.discarded = true
+		return
 	}
+	rw.commit()
+}
+
+// commit writes the status and headers to the client. Later header changes,
+// such as trailers, go straight to the client's header map.
+func (rw *responseWriter) commit() {
+	maps.Copy(rw.ResponseWriter.Header(), rw.header)
+	rw.header = rw.ResponseWriter.Header()
+	rw.ResponseWriter.WriteHeader(rw.statusCode)
 }
 
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
+// commitDiscarded sends a discarded response to the client after all. A
+// body too large to have been kept is left out.
+func (rw *responseWriter) commitDiscarded() {
+	rw.discarded = false
+	if rw.bodyLost {
+		rw.header.Del("Content-Length")
+		rw.header.Del("Content-Encoding")
+		rw.commit()
+		return
+	}
+	rw.commit()
+	rw.ResponseWriter.Write(rw.body)
+}
 
-	// Add default port if missing
-	host := u.Host
-	if u.Port() == "" {
-		if u.Scheme == "https" {
-			host = host + ":443"
-		} else if u.Scheme == "http" {
-			host = host + ":80"
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.discarded {
+		if len(rw.body)+len(b) > maxDiscardedBody {
+			rw.body, rw.bodyLost = nil, true
+		} else if !rw.bodyLost {
+			rw.body = append(rw.body, b...)
 		}
+		return len(b), nil
 	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through as the upstream sends them.
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.discarded {
+		http.NewResponseController(rw.ResponseWriter).Flush()
+	}
+}
 
-	conn, err := net.DialTimeout("tcp", host, timeout)
+// grpcStatus returns the grpc-status a gRPC call ended with, from the
+// trailers or, for a trailers-only response, the headers. It is -1 when the
+// upstream sent none.
+func (rw *responseWriter) grpcStatus() int {
+	v := rw.header.Get("Grpc-Status")
+	if v == "" {
+		v = rw.header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(v)
 	if err != nil {
-		return false
+		return -1
+	}
+	return code
+}
+
+// Hijack hands the client connection over for an upgraded protocol such as
+// WebSocket. The reverse proxy writes the 101 response on the connection
+// itself, with the headers set on rw.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.wroteHeader = true
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// isTimeout reports whether err is an upstream timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// BackendStatus describes a backend for the admin API.
+type BackendStatus struct {
+	URL          string       `json:"url"`
+	Weight       int          `json:"weight"`
+	Draining     bool         `json:"draining"`
+	Outstanding  int64        `json:"outstanding"`
+	LatencyEWMA  string       `json:"latency_ewma"`
+	Health       HealthStatus `json:"health"`
+	Circuit      string       `json:"circuit"`
+	CircuitSince time.Time    `json:"circuit_since"`
+}
+
+// PoolStatus describes a pool for the admin API.
+type PoolStatus struct {
+	Name     string          `json:"name"`
+	Strategy string          `json:"strategy"`
+	Sticky   string          `json:"sticky,omitempty"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+// Status returns the pool's backends and their health.
+func (lb *LoadBalancer) Status() PoolStatus {
+	st := lb.state.Load()
+	status := PoolStatus{Name: lb.name, Strategy: st.strategy, Backends: []BackendStatus{}}
+	if st.sticky != nil {
+		status.Sticky = st.sticky.mode
+	}
+	for _, b := range st.backends {
+		circuit, since := b.CB.State()
+		status.Backends = append(status.Backends, BackendStatus{
+			URL:          b.URL.String(),
+			Weight:       b.Weight(),
+			Draining:     b.Draining(),
+			Outstanding:  b.Outstanding(),
+			LatencyEWMA:  b.LatencyEWMA().String(),
+			Health:       b.Health(),
+			Circuit:      circuit.String(),
+			CircuitSince: since,
+		})
 	}
-	_ = conn.Close()
-	return true
+	return status
 }
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/middleware"
+	"github.com/yxorp/pkg/logger"
+)
+
+func TestLoadBalancer_CircuitBreaker(t *testing.T) {
+	logger.Init()
+	status := http.StatusServiceUnavailable
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+
+	newPool := func(cb config.CircuitBreakerConfig) *LoadBalancer {
+		lb, err := NewLoadBalancer(config.PoolConfig{
+			Name:           "api",
+			Targets:        []config.Target{{URL: upstream.URL}},
+			Timeout:        50 * time.Millisecond,
+			HealthCheck:    config.HealthCheckConfig{Interval: time.Hour},
+			CircuitBreaker: cb,
+		})
+		if err != nil {
+			t.Fatalf("NewLoadBalancer: %v", err)
+		}
+		return lb
+	}
+	serve := func(lb *LoadBalancer, path string) int {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	circuit := func(lb *LoadBalancer) string {
+		return lb.Status().Backends[0].Circuit
+	}
+
+	// 503 is not a failure when only 502 is listed
+	lb := newPool(config.CircuitBreakerConfig{ConsecutiveFailures: 2, FailureStatuses: []int{http.StatusBadGateway}})
+	for range 3 {
+		serve(lb, "/")
+	}
+	if got := circuit(lb); got != "closed" {
+		t.Fatalf("expected closed circuit, got %s", got)
+	}
+
+	// Timeouts are ignored on request and count otherwise
+	status = http.StatusOK
+	lb = newPool(config.CircuitBreakerConfig{ConsecutiveFailures: 2, IgnoreTimeouts: true})
+	for range 2 {
+		if code := serve(lb, "/slow"); code != http.StatusGatewayTimeout {
+			t.Fatalf("expected 504, got %d", code)
+		}
+	}
+	if got := circuit(lb); got != "closed" {
+		t.Fatalf("expected ignored timeouts to keep the circuit closed, got %s", got)
+	}
+
+	lb = newPool(config.CircuitBreakerConfig{ConsecutiveFailures: 2})
+	serve(lb, "/slow")
+	serve(lb, "/slow")
+	if got := circuit(lb); got != middleware.StateOpen.String() {
+		t.Fatalf("expected timeouts to open the circuit, got %s", got)
+	}
+	if code := serve(lb, "/"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with the circuit open, got %d", code)
+	}
+}
+
+type countingObserver struct{ n atomic.Int64 }
+
+func (o *countingObserver) ObserveLatency(time.Duration, int) { o.n.Add(1) }
+
+func TestLoadBalancer_Upgrade(t *testing.T) {
+	logger.Init()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("upstream hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer upstream.Close()
+
+	// The pool timeout must not cut the upgraded connection short
+	lb, err := NewLoadBalancer(config.PoolConfig{Name: "ws", Targets: []config.Target{{URL: upstream.URL}}, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	var obs countingObserver
+	lb.AddObserver(&obs)
+	srv := httptest.NewServer(lb)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := obs.n.Load(); n != 0 {
+		t.Errorf("upgraded connection fed %d latency samples", n)
+	}
+}
+
+// h2cServer starts a test server that speaks HTTP/2 without TLS.
+func h2cServer(h http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	return srv
+}
+
+func TestLoadBalancer_GRPC(t *testing.T) {
+	logger.Init()
+	var grpcStatus atomic.Value
+	grpcStatus.Store("0")
+	upstream := h2cServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("upstream got HTTP/%d, want HTTP/2", r.ProtoMajor)
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", grpcStatus.Load().(string))
+		w.Header().Set("Grpc-Message", "from upstream")
+	}))
+	defer upstream.Close()
+
+	lb, err := NewLoadBalancer(config.PoolConfig{
+		Name:           "grpc",
+		Targets:        []config.Target{{URL: upstream.URL}},
+		Transport:      config.TransportConfig{Protocol: "h2c"},
+		CircuitBreaker: config.CircuitBreakerConfig{ConsecutiveFailures: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	front := h2cServer(middleware.GRPCMiddleware(lb))
+	defer front.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	client.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+	call := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, front.URL+"/echo.v1.Echo/Say", strings.NewReader("\x00\x00\x00\x00\x00"))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := call()
+	if resp.ProtoMajor != 2 || resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "from upstream" {
+		t.Fatalf("got HTTP/%d with trailers %v", resp.ProtoMajor, resp.Trailer)
+	}
+	if state, _ := lb.state.Load().backends[0].CB.State(); state != middleware.StateClosed {
+		t.Fatalf("circuit %v after a successful call", state)
+	}
+
+	// UNAVAILABLE counts as a failure although the HTTP status is 200
+	grpcStatus.Store("14")
+	call()
+	call()
+	if state, _ := lb.state.Load().backends[0].CB.State(); state != middleware.StateOpen {
+		t.Fatalf("circuit %v after two UNAVAILABLE calls, want open", state)
+	}
+	resp = call()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "14" {
+		t.Errorf("open circuit: status %d, grpc-status %q, want a trailers-only UNAVAILABLE", resp.StatusCode, resp.Header.Get("Grpc-Status"))
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yxorp/internal/config"
+)
+
+const (
+	// retryBudgetSlots is the resolution of the retry budget window: counts
+	// age out one second at a time.
+	retryBudgetSlots = 10
+)
+
+var (
+	upstreamRetries      = expvar.NewInt("upstream_retries")
+	retryBudgetExhausted = expvar.NewInt("retry_budget_exhausted")
+)
+
+type budgetSlot struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// retryBudget caps retries at a share of the requests seen recently, so a
+// struggling pool is not hit with extra traffic on top of its failures.
+type retryBudget struct {
+	percent float64
+	min     int
+
+	mu    sync.Mutex
+	slots [retryBudgetSlots]budgetSlot
+}
+
+// slot returns the slot for now, resetting it when it last held an older
+// second. Callers must hold b.mu.
+func (b *retryBudget) slot(now int64) *budgetSlot {
+	s := &b.slots[now%retryBudgetSlots]
+	if s.second != now {
+		*s = budgetSlot{second: now}
+	}
+	return s
+}
+
+// totals returns the requests and retries within the window. Callers must
+// hold b.mu.
+func (b *retryBudget) totals(now int64) (requests, retries int) {
+	for _, s := range b.slots {
+		if now-s.second < retryBudgetSlots {
+			requests += s.requests
+			retries += s.retries
+		}
+	}
+	return requests, retries
+}
+
+func (b *retryBudget) addRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.slot(time.Now().Unix()).requests++
+}
+
+func (b *retryBudget) allowedLocked(now int64) bool {
+	requests, retries := b.totals(now)
+	return retries < b.min || float64(retries) < b.percent*float64(requests)/100
+}
+
+// available reports whether a retry would fit in the budget right now.
+func (b *retryBudget) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allowedLocked(time.Now().Unix())
+}
+
+// spend takes one retry from the budget, or reports false when none is left.
+func (b *retryBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().Unix()
+	if !b.allowedLocked(now) {
+		return false
+	}
+	b.slot(now).retries++
+	return true
+}
+
+// retryPolicy decides whether and when a pool sends a request again.
+type retryPolicy struct {
+	cfg    config.RetryConfig
+	budget *retryBudget
+}
+
+func newRetryPolicy(cfg config.RetryConfig) (*retryPolicy, error) {
+	if cfg.BudgetPercent < 0 || cfg.BudgetPercent > 100 {
+		return nil, fmt.Errorf("retry budget_percent %v is not between 0 and 100", cfg.BudgetPercent)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 2
+	}
+	if len(cfg.Statuses) == 0 {
+		cfg.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	}
+	if cfg.BudgetPercent == 0 {
+		cfg.BudgetPercent = 20
+	}
+	if cfg.MinRetries <= 0 {
+		cfg.MinRetries = 10
+	}
+	if cfg.BackoffBase <= 0 {
+		cfg.BackoffBase = 25 * time.Millisecond
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = 250 * time.Millisecond
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = 64 * 1024
+	}
+	return &retryPolicy{
+		cfg:    cfg,
+		budget: &retryBudget{percent: cfg.BudgetPercent, min: cfg.MinRetries},
+	}, nil
+}
+
+func (p *retryPolicy) enabled() bool {
+	return p.cfg.MaxRetries > 0
+}
+
+// idempotent reports whether r can safely be sent twice.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isConnectError reports whether err means no connection to the target was
+// made, so the request never reached it.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// bufferBody reads r's body so it can be replayed and reports whether it
+// fits within the limit. A body over the limit is left readable in full
+// for a single attempt.
+func (p *retryPolicy) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > p.cfg.MaxBodySize {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, p.cfg.MaxBodySize+1))
+	if err != nil || int64(len(body)) > p.cfg.MaxBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// backoff waits a random time before the given retry (1 for the first) and
+// reports false if ctx ended first.
+func (p *retryPolicy) backoff(ctx context.Context, retry int) bool {
+	ceiling := p.cfg.BackoffBase
+	for i := 1; i < retry && ceiling < p.cfg.BackoffMax; i++ {
+		ceiling *= 2
+	}
+	t := time.NewTimer(rand.N(min(ceiling, p.cfg.BackoffMax)) + 1)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func retryPool(t *testing.T, retry config.RetryConfig, urls ...string) *LoadBalancer {
+	t.Helper()
+	var targets []config.Target
+	for _, u := range urls {
+		targets = append(targets, config.Target{URL: u})
+	}
+	retry.BackoffBase = time.Millisecond
+	lb, err := NewLoadBalancer(config.PoolConfig{
+		Name:        "api",
+		Targets:     targets,
+		HealthCheck: config.HealthCheckConfig{Interval: time.Hour},
+		// Keep the failing backend in rotation for the whole test
+		CircuitBreaker: config.CircuitBreakerConfig{ConsecutiveFailures: -1},
+		Retry:          retry,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	return lb
+}
+
+func TestLoadBalancer_Retry(t *testing.T) {
+	logger.Init()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "overloaded")
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "ok "+string(body))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	serve := func(lb *LoadBalancer, method, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec
+	}
+
+	lb := retryPool(t, config.RetryConfig{MinRetries: 100}, failing.URL, healthy.URL)
+	for range 10 {
+		rec := serve(lb, "GET", "", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok " || rec.Header().Get("Retry-After") != "" {
+			t.Fatalf("GET: got %d %q with headers %v, want the healthy backend's response", rec.Code, rec.Body, rec.Header())
+		}
+	}
+
+	// POST is only retried with an idempotency key
+	saw503 := false
+	for range 10 {
+		if serve(lb, "POST", "x", nil).Code == http.StatusServiceUnavailable {
+			saw503 = true
+		}
+		if rec := serve(lb, "POST", "order", http.Header{"Idempotency-Key": {"k1"}}); rec.Body.String() != "ok order" {
+			t.Fatalf("POST with Idempotency-Key: got %d %q", rec.Code, rec.Body)
+		}
+	}
+	if !saw503 {
+		t.Error("expected a plain POST to reach the failing backend without a retry")
+	}
+
+	// Any method is retried when the connection fails, with its body replayed
+	lb = retryPool(t, config.RetryConfig{MinRetries: 100}, down.URL, healthy.URL)
+	for range 10 {
+		if rec := serve(lb, "POST", "payload", nil); rec.Body.String() != "ok payload" {
+			t.Fatalf("POST after connect failure: got %d %q", rec.Code, rec.Body)
+		}
+	}
+
+	// Bodies over the limit are not buffered, so not retried
+	lb = retryPool(t, config.RetryConfig{MinRetries: 100, MaxBodySize: 4}, down.URL, healthy.URL)
+	failed := 0
+	for range 10 {
+		rec := serve(lb, "POST", "payload", nil)
+		switch {
+		case rec.Code == http.StatusBadGateway:
+			failed++
+		case rec.Body.String() != "ok payload":
+			t.Fatalf("large POST: got %d %q", rec.Code, rec.Body)
+		}
+	}
+	if failed == 0 {
+		t.Error("expected large bodies to go without retries")
+	}
+
+	// Retries disabled
+	lb = retryPool(t, config.RetryConfig{MaxRetries: -1}, failing.URL, healthy.URL)
+	saw503 = false
+	for range 4 {
+		if rec := serve(lb, "GET", "", nil); rec.Code == http.StatusServiceUnavailable {
+			saw503 = rec.Body.String() == "overloaded"
+		}
+	}
+	if !saw503 {
+		t.Error("expected the upstream 503 to pass through with retries off")
+	}
+}
+
+func TestLoadBalancer_RetryBudgetExhausted(t *testing.T) {
+	logger.Init()
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	a, b := httptest.NewServer(failing), httptest.NewServer(failing)
+	defer a.Close()
+	defer b.Close()
+
+	lb := retryPool(t, config.RetryConfig{MaxRetries: 5, MinRetries: 1, BudgetPercent: 1}, a.URL, b.URL)
+	for i := range 4 {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		// Once the budget is spent, failures pass straight through
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "5" {
+			t.Fatalf("request %d: got %d with headers %v", i, rec.Code, rec.Header())
+		}
+	}
+	if _, retries := lb.state.Load().retry.budget.totals(time.Now().Unix()); retries != 1 {
+		t.Errorf("expected the budget to allow 1 retry, got %d", retries)
+	}
+}
+
+func TestLoadBalancer_RetrySkipsOpenCircuit(t *testing.T) {
+	logger.Init()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "overloaded")
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer healthy.Close()
+
+	lb := retryPool(t, config.RetryConfig{MinRetries: 100}, failing.URL, healthy.URL)
+	for _, b := range lb.state.Load().backends {
+		if b.URL.String() == healthy.URL {
+			b.CB.Update(config.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour})
+			b.CB.RecordFailure()
+		}
+	}
+	for range 4 {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "overloaded" {
+			t.Fatalf("got %d %q, want the upstream 503 with its body", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestResponseWriter_CommitDiscarded(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := newResponseWriter(rec)
+	rw.retryStatuses = []int{http.StatusServiceUnavailable}
+	rw.Header().Set("Content-Length", "10")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(rw, "overloaded")
+	if !rw.discarded || rec.Body.Len() != 0 {
+		t.Fatal("expected the response to be held back")
+	}
+	rw.commitDiscarded()
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "overloaded" || rec.Header().Get("Content-Length") != "10" {
+		t.Errorf("got %d %q with headers %v, want the held back response", rec.Code, rec.Body, rec.Header())
+	}
+
+	// A body too large to keep is dropped along with its length
+	rec = httptest.NewRecorder()
+	rw = newResponseWriter(rec)
+	rw.retryStatuses = []int{http.StatusServiceUnavailable}
+	rw.Header().Set("Content-Length", strconv.Itoa(maxDiscardedBody+1))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write(make([]byte, maxDiscardedBody))
+	rw.Write([]byte("x"))
+	rw.commitDiscarded()
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "" {
+		t.Errorf("got a %d byte body with headers %v, want none", rec.Body.Len(), rec.Header())
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{percent: 20, min: 2}
+	for range 20 {
+		b.addRequest()
+	}
+	spent := 0
+	for b.spend() {
+		spent++
+	}
+	if spent != 4 {
+		t.Errorf("expected 20%% of 20 requests = 4 retries, got %d", spent)
+	}
+
+	b = &retryBudget{percent: 20, min: 2}
+	if !b.spend() || !b.spend() || b.spend() {
+		t.Error("expected exactly min retries without traffic")
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+const defaultAffinityCookie = "waf_affinity"
+
+// affinity pins clients to a backend. See config.StickyConfig.
+type affinity struct {
+	pool   string
+	mode   string
+	name   string
+	secret []byte
+	maxAge int
+}
+
+// newAffinity returns nil when stickiness is off.
+func newAffinity(pool string, cfg config.StickyConfig) (*affinity, error) {
+	a := &affinity{pool: pool, mode: cfg.Mode, name: cfg.Name, secret: []byte(cfg.Secret), maxAge: int(cfg.TTL.Seconds())}
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case "cookie":
+		if a.name == "" {
+			a.name = defaultAffinityCookie
+		}
+		if len(a.secret) == 0 {
+			a.secret = make([]byte, 32)
+			rand.Read(a.secret)
+			logger.Info("No sticky cookie secret configured, affinity will not survive a restart", "pool", pool)
+		}
+	case "app_cookie", "header":
+		if a.name == "" {
+			return nil, fmt.Errorf("sticky mode %s needs a name", cfg.Mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sticky mode %q", cfg.Mode)
+	}
+	if a.mode == "header" {
+		a.name = http.CanonicalHeaderKey(a.name)
+	}
+	return a, nil
+}
+
+// backendID names a backend in affinity cookies without revealing its
+// address.
+func backendID(b *Backend) string {
+	return strconv.FormatUint(hash64(b.URL.String()), 36)
+}
+
+func (a *affinity) sign(id string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(a.pool))
+	mac.Write([]byte{0})
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// cookieBackend returns the backend ID from a valid affinity cookie.
+func (a *affinity) cookieBackend(r *http.Request) (string, error) {
+	c, err := r.Cookie(a.name)
+	if err != nil {
+		return "", err
+	}
+	id, mac, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(a.sign(id))) {
+		return "", errors.New("invalid affinity cookie")
+	}
+	return id, nil
+}
+
+// pick returns the usable backend r is pinned to, or -1 when r carries no
+// affinity or its backend cannot take the request.
+func (a *affinity) pick(r *http.Request, backends []*Backend, skip exclusion) int {
+	switch a.mode {
+	case "cookie":
+		id, err := a.cookieBackend(r)
+		if err != nil {
+			return -1
+		}
+		for i, b := range backends {
+			if backendID(b) == id && usable(b, skip, i) {
+				return i
+			}
+		}
+		return -1
+	case "app_cookie":
+		if c, err := r.Cookie(a.name); err == nil && c.Value != "" {
+			return rendezvous(c.Value, backends, skip)
+		}
+	case "header":
+		if v := r.Header.Get(a.name); v != "" {
+			return rendezvous(v, backends, skip)
+		}
+	}
+	return -1
+}
+
+// stick sets the affinity cookie on h when r is not pinned to b already.
+func (a *affinity) stick(h http.Header, r *http.Request, b *Backend) {
+	if a.mode != "cookie" {
+		return
+	}
+	id := backendID(b)
+	if current, err := a.cookieBackend(r); err == nil && current == id {
+		return
+	}
+	c := &http.Cookie{
+		Name:     a.name,
+		Value:    id + "." + a.sign(id),
+		Path:     "/",
+		MaxAge:   a.maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	h.Add("Set-Cookie", c.String())
+}
+
+// rendezvous is weighted highest-random-weight hashing: every usable
+// backend scores the key and the highest score wins, so a key only moves
+// when its backend goes away and comes back to it afterwards.
+func rendezvous(key string, backends []*Backend, skip exclusion) int {
+	best, bestScore := -1, 0.0
+	for i, b := range backends {
+		if !usable(b, skip, i) {
+			continue
+		}
+		// Map the hash to (0, 1) and weight it: -w / ln(u)
+		u := (float64(hash64(key+"#"+b.URL.String())>>11) + 0.5) / (1 << 53)
+		score := -float64(b.Weight()) / math.Log(u)
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
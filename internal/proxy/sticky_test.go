@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func stickyPool(t *testing.T, sticky config.StickyConfig) *LoadBalancer {
+	t.Helper()
+	var targets []config.Target
+	for i := range 3 {
+		srv := namedUpstream(t, fmt.Sprintf("app%d", i), 0)
+		targets = append(targets, config.Target{URL: srv.URL})
+	}
+	lb, err := NewLoadBalancer(config.PoolConfig{
+		Name:        "legacy",
+		Targets:     targets,
+		HealthCheck: config.HealthCheckConfig{Interval: time.Hour},
+		Sticky:      sticky,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	return lb
+}
+
+func backendByName(lb *LoadBalancer, name string) *Backend {
+	for i, b := range lb.state.Load().backends {
+		if fmt.Sprintf("app%d", i) == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func TestSticky_Cookie(t *testing.T) {
+	logger.Init()
+	lb := stickyPool(t, config.StickyConfig{Mode: "cookie", Secret: "s3cret", TTL: time.Hour})
+
+	serve := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		var set *http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == defaultAffinityCookie {
+				set = c
+			}
+		}
+		return rec.Body.String(), set
+	}
+
+	first, cookie := serve(nil)
+	if cookie == nil || cookie.MaxAge != 3600 || !cookie.HttpOnly {
+		t.Fatalf("expected an affinity cookie, got %+v", cookie)
+	}
+	for range 10 {
+		got, set := serve(cookie)
+		if got != first {
+			t.Fatalf("pinned to %s, got %s", first, got)
+		}
+		if set != nil {
+			t.Fatal("expected no new cookie while the pin holds")
+		}
+	}
+
+	// A forged cookie is ignored and replaced
+	forged := &http.Cookie{Name: defaultAffinityCookie, Value: backendID(backendByName(lb, first)) + ".00"}
+	if _, set := serve(forged); set == nil {
+		t.Error("expected a forged cookie to be replaced")
+	}
+
+	// The pin moves when its backend goes down
+	backendByName(lb, first).SetAlive(false)
+	moved, set := serve(cookie)
+	if moved == first || set == nil {
+		t.Fatalf("expected a new backend and cookie, got %s and %v", moved, set)
+	}
+	for range 5 {
+		if got, _ := serve(set); got != moved {
+			t.Fatalf("pinned to %s, got %s", moved, got)
+		}
+	}
+}
+
+func TestSticky_Header(t *testing.T) {
+	logger.Init()
+	lb := stickyPool(t, config.StickyConfig{Mode: "header", Name: "x-session-id"})
+
+	serve := func(session string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session-ID", session)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Header().Get("Set-Cookie") != "" {
+			t.Fatal("expected no cookie in header mode")
+		}
+		return rec.Body.String()
+	}
+
+	pinned := make(map[string]string)
+	used := make(map[string]bool)
+	for i := range 30 {
+		session := fmt.Sprintf("session-%d", i)
+		pinned[session] = serve(session)
+		used[pinned[session]] = true
+		for range 3 {
+			if got := serve(session); got != pinned[session] {
+				t.Fatalf("%s: pinned to %s, got %s", session, pinned[session], got)
+			}
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("expected sessions on all 3 backends, got %v", used)
+	}
+
+	// Only the sessions of the failed backend move
+	backendByName(lb, "app1").SetAlive(false)
+	for session, was := range pinned {
+		got := serve(session)
+		if was != "app1" && got != was {
+			t.Errorf("%s moved from %s to %s", session, was, got)
+		}
+		if got == "app1" {
+			t.Errorf("%s still on the down backend", session)
+		}
+	}
+}
+
+func TestNewAffinity_Invalid(t *testing.T) {
+	for _, cfg := range []config.StickyConfig{
+		{Mode: "ip"},
+		{Mode: "app_cookie"},
+		{Mode: "header"},
+	} {
+		if _, err := newAffinity("p", cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxorp/internal/config"
+)
+
+// poolTransport is the round tripper shared by a pool's backends and health
+// checks. Updates swap the transport underneath without touching the
+// reverse proxies that use it.
+type poolTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (pt *poolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return pt.current.Load().RoundTrip(r)
+}
+
+// swap switches to t and closes the idle connections of the transport it
+// replaces. Requests in flight on the old transport finish normally.
+func (pt *poolTransport) swap(t *http.Transport) {
+	if old := pt.current.Swap(t); old != nil && old != t {
+		old.CloseIdleConnections()
+	}
+}
+
+func newTransport(cfg config.TransportConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	if dialer.Timeout <= 0 {
+		dialer.Timeout = 30 * time.Second
+	}
+	if dialer.KeepAlive == 0 {
+		// As in http.DefaultTransport; net.Dialer alone would use 15s
+		dialer.KeepAlive = 30 * time.Second
+	}
+	t.DialContext = dialer.DialContext
+
+	if cfg.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.DisableKeepAlives = cfg.DisableKeepAlives
+
+	t.Protocols = new(http.Protocols)
+	switch cfg.Protocol {
+	case "":
+		t.Protocols.SetHTTP1(true)
+		t.Protocols.SetHTTP2(true)
+	case "http1":
+		t.Protocols.SetHTTP1(true)
+	case "http2":
+		t.Protocols.SetHTTP2(true)
+	case "h2c":
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol %q", cfg.Protocol)
+	}
+
+	tlsCfg, err := upstreamTLS(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsCfg
+	return t, nil
+}
+
+// upstreamTLS builds the client TLS configuration for a pool.
+func upstreamTLS(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.PinnedSHA256) > 0 {
+		var pins [][]byte
+		for _, p := range cfg.PinnedSHA256 {
+			pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256/"))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid certificate pin %q", p)
+			}
+			pins = append(pins, pin)
+		}
+		// VerifyConnection runs after the chain is verified, and also when
+		// verification is skipped, so pins hold either way
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.ContainsFunc(pins, func(pin []byte) bool { return string(pin) == string(sum[:]) }) {
+					return nil
+				}
+			}
+			return errors.New("upstream certificate matches no pinned key")
+		}
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+// writePEM writes blocks of the given type to a file in dir.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serverCA writes the certificate of a TLS test server to a CA file.
+func serverCA(t *testing.T, srv *httptest.Server) string {
+	return writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+}
+
+func serverPin(srv *httptest.Server) string {
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func get(t *testing.T, cfg config.TransportConfig, url string) (*http.Response, error) {
+	t.Helper()
+	tr, err := newTransport(cfg)
+	if err != nil {
+		t.Fatalf("newTransport: %v", err)
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestNewTransport_Invalid(t *testing.T) {
+	tests := map[string]config.TransportConfig{
+		"protocol": {Protocol: "spdy"},
+		"ca file":  {TLS: config.UpstreamTLSConfig{CAFile: "/nonexistent/ca.pem"}},
+		"pin":      {TLS: config.UpstreamTLSConfig{PinnedSHA256: []string{"c2hvcnQ="}}},
+		"key pair": {TLS: config.UpstreamTLSConfig{CertFile: "/nonexistent/cert.pem"}},
+	}
+	for name, cfg := range tests {
+		if _, err := newTransport(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestNewTransport_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca := serverCA(t, srv)
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name string
+		tls  config.UpstreamTLSConfig
+		ok   bool
+	}{
+		{"system roots", config.UpstreamTLSConfig{}, false},
+		{"ca file", config.UpstreamTLSConfig{CAFile: ca}, true},
+		{"server name", config.UpstreamTLSConfig{CAFile: ca, ServerName: "example.com"}, true},
+		{"wrong server name", config.UpstreamTLSConfig{CAFile: ca, ServerName: "other.test"}, false},
+		{"skip verify", config.UpstreamTLSConfig{InsecureSkipVerify: true}, true},
+		{"pin", config.UpstreamTLSConfig{CAFile: ca, PinnedSHA256: []string{wrongPin, serverPin(srv)}}, true},
+		{"wrong pin", config.UpstreamTLSConfig{CAFile: ca, PinnedSHA256: []string{wrongPin}}, false},
+		{"wrong pin skip verify", config.UpstreamTLSConfig{InsecureSkipVerify: true, PinnedSHA256: []string{wrongPin}}, false},
+		{"pin skip verify", config.UpstreamTLSConfig{InsecureSkipVerify: true, PinnedSHA256: []string{serverPin(srv)}}, true},
+	}
+	for _, tt := range tests {
+		_, err := get(t, config.TransportConfig{TLS: tt.tls}, srv.URL)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestNewTransport_ClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, "client-key.pem", "PRIVATE KEY", keyDER)
+
+	clientCert, _ := x509.ParseCertificate(der)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	ca := serverCA(t, srv)
+
+	if _, err := get(t, config.TransportConfig{TLS: config.UpstreamTLSConfig{CAFile: ca}}, srv.URL); err == nil {
+		t.Error("expected the handshake to fail without a client certificate")
+	}
+	cfg := config.TransportConfig{TLS: config.UpstreamTLSConfig{CAFile: ca, CertFile: certFile, KeyFile: keyFile}}
+	if _, err := get(t, cfg, srv.URL); err != nil {
+		t.Errorf("with client certificate: %v", err)
+	}
+}
+
+func TestNewTransport_Protocol(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	ca := serverCA(t, srv)
+
+	tests := map[string]int{"": 2, "http1": 1, "http2": 2}
+	for protocol, want := range tests {
+		resp, err := get(t, config.TransportConfig{Protocol: protocol, TLS: config.UpstreamTLSConfig{CAFile: ca}}, srv.URL)
+		if err != nil {
+			t.Errorf("%q: %v", protocol, err)
+			continue
+		}
+		if resp.ProtoMajor != want {
+			t.Errorf("%q: got HTTP/%d, want HTTP/%d", protocol, resp.ProtoMajor, want)
+		}
+	}
+}
+
+func TestLoadBalancer_UpdateTransport(t *testing.T) {
+	logger.Init()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := config.PoolConfig{Name: "tls", Targets: []config.Target{{URL: srv.URL}}}
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+	if code := serve(); code != http.StatusBadGateway {
+		t.Fatalf("untrusted upstream: got %d, want 502", code)
+	}
+
+	cfg.Transport.TLS.CAFile = serverCA(t, srv)
+	if err := lb.Update(cfg); err != nil {
+		t.Fatal(err)
+	}
+	before := lb.transport.current.Load()
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("trusted upstream: got %d, want 200", code)
+	}
+
+	cfg.Timeout = time.Minute
+	if err := lb.Update(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if lb.transport.current.Load() != before {
+		t.Error("transport replaced although its settings did not change")
+	}
+
+	cfg.Transport.TLS.CAFile = "/nonexistent/ca.pem"
+	if err := lb.Update(cfg); err == nil {
+		t.Error("expected an invalid transport to be rejected")
+	}
+	if lb.transport.current.Load() != before {
+		t.Error("rejected update replaced the transport")
+	}
+}
@@ -0,0 +1,350 @@
+// Package quota enforces daily and monthly request quotas per API key. Usage
+// counters survive restarts and reset on calendar boundaries.
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+const (
+	Daily   = "daily"
+	Monthly = "monthly"
+)
+
+type limit struct {
+	name   string
+	keys   map[string]bool // nil applies to every key
+	period string
+	max    int64
+}
+
+func (l *limit) appliesTo(apiKey string) bool {
+	return l.keys == nil || l.keys[apiKey]
+}
+
+type counterKey struct {
+	limit string
+	key   string
+}
+
+type counter struct {
+	used  int64
+	start time.Time // start of the period the count belongs to
+}
+
+// Usage reports the consumption of one quota by one API key.
+type Usage struct {
+	Key      string    `json:"key"`
+	Limit    string    `json:"limit"`
+	Period   string    `json:"period"`
+	Used     int64     `json:"used"`
+	Max      int64     `json:"max"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// Manager tracks quota usage and persists it to disk.
+type Manager struct {
+	mu       sync.Mutex
+	enabled  bool
+	header   string
+	loc      *time.Location
+	limits   []*limit
+	counters map[counterKey]*counter
+	dirty    map[counterKey]int64 // deltas not yet written to the log
+	store    *store
+	now      func() time.Time
+	done     chan struct{}
+}
+
+func NewManager(cfg config.QuotaConfig) (*Manager, error) {
+	m := &Manager{
+		enabled:  cfg.Enabled,
+		header:   cfg.Header,
+		loc:      time.UTC,
+		counters: make(map[counterKey]*counter),
+		dirty:    make(map[counterKey]int64),
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+	if m.header == "" {
+		m.header = "X-API-Key"
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota timezone: %w", err)
+		}
+		m.loc = loc
+	}
+
+	for _, l := range cfg.Limits {
+		if l.Period != Daily && l.Period != Monthly {
+			return nil, fmt.Errorf("invalid period %q for quota %s", l.Period, l.Name)
+		}
+		ql := &limit{name: l.Name, period: l.Period, max: l.Limit}
+		if len(l.Keys) > 0 {
+			ql.keys = make(map[string]bool, len(l.Keys))
+			for _, k := range l.Keys {
+				ql.keys[k] = true
+			}
+		}
+		m.limits = append(m.limits, ql)
+	}
+
+	if !m.enabled {
+		return m, nil
+	}
+
+	dir := cfg.DataDir
+	if dir == "" {
+		dir = "data/quota"
+	}
+	st, err := openStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.load(m.counters); err != nil {
+		st.close()
+		return nil, fmt.Errorf("failed to load quota state: %w", err)
+	}
+	m.store = st
+
+	interval := cfg.SnapshotInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go m.persist(interval)
+
+	return m, nil
+}
+
+// persist flushes the append log every second and writes a full snapshot
+// every interval.
+func (m *Manager) persist(interval time.Duration) {
+	flush := time.NewTicker(time.Second)
+	snapshot := time.NewTicker(interval)
+	defer flush.Stop()
+	defer snapshot.Stop()
+
+	for {
+		select {
+		case <-flush.C:
+			m.mu.Lock()
+			if err := m.flushLocked(); err != nil {
+				logger.Error("Failed to write quota log", "error", err)
+			}
+			m.mu.Unlock()
+		case <-snapshot.C:
+			m.mu.Lock()
+			if err := m.snapshotLocked(); err != nil {
+				logger.Error("Failed to write quota snapshot", "error", err)
+			}
+			m.mu.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) flushLocked() error {
+	for k, delta := range m.dirty {
+		c := m.counters[k]
+		if c == nil {
+			continue
+		}
+		if err := m.store.append(record{Limit: k.limit, Key: k.key, Start: c.start.Unix(), Delta: delta}); err != nil {
+			return err
+		}
+	}
+	clear(m.dirty)
+	return m.store.flush()
+}
+
+// snapshotLocked persists every counter, which makes pending log deltas
+// redundant.
+func (m *Manager) snapshotLocked() error {
+	if err := m.store.snapshot(m.counters); err != nil {
+		return err
+	}
+	clear(m.dirty)
+	return nil
+}
+
+// periodBounds returns the calendar period of the given kind containing t.
+func (m *Manager) periodBounds(period string, t time.Time) (time.Time, time.Time) {
+	t = t.In(m.loc)
+	if period == Monthly {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, m.loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, m.loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// current returns the counter for the running period, resetting it if the
+// stored one belongs to an earlier period. Callers must hold m.mu.
+func (m *Manager) current(l *limit, apiKey string, now time.Time) (*counter, time.Time) {
+	start, end := m.periodBounds(l.period, now)
+	k := counterKey{l.name, apiKey}
+	c, ok := m.counters[k]
+	if !ok || !c.start.Equal(start) {
+		c = &counter{start: start}
+		m.counters[k] = c
+		delete(m.dirty, k)
+	}
+	return c, end
+}
+
+// Allow consumes one request from every quota that applies to apiKey. If any
+// quota is exhausted nothing is consumed and ok is false. The returned Usage
+// is the quota closest to exhaustion.
+func (m *Manager) Allow(apiKey string) (tightest *Usage, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var applied []*counter
+	var keys []counterKey
+	for _, l := range m.limits {
+		if !l.appliesTo(apiKey) {
+			continue
+		}
+		c, end := m.current(l, apiKey, now)
+		u := &Usage{Key: apiKey, Limit: l.name, Period: l.period, Used: c.used, Max: l.max, ResetsAt: end}
+		if c.used >= l.max {
+			return u, false
+		}
+		if tightest == nil || l.max-c.used < tightest.Max-tightest.Used {
+			tightest = u
+		}
+		applied = append(applied, c)
+		keys = append(keys, counterKey{l.name, apiKey})
+	}
+
+	for i, c := range applied {
+		c.used++
+		m.dirty[keys[i]]++
+	}
+	if tightest != nil {
+		tightest.Used++
+	}
+	return tightest, true
+}
+
+// Usage returns the current usage of every tracked counter, optionally
+// filtered by API key.
+func (m *Manager) Usage(apiKey string) []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var usage []Usage
+	for _, l := range m.limits {
+		for k, c := range m.counters {
+			if k.limit != l.name || (apiKey != "" && k.key != apiKey) {
+				continue
+			}
+			start, end := m.periodBounds(l.period, now)
+			used := c.used
+			if !c.start.Equal(start) {
+				used = 0
+			}
+			usage = append(usage, Usage{Key: k.key, Limit: l.name, Period: l.period, Used: used, Max: l.max, ResetsAt: end})
+		}
+	}
+	sort.Slice(usage, func(a, b int) bool {
+		if usage[a].Key != usage[b].Key {
+			return usage[a].Key < usage[b].Key
+		}
+		return usage[a].Limit < usage[b].Limit
+	})
+	return usage
+}
+
+// Reset clears the usage of apiKey for the named quota, or for all quotas
+// when limitName is empty. It returns the number of counters cleared.
+func (m *Manager) Reset(apiKey, limitName string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for k := range m.counters {
+		if k.key != apiKey || (limitName != "" && k.limit != limitName) {
+			continue
+		}
+		delete(m.counters, k)
+		delete(m.dirty, k)
+		if m.store != nil {
+			if err := m.store.append(record{Limit: k.limit, Key: k.key, Reset: true}); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	if m.store != nil && n > 0 {
+		if err := m.store.flush(); err != nil {
+			return n, err
+		}
+	}
+	logger.Info("Quota usage reset", "key", apiKey, "limit", limitName, "counters", n)
+	return n, nil
+}
+
+// Close writes a final snapshot and closes the log.
+func (m *Manager) Close() error {
+	if m.store == nil {
+		return nil
+	}
+	close(m.done)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.snapshotLocked(); err != nil {
+		m.store.close()
+		return err
+	}
+	return m.store.close()
+}
+
+func setHeaders(w http.ResponseWriter, u *Usage) {
+	remaining := u.Max - u.Used
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-Quota-Limit", strconv.FormatInt(u.Max, 10))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(u.ResetsAt.Unix(), 10))
+}
+
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get(m.header)
+		if !m.enabled || apiKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		usage, ok := m.Allow(apiKey)
+		if usage != nil {
+			setHeaders(w, usage)
+		}
+		if !ok {
+			logger.Warn("Quota exceeded", "limit", usage.Limit, "period", usage.Period)
+			retry := int64(time.Until(usage.ResetsAt).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+			http.Error(w, "Quota Exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
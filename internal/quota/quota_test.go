@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/pkg/logger"
+)
+
+func newTestManager(t *testing.T, dir string, now time.Time) *Manager {
+	t.Helper()
+	m, err := NewManager(config.QuotaConfig{
+		Enabled: true,
+		DataDir: dir,
+		Limits: []config.QuotaLimit{
+			{Name: "daily", Period: Daily, Limit: 2},
+			{Name: "monthly", Period: Monthly, Limit: 3},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	m.now = func() time.Time { return now }
+	return m
+}
+
+func TestManager_Middleware(t *testing.T) {
+	logger.Init()
+
+	m := newTestManager(t, t.TempDir(), time.Now())
+	defer m.Close()
+
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	makeRequest := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := makeRequest("partner")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Quota-Remaining"); got != "1" {
+		t.Errorf("expected 1 remaining on the daily quota, got %q", got)
+	}
+
+	makeRequest("partner")
+	if rec := makeRequest("partner"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected %d once the daily quota is used, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec := makeRequest(""); rec.Code != http.StatusOK {
+		t.Errorf("expected requests without an API key to pass, got %d", rec.Code)
+	}
+}
+
+func TestManager_CalendarReset(t *testing.T) {
+	day := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	m := newTestManager(t, t.TempDir(), day)
+	defer m.Close()
+
+	m.Allow("partner")
+	m.Allow("partner")
+	if _, ok := m.Allow("partner"); ok {
+		t.Fatal("expected daily quota to be exhausted")
+	}
+
+	// A new day resets the daily quota, and a new month the monthly one
+	m.now = func() time.Time { return day.Add(2 * time.Hour) }
+	if _, ok := m.Allow("partner"); !ok {
+		t.Error("expected daily quota to reset at midnight")
+	}
+	for _, u := range m.Usage("partner") {
+		if u.Limit == "monthly" && u.Used != 1 {
+			t.Errorf("expected monthly usage to restart in April, got %d", u.Used)
+		}
+	}
+}
+
+func TestManager_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// Snapshot the first request and leave the second only in the log, then
+	// stop without the final snapshot Close would write
+	m := newTestManager(t, dir, now)
+	m.Allow("partner")
+	m.mu.Lock()
+	if err := m.snapshotLocked(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	m.mu.Unlock()
+	m.Allow("partner")
+	m.mu.Lock()
+	if err := m.flushLocked(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	m.mu.Unlock()
+	close(m.done)
+	m.store.close()
+
+	restarted := newTestManager(t, dir, now)
+	defer restarted.Close()
+	for _, u := range restarted.Usage("partner") {
+		if u.Used != 2 {
+			t.Errorf("expected %s usage of 2 after restart, got %d", u.Limit, u.Used)
+		}
+	}
+	if _, ok := restarted.Allow("partner"); ok {
+		t.Error("expected usage from before the restart to count against the daily quota")
+	}
+
+	if n, err := restarted.Reset("partner", ""); err != nil || n != 2 {
+		t.Fatalf("expected 2 counters reset, got %d (%v)", n, err)
+	}
+	if _, ok := restarted.Allow("partner"); !ok {
+		t.Error("expected quota to be available after reset")
+	}
+}
@@ -0,0 +1,148 @@
+package quota
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotFile = "quota.snapshot"
+	logFile      = "quota.log"
+)
+
+// record is one line of the append log. It either adds Delta to a counter
+// for the period starting at Start, or (with Reset set) clears the counter.
+type record struct {
+	Limit string `json:"l"`
+	Key   string `json:"k"`
+	Start int64  `json:"s,omitempty"`
+	Delta int64  `json:"d,omitempty"`
+	Reset bool   `json:"r,omitempty"`
+}
+
+// snapshotEntry is the persisted form of a counter.
+type snapshotEntry struct {
+	Limit string `json:"limit"`
+	Key   string `json:"key"`
+	Start int64  `json:"start"`
+	Used  int64  `json:"used"`
+}
+
+// store persists counters as a periodic snapshot plus an append log of the
+// changes made since. Loading replays the log on top of the snapshot.
+type store struct {
+	dir string
+	log *os.File
+	w   *bufio.Writer
+}
+
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &store{dir: dir, log: f, w: bufio.NewWriter(f)}, nil
+}
+
+// load reads the snapshot and replays the log into counters.
+func (s *store) load(counters map[counterKey]*counter) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		var entries []snapshotEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			counters[counterKey{e.Limit, e.Key}] = &counter{used: e.Used, start: time.Unix(e.Start, 0)}
+		}
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, logFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A torn final line from a crash only loses that last write
+				return nil
+			}
+			return err
+		}
+		key := counterKey{rec.Limit, rec.Key}
+		if rec.Reset {
+			delete(counters, key)
+			continue
+		}
+		start := time.Unix(rec.Start, 0)
+		c, ok := counters[key]
+		if !ok || start.After(c.start) {
+			counters[key] = &counter{used: rec.Delta, start: start}
+		} else if start.Equal(c.start) {
+			c.used += rec.Delta
+		}
+	}
+}
+
+func (s *store) append(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+func (s *store) flush() error {
+	return s.w.Flush()
+}
+
+// snapshot atomically replaces the snapshot with counters and truncates the
+// log, whose changes are now part of the snapshot.
+func (s *store) snapshot(counters map[counterKey]*counter) error {
+	entries := make([]snapshotEntry, 0, len(counters))
+	for k, c := range counters {
+		entries = append(entries, snapshotEntry{Limit: k.limit, Key: k.key, Start: c.start.Unix(), Used: c.used})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// Drop anything still buffered; it is included in the snapshot
+	s.w.Reset(s.log)
+	return s.log.Truncate(0)
+}
+
+func (s *store) close() error {
+	if err := s.flush(); err != nil {
+		s.log.Close()
+		return err
+	}
+	return s.log.Close()
+}
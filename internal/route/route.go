@@ -0,0 +1,188 @@
+// Package route matches requests against the routing table that decides
+// which upstream pool serves them and which security policy applies.
+package route
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yxorp/internal/config"
+)
+
+// Route is a compiled routing table entry.
+type Route struct {
+	Name     string
+	Pool     string
+	Security config.RouteSecurity
+	Cache    config.RouteCache
+
+	hosts     []string
+	paths     []string
+	pathRegex *regexp.Regexp
+	methods   []string
+	headers   map[string]*regexp.Regexp
+}
+
+// Table is an ordered list of routes. The first matching route wins.
+type Table struct {
+	routes atomic.Pointer[[]*Route]
+}
+
+func NewTable(cfg []config.RouteConfig) (*Table, error) {
+	var routes []*Route
+	for i, rc := range cfg {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("route-%d", i+1)
+		}
+		rt := &Route{
+			Name:     name,
+			Pool:     rc.Pool,
+			Security: rc.Security,
+			Cache:    rc.Cache,
+			paths:    rc.Paths,
+			methods:  rc.Methods,
+		}
+		for _, h := range rc.Hosts {
+			rt.hosts = append(rt.hosts, strings.ToLower(h))
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path_regex for route %s: %w", name, err)
+			}
+			rt.pathRegex = re
+		}
+		for header, pattern := range rc.Headers {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for header %s in route %s: %w", header, name, err)
+			}
+			if rt.headers == nil {
+				rt.headers = make(map[string]*regexp.Regexp)
+			}
+			rt.headers[http.CanonicalHeaderKey(header)] = re
+		}
+		routes = append(routes, rt)
+	}
+	t := &Table{}
+	t.routes.Store(&routes)
+	return t, nil
+}
+
+// Replace switches t to the routes of other, so a reloaded table takes effect
+// in middleware already built from t.
+func (t *Table) Replace(other *Table) {
+	t.routes.Store(other.routes.Load())
+}
+
+// Routes returns the routes in match order.
+func (t *Table) Routes() []*Route {
+	return *t.routes.Load()
+}
+
+// Match returns the first route matching r, or nil. Paths are matched in
+// their cleaned form, so dot segments cannot step out of a route.
+func (t *Table) Match(r *http.Request) *Route {
+	host := requestHost(r)
+	p := cleanPath(r.URL.Path)
+	for _, rt := range t.Routes() {
+		if rt.matches(r, host, p) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// requestHost returns the lower-cased request host without port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// cleanPath returns p without dot segments and repeated slashes, keeping a
+// trailing slash. Paths that are not rooted, like "*", are left alone.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// HasPathPrefix reports whether prefix covers p on a segment boundary, so
+// "/api" matches "/api" and "/api/users" but not "/apis".
+func HasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
+
+func (rt *Route) matches(r *http.Request, host, path string) bool {
+	if len(rt.hosts) > 0 && !slices.ContainsFunc(rt.hosts, func(p string) bool { return matchHost(p, host) }) {
+		return false
+	}
+	if len(rt.paths) > 0 && !slices.ContainsFunc(rt.paths, func(p string) bool { return HasPathPrefix(path, p) }) {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(path) {
+		return false
+	}
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	for header, re := range rt.headers {
+		if !re.MatchString(r.Header.Get(header)) {
+			return false
+		}
+	}
+	return true
+}
+
+type routeKey struct{}
+
+// FromContext returns the route the request matched, or nil.
+func FromContext(ctx context.Context) *Route {
+	rt, _ := ctx.Value(routeKey{}).(*Route)
+	return rt
+}
+
+// Middleware attaches the matching route to the request so the security
+// middleware and the proxy can act on it. The path is cleaned first, so
+// everything after it, the upstream included, sees the path that was routed.
+func (t *Table) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := cleanPath(r.URL.Path); p != r.URL.Path {
+			u := *r.URL
+			// The raw form may hold the encoded dot segments just removed
+			u.Path, u.RawPath = p, ""
+			r = r.WithContext(r.Context())
+			r.URL = &u
+		}
+		if rt := t.Match(r); rt != nil {
+			r = r.WithContext(context.WithValue(r.Context(), routeKey{}, rt))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
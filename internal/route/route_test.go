@@ -0,0 +1,115 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+)
+
+func TestTable_Match(t *testing.T) {
+	table, err := NewTable([]config.RouteConfig{
+		{Name: "api-v2", Hosts: []string{"api.example.com"}, PathRegex: `^/v2/`, Pool: "api-v2"},
+		{Name: "api", Hosts: []string{"api.example.com"}, Pool: "api"},
+		{Name: "tenants", Hosts: []string{"*.apps.example.com"}, Pool: "tenants"},
+		{Name: "uploads", Paths: []string{"/upload"}, Methods: []string{"POST", "PUT"}, Pool: "uploads"},
+		{Name: "health", Paths: []string{"/healthz"}, Pool: "health"},
+		{Name: "beta", Headers: map[string]string{"x-beta": "^(1|true)$"}, Pool: "beta"},
+	})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		host   string
+		path   string
+		header string
+		want   string
+	}{
+		{"GET", "api.example.com", "/v2/users", "", "api-v2"},
+		{"GET", "API.example.com:8443", "/v1/users", "", "api"},
+		{"GET", "shop.apps.example.com", "/", "", "tenants"},
+		{"GET", "apps.example.com", "/", "", ""},
+		{"POST", "www.example.com", "/upload/avatar", "", "uploads"},
+		{"GET", "www.example.com", "/upload/avatar", "", ""},
+		{"POST", "www.example.com", "/upload", "", "uploads"},
+		{"POST", "www.example.com", "/uploads", "", ""},
+		{"GET", "www.example.com", "/healthz", "", "health"},
+		{"GET", "www.example.com", "/healthzanything", "", ""},
+		{"GET", "www.example.com", "/healthz/../admin", "", ""},
+		{"GET", "www.example.com", "/healthz%2f..%2fadmin", "", ""},
+		{"GET", "www.example.com", "/admin/..//healthz/", "", "health"},
+		{"GET", "www.example.com", "/", "true", "beta"},
+		{"GET", "www.example.com", "/", "no", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("X-Beta", tt.header)
+		}
+		got := ""
+		if rt := table.Match(req); rt != nil {
+			got = rt.Pool
+		}
+		if got != tt.want {
+			t.Errorf("%s %s%s: got route to %q, want %q", tt.method, tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTable_Middleware(t *testing.T) {
+	table, _ := NewTable([]config.RouteConfig{{Paths: []string{"/admin"}, Pool: "admin"}})
+	var got *Route
+	handler := table.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/users", nil))
+	if got == nil || got.Name != "route-1" {
+		t.Errorf("expected the unnamed route in the context, got %+v", got)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got != nil {
+		t.Errorf("expected no route, got %+v", got)
+	}
+
+	// A replaced table takes effect in the existing middleware
+	reloaded, _ := NewTable([]config.RouteConfig{{Name: "all", Paths: []string{"/"}, Pool: "web"}})
+	table.Replace(reloaded)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/users", nil))
+	if got == nil || got.Name != "all" {
+		t.Errorf("expected the reloaded route, got %+v", got)
+	}
+}
+
+func TestTable_MiddlewareCleansPath(t *testing.T) {
+	table, _ := NewTable(nil)
+	var got string
+	handler := table.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.EscapedPath()
+	}))
+
+	tests := []struct{ path, want string }{
+		{"/healthz/../admin", "/admin"},
+		{"/healthz%2f..%2fadmin", "/admin"},
+		{"/a//b/./c/", "/a/b/c/"},
+		{"/files/a%2fb", "/files/a%2fb"},
+	}
+	for _, tt := range tests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if got != tt.want {
+			t.Errorf("%s: forwarded as %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewTable_InvalidRegex(t *testing.T) {
+	if _, err := NewTable([]config.RouteConfig{{Name: "bad", PathRegex: "("}}); err == nil {
+		t.Error("expected error for an invalid path regex")
+	}
+	if _, err := NewTable([]config.RouteConfig{{Name: "bad", Headers: map[string]string{"X": "["}}}); err == nil {
+		t.Error("expected error for an invalid header pattern")
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/tlsfp"
 )
 
 type Rule struct {
 	Name     string
 	Pattern  *regexp.Regexp
 	Location string
+	Action   string
 }
 
 type Engine struct {
@@ -25,17 +29,44 @@ func NewEngine(cfgRules []config.SecurityRule) (*Engine, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid regex for rule %s: %w", r.Name, err)
 		}
+		if r.Action != "" && r.Action != "block" && r.Action != "challenge" {
+			return nil, fmt.Errorf("invalid action %q for rule %s", r.Action, r.Name)
+		}
 		rules = append(rules, Rule{
 			Name:     r.Name,
 			Pattern:  re,
 			Location: r.Location,
+			Action:   r.Action,
 		})
 	}
 	return &Engine{Rules: rules}, nil
 }
 
 func (e *Engine) Check(r *http.Request, body []byte) (bool, string) {
-	for _, rule := range e.Rules {
+	if rule := e.Match(r, body, false); rule != nil {
+		return true, rule.Name
+	}
+	return false, ""
+}
+
+// Match returns the first rule that matches the request, or nil. Rules with
+// the "challenge" action are skipped when the client already passed a
+// challenge: their question has been answered for the lifetime of the
+// clearance cookie, so a matching request goes on to the next rule.
+func (e *Engine) Match(r *http.Request, body []byte, challengePassed bool) *Rule {
+	return e.MatchExcept(r, body, challengePassed, nil)
+}
+
+// MatchExcept is Match without the rules named in skip.
+func (e *Engine) MatchExcept(r *http.Request, body []byte, challengePassed bool, skip []string) *Rule {
+	for i := range e.Rules {
+		rule := &e.Rules[i]
+		if challengePassed && rule.Action == "challenge" {
+			continue
+		}
+		if slices.Contains(skip, rule.Name) {
+			continue
+		}
 		matched := false
 		switch rule.Location {
 		case "body":
@@ -69,11 +100,52 @@ func (e *Engine) Check(r *http.Request, body []byte) (bool, string) {
 				}
 			}
 			// Body inspection would go here (requires reading and restoring body)
+		case "grpc":
+			if method, ok := grpcMethod(r); ok {
+				matched = rule.Pattern.MatchString(method)
+			}
+		case "websocket":
+			// Only matched against WebSocket messages, see MatchMessage
+		case "ja3":
+			if fp := tlsfp.FromContext(r.Context()); fp != nil {
+				matched = rule.Pattern.MatchString(fp.JA3Hash) || rule.Pattern.MatchString(fp.JA3)
+			}
+		case "ja4":
+			if fp := tlsfp.FromContext(r.Context()); fp != nil {
+				matched = rule.Pattern.MatchString(fp.JA4)
+			}
 		}
 
 		if matched {
-			return true, rule.Name
+			return rule
 		}
 	}
-	return false, ""
+	return nil
+}
+
+// MatchMessage returns the first rule with location "body" or "websocket"
+// that matches a WebSocket message from the client, or nil.
+func (e *Engine) MatchMessage(msg []byte, challengePassed bool, skip []string) *Rule {
+	for i := range e.Rules {
+		rule := &e.Rules[i]
+		if rule.Location != "body" && rule.Location != "websocket" {
+			continue
+		}
+		if challengePassed && rule.Action == "challenge" || slices.Contains(skip, rule.Name) {
+			continue
+		}
+		if rule.Pattern.Match(msg) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// grpcMethod returns the "package.Service/Method" a gRPC call invokes.
+func grpcMethod(r *http.Request) (string, bool) {
+	ct, ok := strings.CutPrefix(r.Header.Get("Content-Type"), "application/grpc")
+	if !ok || ct != "" && ct[0] != '+' && ct[0] != ';' {
+		return "", false
+	}
+	return strings.TrimPrefix(r.URL.Path, "/"), true
 }
@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/tlsfp"
 )
 
 type Server struct {
@@ -15,6 +18,11 @@ type Server struct {
 }
 
 func NewServer(cfg config.ServerConfig, handler http.Handler) *Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true) // over TLS, negotiated through ALPN
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+
 	return &Server{
 		httpServer: &http.Server{
 			Addr:         ":" + cfg.Port,
@@ -22,6 +30,10 @@ func NewServer(cfg config.ServerConfig, handler http.Handler) *Server {
 			ReadTimeout:  cfg.ReadTimeout,
 			WriteTimeout: cfg.WriteTimeout,
 			IdleTimeout:  120 * time.Second, // Requirement: 120s
+			Protocols:    protocols,
+			// Fingerprint TLS clients (JA3/JA4) for the middleware chain
+			TLSConfig:   &tls.Config{GetConfigForClient: tlsfp.Record},
+			ConnContext: tlsfp.ConnContext,
 		},
 		certFile: cfg.CertFile,
 		keyFile:  cfg.KeyFile,
@@ -30,7 +42,11 @@ func NewServer(cfg config.ServerConfig, handler http.Handler) *Server {
 
 func (s *Server) Start() error {
 	if s.certFile != "" && s.keyFile != "" {
-		return s.httpServer.ListenAndServeTLS(s.certFile, s.keyFile)
+		ln, err := net.Listen("tcp", s.httpServer.Addr)
+		if err != nil {
+			return err
+		}
+		return s.httpServer.ServeTLS(tlsfp.Listen(ln), s.certFile, s.keyFile)
 	}
 	return s.httpServer.ListenAndServe()
 }
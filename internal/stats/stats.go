@@ -8,13 +8,18 @@ import (
 
 // LogEntry represents a single request log for the dashboard
 type LogEntry struct {
-	Timestamp  string `json:"timestamp"`
-	ClientIP   string `json:"client_ip"`
-	Method     string `json:"method"`
-	Path       string `json:"path"`
-	StatusCode int    `json:"status_code"`
-	Latency    string `json:"latency"`
-	Action     string `json:"action"`
+	Timestamp   string `json:"timestamp"`
+	ClientIP    string `json:"client_ip"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	StatusCode  int    `json:"status_code"`
+	Latency     string `json:"latency"`
+	Action      string `json:"action"`
+	Country     string `json:"country,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	JA3         string `json:"ja3,omitempty"`
+	JA4         string `json:"ja4,omitempty"`
+	ThreatScore int    `json:"threat_score,omitempty"`
 }
 
 // SystemStats represents runtime statistics
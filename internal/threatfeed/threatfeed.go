@@ -0,0 +1,196 @@
+// Package threatfeed reads IP reputation lists in common formats from local
+// files, directories or HTTP URLs.
+package threatfeed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yxorp/internal/config"
+	"github.com/yxorp/internal/iptrie"
+)
+
+// Entry is a network listed by a feed. Score is only set by CSV feeds.
+type Entry struct {
+	Prefix netip.Prefix
+	Score  int
+}
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// ValidFormat reports whether format is understood by Parse.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", "plain", "netset", "spamhaus", "csv":
+		return true
+	}
+	return false
+}
+
+// Load reads the feed from its URL, or from its path. A directory path loads
+// every regular file in it.
+func Load(feed config.ThreatFeed) ([]Entry, error) {
+	if feed.URL != "" {
+		resp, err := client.Get(feed.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected status %s", feed.URL, resp.Status)
+		}
+		return Parse(resp.Body, feed)
+	}
+
+	if feed.Path == "" {
+		return nil, errors.New("feed has neither path nor url")
+	}
+	info, err := os.Stat(feed.Path)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{feed.Path}
+	if info.IsDir() {
+		dirEntries, err := os.ReadDir(feed.Path)
+		if err != nil {
+			return nil, err
+		}
+		paths = paths[:0]
+		for _, e := range dirEntries {
+			if e.Type().IsRegular() {
+				paths = append(paths, filepath.Join(feed.Path, e.Name()))
+			}
+		}
+	}
+
+	var entries []Entry
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileEntries, err := Parse(f, feed)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+// Parse reads a feed in the configured format:
+//   - plain, netset: one address or CIDR per line with '#' or ';' comments,
+//     which covers FireHOL netsets and Spamhaus DROP text files
+//   - spamhaus: DROP/EDROP text files or their JSON lines variant
+//   - csv: address and score columns (1-based IPColumn and ScoreColumn,
+//     default 1 and 2); rows scoring below MinScore and a header row are
+//     skipped
+func Parse(r io.Reader, feed config.ThreatFeed) ([]Entry, error) {
+	switch feed.Format {
+	case "", "plain", "netset":
+		prefixes, err := iptrie.ReadList(r)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]Entry, len(prefixes))
+		for i, p := range prefixes {
+			entries[i] = Entry{Prefix: p}
+		}
+		return entries, nil
+	case "spamhaus":
+		return parseSpamhaus(r)
+	case "csv":
+		return parseCSV(r, feed)
+	}
+	return nil, fmt.Errorf("unknown feed format %q", feed.Format)
+}
+
+func parseSpamhaus(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(text, "{") {
+			var record struct {
+				CIDR string `json:"cidr"`
+			}
+			if err := json.Unmarshal([]byte(text), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if record.CIDR == "" {
+				continue // metadata record
+			}
+			text = record.CIDR
+		}
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		p, err := iptrie.ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, Entry{Prefix: p})
+	}
+	return entries, scanner.Err()
+}
+
+func parseCSV(r io.Reader, feed config.ThreatFeed) ([]Entry, error) {
+	ipCol, scoreCol := feed.IPColumn-1, feed.ScoreColumn-1
+	if ipCol < 0 {
+		ipCol = 0
+	}
+	if scoreCol < 0 {
+		scoreCol = 1
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []Entry
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ipCol >= len(record) || scoreCol >= len(record) {
+			return nil, fmt.Errorf("row %d: expected at least %d columns", row, max(ipCol, scoreCol)+1)
+		}
+
+		p, err := iptrie.ParsePrefix(record[ipCol])
+		if err != nil {
+			if row == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		}
+		score, err := strconv.ParseFloat(strings.TrimSpace(record[scoreCol]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid score: %w", row, err)
+		}
+		if score < float64(feed.MinScore) {
+			continue
+		}
+		entries = append(entries, Entry{Prefix: p, Score: int(score)})
+	}
+}
@@ -0,0 +1,95 @@
+package threatfeed
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yxorp/internal/config"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		feed  config.ThreatFeed
+		input string
+		want  []Entry
+	}{
+		{
+			name:  "plain",
+			input: "# comment\n192.0.2.1\n\n198.51.100.0/24 # trailing\n",
+			want: []Entry{
+				{Prefix: netip.MustParsePrefix("192.0.2.1/32")},
+				{Prefix: netip.MustParsePrefix("198.51.100.0/24")},
+			},
+		},
+		{
+			name:  "firehol netset",
+			feed:  config.ThreatFeed{Format: "netset"},
+			input: "#\n# firehol_level1\n#\n1.0.0.0/8\n2001:db8::/32\n",
+			want: []Entry{
+				{Prefix: netip.MustParsePrefix("1.0.0.0/8")},
+				{Prefix: netip.MustParsePrefix("2001:db8::/32")},
+			},
+		},
+		{
+			name:  "spamhaus drop text",
+			feed:  config.ThreatFeed{Format: "spamhaus"},
+			input: "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n",
+			want:  []Entry{{Prefix: netip.MustParsePrefix("1.10.16.0/20")}},
+		},
+		{
+			name:  "spamhaus drop json",
+			feed:  config.ThreatFeed{Format: "spamhaus"},
+			input: `{"cidr":"1.10.16.0/20","sblid":"SBL256894","rir":"apnic"}` + "\n" + `{"type":"metadata","timestamp":1700000000}` + "\n",
+			want:  []Entry{{Prefix: netip.MustParsePrefix("1.10.16.0/20")}},
+		},
+		{
+			name:  "csv with header and min score",
+			feed:  config.ThreatFeed{Format: "csv", IPColumn: 2, ScoreColumn: 3, MinScore: 50},
+			input: "id,ip,score\n1,192.0.2.1,90\n2,192.0.2.2,10\n3,198.51.100.0/24,55.5\n",
+			want: []Entry{
+				{Prefix: netip.MustParsePrefix("192.0.2.1/32"), Score: 90},
+				{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Score: 55},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input), tt.feed)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("entry %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := Parse(strings.NewReader("ip,score\n192.0.2.1,high\n"), config.ThreatFeed{Format: "csv"}); err == nil {
+		t.Error("expected error for a non-numeric score")
+	}
+}
+
+func TestLoad_Directory(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.netset"), []byte("192.0.2.0/24\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.netset"), []byte("198.51.100.1\n"), 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+
+	entries, err := Load(config.ThreatFeed{Path: dir})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %v", entries)
+	}
+}
@@ -0,0 +1,243 @@
+// Package tlsfp computes JA3 and JA4 fingerprints of TLS clients and carries
+// them from the handshake to the HTTP requests of the connection.
+package tlsfp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	extServerName        = 0x0000
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+// Fingerprint identifies the TLS stack of a client.
+type Fingerprint struct {
+	JA3     string `json:"ja3"`      // full JA3 string
+	JA3Hash string `json:"ja3_hash"` // MD5 of JA3, the commonly published form
+	JA4     string `json:"ja4"`
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients
+// randomize and fingerprints therefore ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal[T ~uint8 | ~uint16](values []T) string {
+	var b strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+	return b.String()
+}
+
+func joinHex(values []uint16) string {
+	var b strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%04x", v)
+	}
+	return b.String()
+}
+
+func hash12(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Compute fingerprints a ClientHello.
+//
+// The JA3 version field is the ClientHello legacy version, which crypto/tls
+// does not expose. It is derived instead: clients offering the
+// supported_versions extension always send TLS 1.2 there, older clients send
+// their maximum version.
+func Compute(hello *tls.ClientHelloInfo) *Fingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	versions := withoutGREASE(hello.SupportedVersions)
+
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+	curves = withoutGREASE(curves)
+
+	sigAlgs := make([]uint16, 0, len(hello.SignatureSchemes))
+	for _, s := range hello.SignatureSchemes {
+		sigAlgs = append(sigAlgs, uint16(s))
+	}
+	sigAlgs = withoutGREASE(sigAlgs)
+
+	maxVersion := uint16(0)
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+	legacyVersion := maxVersion
+	if slices.Contains(extensions, extSupportedVersions) {
+		legacyVersion = tls.VersionTLS12
+	}
+
+	fp := &Fingerprint{}
+	fp.JA3 = strings.Join([]string{
+		strconv.Itoa(int(legacyVersion)),
+		joinDecimal(ciphers),
+		joinDecimal(extensions),
+		joinDecimal(curves),
+		joinDecimal(hello.SupportedPoints),
+	}, ",")
+	sum := md5.Sum([]byte(fp.JA3))
+	fp.JA3Hash = hex.EncodeToString(sum[:])
+
+	fp.JA4 = ja4(maxVersion, ciphers, extensions, sigAlgs, hello.SupportedProtos)
+	return fp
+}
+
+func ja4(version uint16, ciphers, extensions, sigAlgs []uint16, alpn []string) string {
+	var a strings.Builder
+	a.WriteByte('t')
+	switch version {
+	case tls.VersionTLS13:
+		a.WriteString("13")
+	case tls.VersionTLS12:
+		a.WriteString("12")
+	case tls.VersionTLS11:
+		a.WriteString("11")
+	case tls.VersionTLS10:
+		a.WriteString("10")
+	case tls.VersionSSL30:
+		a.WriteString("s3")
+	default:
+		a.WriteString("00")
+	}
+	if slices.Contains(extensions, extServerName) {
+		a.WriteByte('d')
+	} else {
+		a.WriteByte('i')
+	}
+	fmt.Fprintf(&a, "%02d%02d", min(len(ciphers), 99), min(len(extensions), 99))
+	a.WriteString(alpnCode(alpn))
+
+	b := "000000000000"
+	if len(ciphers) > 0 {
+		b = hash12(joinHex(slices.Sorted(slices.Values(ciphers))))
+	}
+
+	c := "000000000000"
+	if len(extensions) > 0 {
+		exts := make([]uint16, 0, len(extensions))
+		for _, e := range extensions {
+			if e != extServerName && e != extALPN {
+				exts = append(exts, e)
+			}
+		}
+		slices.Sort(exts)
+		s := joinHex(exts)
+		if len(sigAlgs) > 0 {
+			s += "_" + joinHex(sigAlgs)
+		}
+		c = hash12(s)
+	}
+
+	return a.String() + "_" + b + "_" + c
+}
+
+// alpnCode is the first and last character of the first ALPN value, or the
+// first and last hex digit of its bytes when either is not alphanumeric.
+func alpnCode(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(p))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// conn remembers the fingerprint of its handshake.
+type conn struct {
+	net.Conn
+	fp atomic.Pointer[Fingerprint]
+}
+
+type listener struct {
+	net.Listener
+}
+
+// Listen wraps ln so that Record and ConnContext can attach fingerprints to
+// its connections. TLS must be layered on top of the returned listener.
+func Listen(ln net.Listener) net.Listener {
+	return listener{ln}
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c}, nil
+}
+
+// Record fingerprints the ClientHello. It has the signature of
+// tls.Config.GetConfigForClient and keeps the server's configuration.
+func Record(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if c, ok := hello.Conn.(*conn); ok {
+		c.fp.Store(Compute(hello))
+	}
+	return nil, nil
+}
+
+type connKey struct{}
+
+// ConnContext has the signature of http.Server.ConnContext and makes the
+// connection's fingerprint available through FromContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		if fc, ok := tc.NetConn().(*conn); ok {
+			return context.WithValue(ctx, connKey{}, fc)
+		}
+	}
+	return ctx
+}
+
+// FromContext returns the fingerprint of the TLS connection a request
+// arrived on, or nil for plain HTTP.
+func FromContext(ctx context.Context) *Fingerprint {
+	if c, ok := ctx.Value(connKey{}).(*conn); ok {
+		return c.fp.Load()
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package tlsfp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompute_JA3(t *testing.T) {
+	// Example from the JA3 reference implementation
+	hello := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:        []uint16{0, 10, 11},
+		SupportedCurves:   []tls.CurveID{23, 24, 25},
+		SupportedPoints:   []uint8{0},
+		SupportedVersions: []uint16{tls.VersionTLS10, tls.VersionSSL30},
+	}
+	fp := Compute(hello)
+	if want := "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"; fp.JA3 != want {
+		t.Errorf("JA3 = %q, want %q", fp.JA3, want)
+	}
+	if want := "ada70206e40642a3e4461f35503241d5"; fp.JA3Hash != want {
+		t.Errorf("JA3 hash = %q, want %q", fp.JA3Hash, want)
+	}
+}
+
+func TestCompute_JA4(t *testing.T) {
+	// Example from the JA4 specification, with GREASE values added
+	hello := &tls.ClientHelloInfo{
+		CipherSuites: []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+			0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d,
+			0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015, 0x4469},
+		SignatureSchemes:  []tls.SignatureScheme{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+	}
+	fp := Compute(hello)
+	if want := "t13d1516h2_8daaf6152771_e5627efa2ab1"; fp.JA4 != want {
+		t.Errorf("JA4 = %q, want %q", fp.JA4, want)
+	}
+	if fp.JA3[:4] != "771," {
+		t.Errorf("JA3 version for a TLS 1.3 client = %q, want 771", fp.JA3)
+	}
+}
+
+func TestServer_Fingerprint(t *testing.T) {
+	var got *Fingerprint
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+	srv.Listener = Listen(srv.Listener)
+	srv.Config.ConnContext = ConnContext
+	srv.TLS = &tls.Config{GetConfigForClient: Record}
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got == nil || got.JA3Hash == "" || got.JA4[:4] != "t13i" {
+		t.Errorf("unexpected fingerprint %+v", got)
+	}
+
+	if fp := FromContext(ConnContext(context.Background(), &net.TCPConn{})); fp != nil {
+		t.Errorf("expected no fingerprint for plain connections, got %+v", fp)
+	}
+}